@@ -0,0 +1,148 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/prometheus/snmp_exporter/collector"
+)
+
+var (
+	batchConcurrency = kingpin.Flag("snmp.batch-concurrency", "The number of targets to scrape concurrently in a batch request.").Default("16").Int()
+	batchMaxBodySize = int64(1 << 20)
+)
+
+// batchRequest is the body of a POST request to the prober endpoint.
+type batchRequest struct {
+	Targets []probe `json:"targets"`
+}
+
+// parseBatch builds the list of probes for a batch request. Targets are
+// either given as repeated 'target' parameters sharing the other query
+// parameters, or in a JSON body where the query parameters act as defaults.
+func parseBatch(w http.ResponseWriter, r *http.Request) ([]probe, error) {
+	query := r.URL.Query()
+	defaults, err := parseProbe(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var probes []probe
+	if r.Method == http.MethodPost {
+		var req batchRequest
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, batchMaxBodySize))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			return nil, fmt.Errorf("error parsing batch request body: %w", err)
+		}
+		for _, p := range req.Targets {
+			if p.Auth == "" {
+				p.Auth = defaults.Auth
+			}
+			if len(p.Modules) == 0 {
+				p.Modules = defaults.Modules
+			}
+			if p.SNMPContext == "" {
+				p.SNMPContext = defaults.SNMPContext
+			}
+			if p.SNMPEngineID == "" {
+				p.SNMPEngineID = defaults.SNMPEngineID
+			}
+			probes = append(probes, p)
+		}
+	} else {
+		for _, target := range query["target"] {
+			p := defaults
+			p.Target = target
+			probes = append(probes, p)
+		}
+	}
+
+	if len(probes) == 0 {
+		return nil, fmt.Errorf("at least one target must be specified")
+	}
+	seen := make(map[string]bool, len(probes))
+	for _, p := range probes {
+		if p.Target == "" {
+			return nil, fmt.Errorf("target must not be empty")
+		}
+		if seen[p.Target] {
+			return nil, fmt.Errorf("target '%s' specified more than once", p.Target)
+		}
+		seen[p.Target] = true
+	}
+	return probes, nil
+}
+
+// boundedCollector limits how many targets of a batch are scraped at once.
+type boundedCollector struct {
+	prometheus.Collector
+	ctx context.Context
+	sem chan struct{}
+}
+
+// Collect implements Prometheus.Collector.
+func (b boundedCollector) Collect(ch chan<- prometheus.Metric) {
+	select {
+	case b.sem <- struct{}{}:
+	case <-b.ctx.Done():
+		return
+	}
+	defer func() { <-b.sem }()
+	b.Collector.Collect(ch)
+}
+
+func batchHandler(w http.ResponseWriter, r *http.Request, logger *slog.Logger, exporterMetrics collector.Metrics, debug bool) {
+	probes, err := parseBatch(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		snmpRequestErrors.Inc()
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	sem := make(chan struct{}, max(*batchConcurrency, 1))
+	for _, p := range probes {
+		c, labels, err := newCollector(r.Context(), p, logger, exporterMetrics, debug, nil)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("target '%s': %s", p.Target, err), http.StatusBadRequest)
+			snmpRequestErrors.Inc()
+			return
+		}
+		// Each target's series are distinguished by target and instance labels.
+		reg := prometheus.WrapRegistererWith(prometheus.Labels{"target": p.Target, "instance": p.Target}, registry)
+		reg = prometheus.WrapRegistererWith(labels, reg)
+		if err := reg.Register(boundedCollector{Collector: c, ctx: r.Context(), sem: sem}); err != nil {
+			http.Error(w, fmt.Sprintf("target '%s': %s", p.Target, err), http.StatusInternalServerError)
+			snmpRequestErrors.Inc()
+			return
+		}
+	}
+	logger.Debug("Starting batch scrape", "targets", len(probes))
+	// A failing target must not hide the results of the others.
+	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		ErrorLog:      slog.NewLogLogger(logger.Handler(), slog.LevelError),
+		ErrorHandling: promhttp.ContinueOnError,
+	})
+	h.ServeHTTP(w, r)
+}
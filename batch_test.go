@@ -0,0 +1,209 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/collector"
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+func TestParseBatch(t *testing.T) {
+	cases := []struct {
+		name    string
+		method  string
+		url     string
+		body    string
+		want    []probe
+		wantErr string
+	}{
+		{
+			name:   "repeated targets share query parameters",
+			method: http.MethodGet,
+			url:    "/snmp?target=a&target=b&auth=v3&module=if_mib,system",
+			want: []probe{
+				{Target: "a", Auth: "v3", Modules: []string{"if_mib", "system"}},
+				{Target: "b", Auth: "v3", Modules: []string{"if_mib", "system"}},
+			},
+		},
+		{
+			name:   "body entries fall back to query parameters",
+			method: http.MethodPost,
+			url:    "/snmp?module=system",
+			body:   `{"targets": [{"target": "a"}, {"target": "b", "auth": "v3", "module": ["if_mib"], "snmp_context": "vrf"}]}`,
+			want: []probe{
+				{Target: "a", Modules: []string{"system"}},
+				{Target: "b", Auth: "v3", Modules: []string{"if_mib"}, SNMPContext: "vrf"},
+			},
+		},
+		{
+			name:    "duplicate targets",
+			method:  http.MethodGet,
+			url:     "/snmp?target=a&target=a",
+			wantErr: "target 'a' specified more than once",
+		},
+		{
+			name:    "empty body",
+			method:  http.MethodPost,
+			url:     "/snmp",
+			body:    `{"targets": []}`,
+			wantErr: "at least one target must be specified",
+		},
+		{
+			name:    "unknown field",
+			method:  http.MethodPost,
+			url:     "/snmp",
+			body:    `{"targets": [{"address": "a"}]}`,
+			wantErr: "error parsing batch request body",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+			got, err := parseBatch(httptest.NewRecorder(), req)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected error %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected probes %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestBatchHandlerRejectsUnknownModule(t *testing.T) {
+	conf := &config.Config{
+		Auths: map[string]*config.Auth{
+			"public_v2": {Community: "public", Version: 2},
+		},
+		Modules: map[string]*config.Module{
+			"if_mib": {},
+		},
+	}
+	sc = &SafeConfig{C: conf, modules: namedModules(conf)}
+
+	body := `{"targets": [{"target": "a"}, {"target": "b", "module": ["nope"]}]}`
+	req := httptest.NewRequest(http.MethodPost, "/snmp", strings.NewReader(body))
+	resp := httptest.NewRecorder()
+
+	handler(resp, req, nopLogger, collector.Metrics{})
+
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, resp.Code)
+	}
+	if !strings.Contains(resp.Body.String(), "target 'b': Unknown module 'nope'") {
+		t.Fatalf("unexpected response body: %q", resp.Body.String())
+	}
+}
+
+func TestBatchHandlerLabelsTargets(t *testing.T) {
+	dir := t.TempDir()
+	var query []string
+	for _, name := range []string{"a", "b"} {
+		recording := filepath.Join(dir, name+".snmprec")
+		if err := os.WriteFile(recording, []byte("1.3.6.1.2.1.1.3.0|67|12345\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		query = append(query, "target=file://"+recording)
+	}
+	conf := &config.Config{
+		Auths: map[string]*config.Auth{"public_v2": {Community: "public", Version: 2}},
+		Modules: map[string]*config.Module{
+			"system": {
+				Get:        []string{"1.3.6.1.2.1.1.3.0"},
+				Metrics:    []*config.Metric{{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge"}},
+				WalkParams: config.DefaultWalkParams,
+			},
+		},
+	}
+	sc = &SafeConfig{C: conf, modules: namedModules(conf)}
+	metrics := collector.Metrics{
+		SNMPCollectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "duration"}, []string{"module"}),
+		SNMPInflight:           prometheus.NewGauge(prometheus.GaugeOpts{Name: "inflight"}),
+	}
+	*fileTargets = true
+	defer func() { *fileTargets = false }()
+
+	resp := httptest.NewRecorder()
+	handler(resp, httptest.NewRequest(http.MethodGet, "/snmp?module=system&"+strings.Join(query, "&"), nil), nopLogger, metrics)
+	for _, name := range []string{"a", "b"} {
+		target := "file://" + filepath.Join(dir, name+".snmprec")
+		want := `sysUpTime{instance="` + target + `",target="` + target + `"} 12345`
+		if !strings.Contains(resp.Body.String(), want) {
+			t.Errorf("expected %s, got:\n%s", want, resp.Body.String())
+		}
+	}
+}
+
+func TestBatchHandlerInventoryLabels(t *testing.T) {
+	recording := filepath.Join(t.TempDir(), "core.snmprec")
+	if err := os.WriteFile(recording, []byte("1.3.6.1.2.1.1.3.0|67|12345\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	conf := &config.Config{
+		Auths: map[string]*config.Auth{"public_v2": {Community: "public", Version: 2}},
+		Modules: map[string]*config.Module{
+			"system": {
+				Get:        []string{"1.3.6.1.2.1.1.3.0"},
+				Metrics:    []*config.Metric{{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge"}},
+				WalkParams: config.DefaultWalkParams,
+			},
+		},
+		Targets: map[string]*config.Target{
+			"core1": {Address: "file://" + recording, Modules: []string{"system"}, Labels: map[string]string{"site": "ams1"}},
+			"core2": {Address: "file://" + recording, Modules: []string{"system"}, Labels: map[string]string{"site": "fra1"}},
+		},
+	}
+	sc = &SafeConfig{C: conf, modules: namedModules(conf)}
+	metrics := collector.Metrics{
+		SNMPCollectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "duration"}, []string{"module"}),
+		SNMPInflight:           prometheus.NewGauge(prometheus.GaugeOpts{Name: "inflight"}),
+	}
+	*fileTargets = true
+	defer func() { *fileTargets = false }()
+
+	resp := httptest.NewRecorder()
+	handler(resp, httptest.NewRequest(http.MethodGet, "/snmp?target=core1&target=core2", nil), nopLogger, metrics)
+	for target, site := range map[string]string{"core1": "ams1", "core2": "fra1"} {
+		want := `sysUpTime{instance="` + target + `",site="` + site + `",target="` + target + `"} 12345`
+		if !strings.Contains(resp.Body.String(), want) {
+			t.Errorf("expected %s, got:\n%s", want, resp.Body.String())
+		}
+	}
+
+	// Labels clashing with the ones of the batch fail the target instead
+	// of panicking, even if they weren't rejected when loading.
+	conf.Targets["core2"].Labels = map[string]string{"instance": "core2"}
+	resp = httptest.NewRecorder()
+	handler(resp, httptest.NewRequest(http.MethodGet, "/snmp?target=core1&target=core2", nil), nopLogger, metrics)
+	if resp.Code != http.StatusInternalServerError || !strings.Contains(resp.Body.String(), "target 'core2'") {
+		t.Errorf("expected an error for core2, got %d: %q", resp.Code, resp.Body.String())
+	}
+}
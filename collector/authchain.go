@@ -0,0 +1,330 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+const sysUpTimeOID = "1.3.6.1.2.1.1.3.0"
+
+// The auths accepted by targets that weren't scraped for this long are
+// forgotten, so that targets that are no longer scraped don't pile up.
+const acceptedTTL = 24 * time.Hour
+
+// AuthChain is a list of auths that are tried in order until a target accepts
+// one. The auth that was accepted is remembered for each target, and tried
+// first the next time.
+type AuthChain struct {
+	names []string
+	auths []*config.Auth
+
+	mu        sync.Mutex
+	accepted  map[string]acceptedAuth
+	lastSweep time.Time
+}
+
+// acceptedAuth is the index of the auth a target accepted, and when the
+// target was last scraped with it.
+type acceptedAuth struct {
+	index int
+	used  time.Time
+}
+
+// NewAuthChain returns the chain of an auth, whose auths are looked up in
+// auths. It returns nil if the auth has no chain.
+func NewAuthChain(auth *config.Auth, auths map[string]*config.Auth) *AuthChain {
+	if len(auth.Chain) == 0 {
+		return nil
+	}
+	chain := &AuthChain{accepted: map[string]acceptedAuth{}, lastSweep: time.Now()}
+	for _, name := range auth.Chain {
+		if a, ok := auths[name]; ok {
+			chain.names = append(chain.names, name)
+			chain.auths = append(chain.auths, a)
+		}
+	}
+	return chain
+}
+
+// Update takes over the auths that targets accepted from the chain of the
+// same auth in the previous configuration, if it chains the same auths.
+func (a *AuthChain) Update(previous *AuthChain) {
+	if previous == nil || !slices.Equal(a.names, previous.names) {
+		return
+	}
+	previous.mu.Lock()
+	accepted := maps.Clone(previous.accepted)
+	previous.mu.Unlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.accepted = accepted
+}
+
+// order returns the indexes of the auths to try for a target.
+func (a *AuthChain) order(target string) []int {
+	a.mu.Lock()
+	accepted, ok := a.accepted[target]
+	a.mu.Unlock()
+	order := make([]int, 0, len(a.auths))
+	if ok {
+		order = append(order, accepted.index)
+	}
+	for i := range a.auths {
+		if !ok || i != accepted.index {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+func (a *AuthChain) remember(target string, i int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.accepted[target] = acceptedAuth{index: i, used: time.Now()}
+	a.sweep()
+}
+
+func (a *AuthChain) forget(target string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.accepted, target)
+}
+
+// UseAuthChain makes the collector scrape with the first auth of the chain
+// that the target accepts, rather than with the auth it was created with.
+func (c *Collector) UseAuthChain(chain *AuthChain) {
+	c.authChain = chain
+}
+
+// remembered returns the auth the target accepted last, if any.
+func (a *AuthChain) remembered(target string) (string, *config.Auth, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	accepted, ok := a.accepted[target]
+	if !ok {
+		return "", nil, false
+	}
+	accepted.used = time.Now()
+	a.accepted[target] = accepted
+	a.sweep()
+	return a.names[accepted.index], a.auths[accepted.index], true
+}
+
+// sweep forgets the targets that weren't scraped for the TTL, once per TTL.
+// It must be called with the lock held.
+func (a *AuthChain) sweep() {
+	if time.Since(a.lastSweep) < acceptedTTL {
+		return
+	}
+	a.lastSweep = time.Now()
+	for target, accepted := range a.accepted {
+		if time.Since(accepted.used) > acceptedTTL {
+			delete(a.accepted, target)
+		}
+	}
+}
+
+// resolveAuth tries the auths of the chain with a get of sysUpTime, until one
+// is answered. Only timeouts and authentication failures move on to the next
+// auth. The auth named skip, which the target just rejected, isn't tried.
+func (c Collector) resolveAuth(ctx context.Context, skip string) (string, *config.Auth, error) {
+	order := slices.DeleteFunc(c.authChain.order(c.target), func(i int) bool {
+		return c.authChain.names[i] == skip
+	})
+	var err error
+	for n, i := range order {
+		name, auth := c.authChain.names[i], c.authChain.auths[i]
+		logger := c.logger.With("chained_auth", name)
+		err = c.tryAuth(ctx, logger, auth, len(order)-n)
+		if err == nil {
+			logger.Debug("Target accepted auth")
+			c.authChain.remember(c.target, i)
+			return name, auth, nil
+		}
+		if !authFailure(err) {
+			break
+		}
+		logger.Debug("Target did not accept auth", "err", err)
+	}
+	c.authChain.forget(c.target)
+	if err == nil {
+		err = fmt.Errorf("auth chain is empty")
+	}
+	return "", nil, err
+}
+
+// authFailure reports whether an error could be because the target doesn't
+// accept the auth, so that the next auth of the chain is tried.
+func authFailure(err error) bool {
+	reason := errorReason(err)
+	return reason == reasonAuth || reason == reasonTimeout
+}
+
+// tryAuth gets sysUpTime with an auth, leaving time for the auths that are
+// tried after it.
+func (c Collector) tryAuth(ctx context.Context, logger *slog.Logger, auth *config.Auth, left int) error {
+	c.auth = auth
+	client, err := c.connect(ctx, logger)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		g.Retries = *config.DefaultWalkParams.Retries
+		g.Timeout = config.DefaultWalkParams.Timeout
+		if deadline, ok := c.ctx.Deadline(); ok {
+			g.Timeout, g.Retries = fitDeadline(g.Timeout, g.Retries, time.Until(deadline)/time.Duration(left))
+		}
+	})
+	_, err = client.Get([]string{sysUpTimeOID})
+	return err
+}
+
+func authInfoMetric(module, auth string) prometheus.Metric {
+	return prometheus.MustNewConstMetric(
+		prometheus.NewDesc("snmp_scrape_auth_info", "The auth of the chain that the target accepted.", []string{"auth"}, prometheus.Labels{"module": module}),
+		prometheus.GaugeValue,
+		1, auth)
+}
+
+// errAuthRejected is returned for the requests of a scrape once the target
+// didn't accept or answer the auth it accepted before.
+var errAuthRejected = errors.New("target no longer accepts the auth")
+
+// authGate holds the requests of a scrape with the auth a target accepted
+// before until the first of them is answered. If the target rejects the auth
+// or doesn't answer, all of the requests fail with errAuthRejected, and the
+// modules are scraped again with another auth of the chain.
+type authGate struct {
+	mu      sync.Mutex
+	started bool
+
+	once     sync.Once
+	decided  chan struct{}
+	rejected bool
+}
+
+func newAuthGate() *authGate {
+	return &authGate{decided: make(chan struct{})}
+}
+
+func (g *authGate) decide(rejected bool) {
+	g.once.Do(func() {
+		g.rejected = rejected
+		close(g.decided)
+	})
+}
+
+// failed reports whether the target rejected the auth.
+func (g *authGate) failed() bool {
+	if g == nil {
+		return false
+	}
+	select {
+	case <-g.decided:
+		return g.rejected
+	default:
+		return false
+	}
+}
+
+// reject decides the auth was rejected if no request was answered and the
+// error could be because of the auth, such as when no worker could connect.
+func (g *authGate) reject(err error) bool {
+	if g == nil {
+		return false
+	}
+	if authFailure(err) {
+		g.decide(true)
+	}
+	return g.failed()
+}
+
+// do makes a request once the auth is known to be accepted, or as the
+// first request, which decides whether it is. The request calls answered
+// when it gets a response part way through, such as the first PDU of a walk.
+func (g *authGate) do(req func(answered func()) error) error {
+	g.mu.Lock()
+	first := !g.started
+	g.started = true
+	g.mu.Unlock()
+	if !first {
+		<-g.decided
+		if g.rejected {
+			return errAuthRejected
+		}
+		return req(func() {})
+	}
+	err := req(func() { g.decide(false) })
+	g.decide(err != nil && authFailure(err))
+	if g.rejected {
+		return fmt.Errorf("%w: %w", errAuthRejected, err)
+	}
+	return err
+}
+
+// scraper returns the client the requests of a module are made with.
+func (g *authGate) scraper(client scraper.SNMPScraper) scraper.SNMPScraper {
+	if g == nil {
+		return client
+	}
+	return &gatedScraper{SNMPScraper: client, gate: g}
+}
+
+type gatedScraper struct {
+	scraper.SNMPScraper
+	gate *authGate
+}
+
+func (s *gatedScraper) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	var packet *gosnmp.SnmpPacket
+	err := s.gate.do(func(func()) error {
+		var err error
+		packet, err = s.SNMPScraper.Get(oids)
+		return err
+	})
+	return packet, err
+}
+
+func (s *gatedScraper) WalkAll(oid string) ([]gosnmp.SnmpPDU, error) {
+	var pdus []gosnmp.SnmpPDU
+	err := s.Walk(oid, func(pdu gosnmp.SnmpPDU) error {
+		pdus = append(pdus, pdu)
+		return nil
+	})
+	return pdus, err
+}
+
+func (s *gatedScraper) Walk(oid string, fn func(gosnmp.SnmpPDU) error) error {
+	return s.gate.do(func(answered func()) error {
+		return s.SNMPScraper.Walk(oid, func(pdu gosnmp.SnmpPDU) error {
+			answered()
+			return fn(pdu)
+		})
+	})
+}
@@ -0,0 +1,195 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+	"github.com/prometheus/snmp_exporter/simulator"
+)
+
+// countingConn counts the packets an agent receives.
+type countingConn struct {
+	net.PacketConn
+	received atomic.Int32
+}
+
+func (c *countingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil {
+		c.received.Add(1)
+	}
+	return n, addr, err
+}
+
+func TestCollectAuthChain(t *testing.T) {
+	metrics := Metrics{
+		SNMPCollectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "d"}, []string{"module"}),
+		SNMPUnexpectedPduType:  prometheus.NewCounter(prometheus.CounterOpts{Name: "u"}),
+		SNMPDuration:           prometheus.NewHistogram(prometheus.HistogramOpts{Name: "p"}),
+		SNMPPackets:            prometheus.NewCounter(prometheus.CounterOpts{Name: "s"}),
+		SNMPRetries:            prometheus.NewCounter(prometheus.CounterOpts{Name: "r"}),
+		SNMPInflight:           prometheus.NewGauge(prometheus.GaugeOpts{Name: "i"}),
+	}
+	pdus, err := scraper.ReadSnmprec(strings.NewReader("1.3.6.1.2.1.1.3.0|67|12345\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auths := map[string]*config.Auth{
+		"public_v2": {Community: "public", Version: 2},
+		"wrong_v3":  {Username: "admin", SecurityLevel: "authNoPriv", Password: "pancakes", AuthProtocol: "SHA", Version: 3},
+		"admin_v3":  {Username: "admin", SecurityLevel: "authNoPriv", Password: "maplesyrup", AuthProtocol: "SHA", Version: 3},
+	}
+	// The agent only accepts the v3 user.
+	agent, err := simulator.NewAgent(promslog.NewNopLogger(), pdus, []*config.Auth{auths["admin_v3"]}, nil, simulator.Faults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted := &countingConn{PacketConn: conn}
+	go agent.ServePacket(counted)
+	defer conn.Close()
+	target := conn.LocalAddr().String()
+
+	retries := 0
+	module := NewNamedModule("system", &config.Module{
+		Get:        []string{"1.3.6.1.2.1.1.3.0"},
+		Metrics:    []*config.Metric{{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge"}},
+		WalkParams: config.WalkParams{Retries: &retries, Timeout: 500 * time.Millisecond, MaxRepetitions: 2},
+	})
+	collect := func(chain *AuthChain) map[string]string {
+		ctx, cancel := context.WithTimeout(context.Background(), 900*time.Millisecond)
+		defer cancel()
+		c := New(ctx, target, "migrating", "", "", &config.Auth{}, []*NamedModule{module}, promslog.NewNopLogger(), metrics, 1, false)
+		c.UseAuthChain(chain)
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		// The labels of the auth and error info, and the value of sysUpTime.
+		got := map[string]string{}
+		seen := map[string]bool{}
+		for m := range ch {
+			var pb io_prometheus_client.Metric
+			if err := m.Write(&pb); err != nil {
+				t.Fatal(err)
+			}
+			desc := m.Desc().String()
+			if seen[desc] {
+				t.Fatalf("duplicate metric %s", desc)
+			}
+			seen[desc] = true
+			for _, name := range []string{"snmp_scrape_auth_info", "snmp_scrape_error_info", "sysUpTime"} {
+				if !strings.Contains(desc, `"`+name+`"`) {
+					continue
+				}
+				got[name] = ""
+				for _, l := range pb.GetLabel() {
+					if l.GetName() == "auth" || l.GetName() == "reason" {
+						got[name] = l.GetValue()
+					}
+				}
+			}
+		}
+		return got
+	}
+
+	chain := NewAuthChain(&config.Auth{Chain: []string{"public_v2", "wrong_v3", "admin_v3"}}, auths)
+	for i := range 2 {
+		got := collect(chain)
+		if _, ok := got["sysUpTime"]; !ok || got["snmp_scrape_auth_info"] != "admin_v3" {
+			t.Fatalf("scrape %d: expected sysUpTime with auth admin_v3, got %v", i, got)
+		}
+		// The auth that was accepted is tried first from then on.
+		if order := chain.order(target); order[0] != 2 {
+			t.Fatalf("scrape %d: expected admin_v3 to be tried first, got %v", i, order)
+		}
+	}
+	// Once the auth is known, the scrape uses it straight away: the engine
+	// is discovered and sysUpTime is got, without trying the auth first.
+	counted.received.Store(0)
+	collect(chain)
+	if got := counted.received.Load(); got != 2 {
+		t.Fatalf("expected 2 requests with the accepted auth, got %d", got)
+	}
+
+	// The chain is only tried again when the target no longer accepts the
+	// auth it accepted before.
+	chain = NewAuthChain(&config.Auth{Chain: []string{"wrong_v3", "admin_v3"}}, auths)
+	chain.remember(target, 0)
+	got := collect(chain)
+	if _, ok := got["sysUpTime"]; !ok || got["snmp_scrape_auth_info"] != "admin_v3" {
+		t.Fatalf("expected sysUpTime with auth admin_v3, got %v", got)
+	}
+	if _, ok := got["snmp_scrape_error_info"]; ok {
+		t.Fatalf("expected no error for the rejected auth, got %v", got)
+	}
+	if order := chain.order(target); order[0] != 1 {
+		t.Fatalf("expected admin_v3 to be tried first, got %v", order)
+	}
+
+	got = collect(NewAuthChain(&config.Auth{Chain: []string{"wrong_v3"}}, auths))
+	if _, ok := got["sysUpTime"]; ok || got["snmp_scrape_error_info"] != reasonAuth {
+		t.Fatalf("expected an auth error, got %v", got)
+	}
+}
+
+func TestAuthChainUpdate(t *testing.T) {
+	auths := map[string]*config.Auth{
+		"public_v2": {Community: "public", Version: 2},
+		"admin_v3":  {Username: "admin", Version: 3},
+	}
+	chain := NewAuthChain(&config.Auth{Chain: []string{"public_v2", "admin_v3"}}, auths)
+	chain.remember("a", 1)
+	chain.remember("b", 1)
+
+	// Chains of the same auths keep what targets accepted, even if the
+	// auths themselves changed.
+	auths["admin_v3"] = &config.Auth{Username: "admin", Password: "rotated", Version: 3}
+	reloaded := NewAuthChain(&config.Auth{Chain: []string{"public_v2", "admin_v3"}}, auths)
+	reloaded.Update(chain)
+	if name, auth, ok := reloaded.remembered("a"); !ok || name != "admin_v3" || auth.Password != "rotated" {
+		t.Fatalf("expected target to keep admin_v3, got %q %v", name, ok)
+	}
+	changed := NewAuthChain(&config.Auth{Chain: []string{"admin_v3", "public_v2"}}, auths)
+	changed.Update(reloaded)
+	if _, _, ok := changed.remembered("a"); ok {
+		t.Fatal("expected a changed chain to forget the accepted auths")
+	}
+
+	// Targets that are no longer scraped are forgotten.
+	reloaded.mu.Lock()
+	reloaded.accepted["b"] = acceptedAuth{index: 1, used: time.Now().Add(-2 * acceptedTTL)}
+	reloaded.lastSweep = time.Now().Add(-2 * acceptedTTL)
+	reloaded.mu.Unlock()
+	if _, _, ok := reloaded.remembered("a"); !ok {
+		t.Fatal("expected the scraped target to be kept")
+	}
+	if _, _, ok := reloaded.remembered("b"); ok {
+		t.Fatal("expected the target that is no longer scraped to be forgotten")
+	}
+}
@@ -17,12 +17,14 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
-	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alecthomas/kingpin/v2"
@@ -39,6 +41,9 @@ var (
 	float64Mantissa uint64 = 9007199254740992
 	wrapCounters           = kingpin.Flag("snmp.wrap-large-counters", "Wrap 64-bit counters to avoid floating point rounding.").Default("true").Bool()
 	srcAddress             = kingpin.Flag("snmp.source-address", "Source address to send snmp from in the format 'address:port' to use when connecting targets. If the port parameter is empty or '0', as in '127.0.0.1:' or '[::1]:0', a source port number is automatically (random) chosen.").Default("").String()
+
+	// The shortest timeout an attempt is given when fitting a scrape deadline.
+	minAttemptTimeout = time.Second
 )
 
 // Types preceded by an enum with their actual type.
@@ -85,11 +90,38 @@ func listToOid(l []int) string {
 }
 
 type ScrapeResults struct {
-	pdus []gosnmp.SnmpPDU
+	pdus     []gosnmp.SnmpPDU
+	failures []scrapeFailure
+}
+
+// scrapeFailure is an OID whose walk or get failed.
+type scrapeFailure struct {
+	oid    string
+	reason string
+}
+
+func (r *ScrapeResults) fail(reason string, oids ...string) {
+	for _, oid := range oids {
+		r.failures = append(r.failures, scrapeFailure{oid: oid, reason: reason})
+	}
+}
+
+// stopScrape reports whether a failed walk or get ends the scrape of a
+// module. Otherwise the failure is recorded and the scrape carries on.
+func stopScrape(module *config.Module, err error) bool {
+	return module.Required || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || errors.Is(err, errAuthRejected)
 }
 
+// ScrapeTarget scrapes a module, returning all the PDUs at once.
 func ScrapeTarget(snmp scraper.SNMPScraper, target string, auth *config.Auth, module *config.Module, logger *slog.Logger, metrics Metrics) (ScrapeResults, error) {
 	results := ScrapeResults{}
+	err := scrapeTarget(snmp, target, auth, module, logger, metrics, &results, &results)
+	return results, err
+}
+
+// scrapeTarget scrapes a module, handing the PDUs to the sink as they
+// arrive. Failed walks and gets are recorded in the results.
+func scrapeTarget(snmp scraper.SNMPScraper, target string, auth *config.Auth, module *config.Module, logger *slog.Logger, metrics Metrics, results *ScrapeResults, sink pduSink) error {
 	// Evaluate rules.
 	newGet := module.Get
 	newWalk := module.Walk
@@ -103,10 +135,17 @@ func ScrapeTarget(snmp scraper.SNMPScraper, target string, auth *config.Auth, mo
 
 	for _, filter := range module.Filters {
 		allowedList := []string{}
-		pdus, err := snmp.WalkAll(filter.Oid)
+		// The filters of modules that weren't prepared are compiled here.
+		if err := filter.Compile(); err != nil {
+			logger.Info("Invalid filter, won't do any filter on this oid", "oid", filter.Oid, "err", err)
+			results.fail(reasonError, filter.Oid)
+			continue
+		}
+		pdus, err := walkFilter(snmp, filter.Oid)
 		// Do not try to filter anything if we had errors.
 		if err != nil {
-			logger.Info("Error getting OID, won't do any filter on this oid", "oid", filter.Oid)
+			logger.Info("Error getting OID, won't do any filter on this oid", "oid", filter.Oid, "err", err)
+			results.fail(errorReason(err), filter.Oid)
 			continue
 		}
 
@@ -146,7 +185,13 @@ func ScrapeTarget(snmp scraper.SNMPScraper, target string, auth *config.Auth, mo
 
 		packet, err := snmp.Get(getOids[:oids])
 		if err != nil {
-			return results, err
+			if stopScrape(module, err) {
+				return err
+			}
+			logger.Info("Error getting OIDs, skipping them", "oids", getOids[:oids], "err", err)
+			results.fail(errorReason(err), getOids[:oids]...)
+			getOids = getOids[oids:]
+			continue
 		}
 		// SNMPv1 will return packet error for unsupported OIDs.
 		if packet.Error == gosnmp.NoSuchName && version == 1 {
@@ -155,28 +200,44 @@ func ScrapeTarget(snmp scraper.SNMPScraper, target string, auth *config.Auth, mo
 			continue
 		}
 		// Response received with errors.
-		// TODO: "stringify" gosnmp errors instead of showing error code.
 		if packet.Error != gosnmp.NoError {
-			return results, fmt.Errorf("error reported by target %s: Error Status %d", target, packet.Error)
+			err := agentError{target: target, status: packet.Error}
+			if module.Required {
+				return err
+			}
+			logger.Info("Error getting OIDs, skipping them", "oids", getOids[:oids], "err", err)
+			results.fail(reasonAgentError, getOids[:oids]...)
+			getOids = getOids[oids:]
+			continue
 		}
 		for _, v := range packet.Variables {
 			if v.Type == gosnmp.NoSuchObject || v.Type == gosnmp.NoSuchInstance || v.Type == gosnmp.EndOfMibView {
 				logger.Debug("OID not supported by target", "oids", v.Name)
 				continue
 			}
-			results.pdus = append(results.pdus, v)
+			sink.add(v)
 		}
 		getOids = getOids[oids:]
 	}
 
+	sink.walking(newWalk)
 	for _, subtree := range newWalk {
-		pdus, err := snmp.WalkAll(subtree)
+		// What an interrupted walk returned is kept, in case the caller can
+		// use partial results.
+		err := snmp.Walk(subtree, func(pdu gosnmp.SnmpPDU) error {
+			sink.add(pdu)
+			return nil
+		})
+		sink.walked(subtree)
 		if err != nil {
-			return results, err
+			if stopScrape(module, err) {
+				return err
+			}
+			logger.Info("Error walking subtree, skipping it", "oid", subtree, "err", err)
+			results.fail(errorReason(err), subtree)
 		}
-		results.pdus = append(results.pdus, pdus...)
 	}
-	return results, nil
+	return nil
 }
 
 // intersectIndices returns the indices present in both a and b, preserving
@@ -198,17 +259,9 @@ func intersectIndices(a, b []string) []string {
 func filterAllowedIndices(logger *slog.Logger, filter config.DynamicFilter, pdus []gosnmp.SnmpPDU, allowedList []string, metrics Metrics) []string {
 	logger.Debug("Evaluating rule for oid", "oid", filter.Oid)
 	for _, pdu := range pdus {
-		found := false
-		for _, val := range filter.Values {
-			snmpval := pduValueAsString(&pdu, "DisplayString", "", metrics)
-			logger.Debug("evaluating filters", "config value", val, "snmp value", snmpval)
-
-			if regexp.MustCompile(val).MatchString(snmpval) {
-				found = true
-				break
-			}
-		}
-		if found {
+		snmpval := pduValueAsString(&pdu, "DisplayString", "", metrics)
+		logger.Debug("evaluating filters", "config values", filter.Values, "snmp value", snmpval)
+		if filter.Matches(snmpval) {
 			pduArray := strings.Split(pdu.Name, ".")
 			index := pduArray[len(pduArray)-1]
 			logger.Debug("Caching index", "index", index)
@@ -267,7 +320,7 @@ func addAllowedIndices(filter config.DynamicFilter, allowedList []string, logger
 }
 
 type MetricNode struct {
-	metric *config.Metric
+	metric *preparedMetric
 
 	children map[int]*MetricNode
 }
@@ -284,11 +337,27 @@ func buildMetricTree(metrics []*config.Metric) *MetricNode {
 			}
 			head = head.children[o]
 		}
-		head.metric = metric
+		head.metric = newPreparedMetric(metric)
 	}
 	return metricTree
 }
 
+// findMetric returns the metric an OID belongs to, along with its index.
+func findMetric(tree *MetricNode, oidList []int) (*preparedMetric, []int) {
+	head := tree
+	for i, o := range oidList {
+		var ok bool
+		head, ok = head.children[o]
+		if !ok {
+			return nil, nil
+		}
+		if head.metric != nil {
+			return head.metric, oidList[i+1:]
+		}
+	}
+	return nil, nil
+}
+
 type Metrics struct {
 	SNMPCollectionDuration *prometheus.HistogramVec
 	SNMPUnexpectedPduType  prometheus.Counter
@@ -296,18 +365,41 @@ type Metrics struct {
 	SNMPPackets            prometheus.Counter
 	SNMPRetries            prometheus.Counter
 	SNMPInflight           prometheus.Gauge
+	// USM reports received from targets by report, if set.
+	SNMPReports *prometheus.CounterVec
 }
 
+// NamedModule is a module prepared for scraping. It is built once per
+// configuration load and must not be changed afterwards, as it is shared
+// by concurrent scrapes.
 type NamedModule struct {
 	*config.Module
-	name string
+	name       string
+	metricTree *MetricNode
+	// All the columns the metrics read from other PDUs.
+	lookupTree *oidTree
+	// Whether a scrape could return the same PDU twice.
+	mayRepeat bool
 }
 
 func NewNamedModule(name string, module *config.Module) *NamedModule {
-	return &NamedModule{
-		Module: module,
-		name:   name,
+	m := &NamedModule{
+		Module:     module,
+		name:       name,
+		metricTree: buildMetricTree(module.Metrics),
+		lookupTree: &oidTree{},
+		mayRepeat:  module.WalkParams.AllowNonIncreasingOIDs || overlaps(append(append([]string{}, module.Walk...), module.Get...)),
+	}
+	for _, metric := range module.Metrics {
+		for _, column := range lookupColumns(metric) {
+			m.lookupTree.add(column)
+		}
+	}
+	for i := range module.Filters {
+		// Filters with invalid values are reported when they are used.
+		_ = module.Filters[i].Compile()
 	}
+	return m
 }
 
 type Collector struct {
@@ -322,6 +414,16 @@ type Collector struct {
 	snmpContext  string
 	snmpEngineID string
 	debugSNMP    bool
+	recorder     *scraper.Recorder
+	selector     *ModuleSelector
+	authChain    *AuthChain
+	// The auth of the chain and how its requests are held, and the engine
+	// of the target, while scraping.
+	chainedAuth string
+	gate        *authGate
+	engine      *targetEngine
+	engines     *EngineCache
+	sessions    *SessionPool
 }
 
 func New(ctx context.Context, target, authName, snmpContext, snmpEngineID string, auth *config.Auth, modules []*NamedModule, logger *slog.Logger, metrics Metrics, conc int, debugSNMP bool) *Collector {
@@ -340,12 +442,41 @@ func New(ctx context.Context, target, authName, snmpContext, snmpEngineID string
 	}
 }
 
+// UseEngineCache makes the collector reuse the SNMPv3 engines of targets and
+// the keys localized to them across scrapes.
+func (c *Collector) UseEngineCache(cache *EngineCache) {
+	c.engines = cache
+}
+
+// UseSessionPool makes the collector borrow the sessions of its scrapes from
+// a pool, and return them to it once done.
+func (c *Collector) UseSessionPool(pool *SessionPool) {
+	c.sessions = pool
+}
+
+// RecordTo records the PDUs of the scrapes to r.
+func (c *Collector) RecordTo(r *scraper.Recorder) {
+	c.recorder = r
+}
+
+// newScraper returns the client scraping a target. Targets starting with
+// file:// replay the recording in that file.
+func newScraper(logger *slog.Logger, target string, debug bool) (scraper.SNMPScraper, error) {
+	if path, ok := strings.CutPrefix(target, "file://"); ok {
+		return scraper.NewFileScraper(path)
+	}
+	return scraper.NewGoSNMP(logger, target, *srcAddress, debug)
+}
+
 // Describe implements Prometheus.Collector.
 func (c Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- prometheus.NewDesc("dummy", "dummy", nil, nil)
 }
 
-func (c Collector) collect(ch chan<- prometheus.Metric, logger *slog.Logger, client scraper.SNMPScraper, module *NamedModule) {
+// collect scrapes a module. It returns whether the target no longer accepts
+// the auth of the chain it accepted before, in which case nothing is reported
+// for the module so it can be scraped again with another auth.
+func (c Collector) collect(ch chan<- prometheus.Metric, logger *slog.Logger, client scraper.SNMPScraper, module *NamedModule) (rejected bool) {
 	var (
 		packets uint64
 		retries uint64
@@ -371,6 +502,10 @@ func (c Collector) collect(ch chan<- prometheus.Metric, logger *slog.Logger, cli
 		func(g *gosnmp.GoSNMP) {
 			g.Retries = *module.WalkParams.Retries
 			g.Timeout = module.WalkParams.Timeout
+			if deadline, ok := c.ctx.Deadline(); ok {
+				g.Timeout, g.Retries = fitDeadline(g.Timeout, g.Retries, time.Until(deadline))
+				logger.Debug("Fitted walk parameters to scrape deadline", "timeout", g.Timeout, "retries", g.Retries)
+			}
 			g.MaxRepetitions = module.WalkParams.MaxRepetitions
 			g.UseUnconnectedUDPSocket = module.WalkParams.UseUnconnectedUDPSocket
 			if module.WalkParams.AllowNonIncreasingOIDs {
@@ -383,12 +518,45 @@ func (c Collector) collect(ch chan<- prometheus.Metric, logger *slog.Logger, cli
 	start := time.Now()
 	moduleLabel := prometheus.Labels{"module": module.name}
 	c.metrics.SNMPInflight.Inc()
-	results, err := ScrapeTarget(client, c.target, c.auth, module.Module, logger, c.metrics)
+	if *subtreeMetrics {
+		stats := &statsScraper{SNMPScraper: client, packets: &packets, retries: &retries}
+		client = stats
+		defer func() {
+			if !rejected {
+				subtreeStatsMetrics(ch, module, stats.stats)
+			}
+		}()
+	}
+	// Samples are sent as the PDUs arrive, except for required modules which
+	// only return samples if all of the scrape succeeds.
+	var samples []prometheus.Metric
+	emit := func(m prometheus.Metric) { ch <- m }
+	if module.Required {
+		emit = func(m prometheus.Metric) { samples = append(samples, m) }
+	}
+	stream := newSampleStream(module, logger, c.metrics, emit)
+	results := ScrapeResults{}
+	err := scrapeTarget(client, c.target, c.auth, module.Module, logger, c.metrics, &results, stream)
 	c.metrics.SNMPInflight.Dec()
+	truncated := false
+	if errors.Is(err, errAuthRejected) {
+		logger.Debug("Target no longer accepts auth", "err", err)
+		return true
+	}
 	if err != nil {
-		logger.Info("Error scraping target", "err", err)
-		ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error scraping target", nil, moduleLabel), err)
-		return
+		// Required modules return all of their samples or none, even when out
+		// of time.
+		if !errors.Is(err, context.DeadlineExceeded) || module.Required {
+			logger.Info("Error scraping target", "err", err)
+			moduleFailed(ch, module.name, errorReason(err))
+			return false
+		}
+		// Out of time, return what was gathered so far.
+		logger.Info("Scrape deadline exceeded, returning partial results", "err", err, "pdus", stream.pdus)
+		truncated = true
+		moduleFailed(ch, module.name, reasonTimeout)
+	} else {
+		ch <- moduleSuccessMetric(module.name, true)
 	}
 	ch <- prometheus.MustNewConstMetric(
 		prometheus.NewDesc("snmp_scrape_walk_duration_seconds", "Time SNMP walk/bulkwalk took.", nil, moduleLabel),
@@ -405,99 +573,160 @@ func (c Collector) collect(ch chan<- prometheus.Metric, logger *slog.Logger, cli
 	ch <- prometheus.MustNewConstMetric(
 		prometheus.NewDesc("snmp_scrape_pdus_returned", "PDUs returned from get, bulkget, and walk.", nil, moduleLabel),
 		prometheus.GaugeValue,
-		float64(len(results.pdus)))
-
-	oidToPdu := make(map[string]gosnmp.SnmpPDU, len(results.pdus))
-	for _, pdu := range results.pdus {
-		oidToPdu[pdu.Name[1:]] = pdu
+		float64(stream.pdus))
+	ch <- truncatedMetric(module.name, truncated)
+	failures := map[scrapeFailure]int{}
+	for _, f := range results.failures {
+		failures[f]++
+	}
+	for f, count := range failures {
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc("snmp_scrape_subtree_errors", "Walks and gets that failed, by OID and reason.", []string{"oid", "reason"}, moduleLabel),
+			prometheus.GaugeValue,
+			float64(count), f.oid, f.reason)
 	}
 
-	metricTree := buildMetricTree(module.Metrics)
-	// Look for metrics that match each pdu.
-	for oid, pdu := range oidToPdu {
-		head := metricTree
-		oidList := oidToList(oid)
-		for i, o := range oidList {
-			var ok bool
-			head, ok = head.children[o]
-			if !ok {
-				break
-			}
-			if head.metric != nil {
-				// Found a match.
-				samples := pduToSamples(oidList[i+1:], &pdu, head.metric, oidToPdu, logger, c.metrics)
-				for _, sample := range samples {
-					ch <- sample
-				}
-				break
-			}
-		}
+	stream.finish()
+	for _, sample := range samples {
+		ch <- sample
 	}
 	ch <- prometheus.MustNewConstMetric(
 		prometheus.NewDesc("snmp_scrape_duration_seconds", "Total SNMP time scrape took (walk and processing).", nil, moduleLabel),
 		prometheus.GaugeValue,
 		time.Since(start).Seconds())
+	return false
 }
 
 // Collect implements Prometheus.Collector.
 func (c Collector) Collect(ch chan<- prometheus.Metric) {
-	wg := sync.WaitGroup{}
-	workerCount := max(c.concurrency, 1)
 	ctx, cancel := context.WithCancel(c.ctx)
 	defer cancel()
+	c.engine = &targetEngine{}
+	defer c.engine.metrics(ch)
+	if c.authChain != nil {
+		// Scrape with the auth the target accepted last, and only go through
+		// the chain again if it no longer does.
+		name, auth, ok := c.authChain.remembered(c.target)
+		if ok {
+			c.gate = newAuthGate()
+		} else {
+			var err error
+			name, auth, err = c.resolveAuth(ctx, "")
+			if err != nil {
+				c.logger.Info("Target accepted no auth of the chain", "err", err)
+				if c.selector != nil {
+					selectionMetrics(ch, err)
+					return
+				}
+				for _, m := range c.modules {
+					moduleFailed(ch, m.name, errorReason(err))
+				}
+				return
+			}
+		}
+		c.auth, c.chainedAuth = auth, name
+	}
+	if c.selector != nil {
+		modules, err := c.selectModules(ctx)
+		if errors.Is(err, errAuthRejected) {
+			if err = c.nextAuth(ctx); err == nil {
+				modules, err = c.selectModules(ctx)
+			}
+		}
+		selectionMetrics(ch, err)
+		if err != nil {
+			c.logger.Info("Error selecting modules", "err", err)
+			return
+		}
+		c.modules = modules
+	}
+	retry := c.scrapeModules(ctx, ch, c.modules)
+	if len(retry) == 0 {
+		return
+	}
+	if err := c.nextAuth(ctx); err != nil {
+		c.logger.Info("Target accepted no auth of the chain", "err", err)
+		for _, m := range retry {
+			moduleFailed(ch, m.name, errorReason(err))
+		}
+		return
+	}
+	c.scrapeModules(ctx, ch, retry)
+}
+
+// nextAuth moves on to the auth of the chain that the target accepts, once
+// it no longer accepts the one it accepted before.
+func (c *Collector) nextAuth(ctx context.Context) error {
+	c.logger.Info("Target no longer accepts auth, trying the chain", "chained_auth", c.chainedAuth)
+	name, auth, err := c.resolveAuth(ctx, c.chainedAuth)
+	if err != nil {
+		return err
+	}
+	c.auth, c.chainedAuth, c.gate = auth, name, nil
+	return nil
+}
+
+// scrapeModules scrapes the modules with the workers. It returns the modules
+// to scrape again with another auth of the chain, if the target no longer
+// accepts the auth it accepted before.
+func (c Collector) scrapeModules(ctx context.Context, ch chan<- prometheus.Metric, modules []*NamedModule) []*NamedModule {
+	wg := sync.WaitGroup{}
+	workerCount := max(c.concurrency, 1)
+	var (
+		mu    sync.Mutex
+		retry []*NamedModule
+	)
+	retryLater := func(m *NamedModule) {
+		mu.Lock()
+		defer mu.Unlock()
+		retry = append(retry, m)
+	}
 	workerChan := make(chan *NamedModule)
+	shared := newSharedWalks(modules)
+	// The workers that connected or are still connecting. Workers that can't
+	// connect leave the modules to the others, and only the last one reports
+	// them failed.
+	var workers atomic.Int32
+	workers.Store(int32(workerCount))
 	for i := 0; i < workerCount; i++ {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
 			logger := c.logger.With("worker", i)
-			client, err := scraper.NewGoSNMP(logger, c.target, *srcAddress, c.debugSNMP)
+			client, err := c.connect(ctx, logger)
 			if err != nil {
-				logger.Info("Failed to create snmp scrape client", "err", err)
-				cancel()
-				ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error during initialisation of the Worker", nil, nil), err)
-				return
-			}
-			// Set UseUnconnectedSocket option if at least one module has it set
-			useUnconnectedUDPSocket := false
-			for _, m := range c.modules {
-				if m.WalkParams.UseUnconnectedUDPSocket {
-					useUnconnectedUDPSocket = true
-					break
+				if workers.Add(-1) > 0 {
+					return
 				}
-			}
-			// Set EngineID option if one is configured and we're using SNMPv3
-			if c.snmpEngineID != "" && c.auth.Version == 3 {
-				// Convert the SNMP Engine ID to a byte string
-				sEID, err := hex.DecodeString(c.snmpEngineID)
-				if err != nil {
-					logger.Debug("Failed to decode snmpEngineID as hex", "engineID", c.snmpEngineID, "err", err)
-					cancel()
+				if !c.gate.reject(err) {
+					drainFailed(ch, workerChan, shared, errorReason(err))
 					return
 				}
-				// Set the options.
-				client.SetOptions(func(g *gosnmp.GoSNMP) {
-					g.ContextEngineID = string(sEID)
-				})
-			}
-			// Set the options.
-			client.SetOptions(func(g *gosnmp.GoSNMP) {
-				g.Context = ctx
-				g.UseUnconnectedUDPSocket = useUnconnectedUDPSocket
-				c.auth.ConfigureSNMP(g, c.snmpContext)
-			})
-			if err = client.Connect(); err != nil {
-				logger.Info("Error connecting to target", "err", err)
-				ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error connecting to target", nil, nil), err)
-				cancel()
+				for m := range workerChan {
+					shared.release(m)
+					retryLater(m)
+				}
 				return
 			}
 			defer client.Close()
 			for m := range workerChan {
+				if c.gate.failed() {
+					shared.release(m)
+					retryLater(m)
+					continue
+				}
 				_logger := logger.With("module", m.name)
 				_logger.Debug("Starting scrape")
 				start := time.Now()
-				c.collect(ch, _logger, client, m)
+				rejected := c.collect(ch, _logger, shared.scraper(ctx, c.gate.scraper(client), m), m)
+				shared.release(m)
+				if rejected {
+					retryLater(m)
+					continue
+				}
+				if c.auth.Version == 3 {
+					c.engine.record(client)
+				}
 				duration := time.Since(start).Seconds()
 				_logger.Debug("Finished scrape", "duration_seconds", duration)
 				c.metrics.SNMPCollectionDuration.WithLabelValues(m.name).Observe(duration)
@@ -505,14 +734,15 @@ func (c Collector) Collect(ch chan<- prometheus.Metric) {
 		}(i)
 	}
 
-	done := false
-	for _, module := range c.modules {
-		if done {
-			break
+	var skipped []string
+	for _, module := range modules {
+		if len(skipped) > 0 {
+			skipped = append(skipped, module.name)
+			continue
 		}
 		select {
 		case <-ctx.Done():
-			done = true
+			skipped = append(skipped, module.name)
 			c.logger.Debug("Context canceled", "err", ctx.Err(), "module", module.name)
 		case workerChan <- module:
 			c.logger.Debug("Sent module to worker", "module", module.name)
@@ -520,6 +750,282 @@ func (c Collector) Collect(ch chan<- prometheus.Metric) {
 	}
 	close(workerChan)
 	wg.Wait()
+	// Modules that were never started ran out of time too.
+	if errors.Is(c.ctx.Err(), context.DeadlineExceeded) {
+		for _, name := range skipped {
+			ch <- truncatedMetric(name, true)
+			moduleFailed(ch, name, reasonTimeout)
+		}
+	}
+	if c.chainedAuth != "" {
+		for _, m := range modules {
+			if !slices.Contains(retry, m) {
+				ch <- authInfoMetric(m.name, c.chainedAuth)
+			}
+		}
+	}
+	return retry
+}
+
+// connect returns a client connected to the target, borrowed from the
+// session pool if possible.
+func (c Collector) connect(ctx context.Context, logger *slog.Logger) (scraper.SNMPScraper, error) {
+	// Set UseUnconnectedSocket option if at least one module has it set
+	useUnconnectedUDPSocket := false
+	for _, m := range c.modules {
+		if m.WalkParams.UseUnconnectedUDPSocket {
+			useUnconnectedUDPSocket = true
+			break
+		}
+	}
+	auth, err := c.auth.ResolveSecrets(ctx)
+	if err != nil {
+		logger.Info("Error fetching secrets", "err", err)
+		return nil, err
+	}
+	var key *sessionKey
+	// Packet traces are only logged by the sessions opened for them.
+	if c.sessions != nil && !c.debugSNMP && pooledTransport(c.target, useUnconnectedUDPSocket) {
+		key = &sessionKey{
+			target:       c.target,
+			source:       *srcAddress,
+			auth:         sessionFingerprint(auth),
+			snmpContext:  c.snmpContext,
+			snmpEngineID: c.snmpEngineID,
+		}
+		if client, ok := c.sessions.get(*key); ok {
+			logger.Debug("Borrowed session from the pool")
+			client.SetOptions(func(g *gosnmp.GoSNMP) {
+				g.Context = ctx
+				// Drop the hooks of the scrape that used it last.
+				g.OnSent, g.OnRecv, g.OnRetry = nil, nil, nil
+			})
+			return c.wrapSession(client, auth, key), nil
+		}
+	}
+	client, err := newScraper(logger, c.target, c.debugSNMP)
+	if err != nil {
+		logger.Info("Failed to create snmp scrape client", "err", err)
+		return nil, err
+	}
+	engineID := ""
+	// Set EngineID option if one is configured and we're using SNMPv3
+	if c.snmpEngineID != "" && c.auth.Version == 3 {
+		// Convert the SNMP Engine ID to a byte string
+		sEID, err := hex.DecodeString(c.snmpEngineID)
+		if err != nil {
+			logger.Info("Failed to decode snmpEngineID as hex", "engineID", c.snmpEngineID, "err", err)
+			return nil, err
+		}
+		engineID = string(sEID)
+		// Set the options.
+		client.SetOptions(func(g *gosnmp.GoSNMP) {
+			g.ContextEngineID = engineID
+		})
+	}
+	var known *engine
+	if auth.Version == 3 && c.engines != nil {
+		// The engine ID given for keys takes precedence over the cache.
+		if eng, ok := c.engines.engine(c.target); ok && (engineID == "" || !auth.HasKeys() || eng.id == engineID) {
+			known = &eng
+		}
+	}
+	// Keys can only be localized once the engine ID is known.
+	if auth.HasKeys() && engineID == "" && known == nil {
+		known, err = c.discoverEngine(ctx, client, auth, useUnconnectedUDPSocket)
+		if err != nil {
+			logger.Info("Error discovering engine ID", "err", err)
+			return nil, err
+		}
+	}
+	if known != nil && auth.HasKeys() {
+		engineID = known.id
+	}
+	// Set the options.
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		g.Context = ctx
+		g.UseUnconnectedUDPSocket = useUnconnectedUDPSocket
+		auth.ConfigureSNMP(g, c.snmpContext)
+		if auth.Version != 3 {
+			return
+		}
+		usm := g.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+		if known != nil {
+			// gosnmp skips the discovery of engines it's given.
+			usm.AuthoritativeEngineID = known.id
+			usm.AuthoritativeEngineBoots = known.boots
+			usm.AuthoritativeEngineTime = known.time
+			if g.ContextEngineID == "" {
+				g.ContextEngineID = known.id
+			}
+		}
+		err = c.localizeKeys(auth, usm, engineID)
+	})
+	if err != nil {
+		logger.Info("Error localizing keys", "err", err)
+		if c.engines != nil {
+			// The cached engine may be one the keys aren't for.
+			c.engines.forgetEngine(c.target)
+		}
+		return nil, err
+	}
+	if err = client.Connect(); err != nil {
+		logger.Info("Error connecting to target", "err", err)
+		return nil, err
+	}
+	if auth.Version == 3 && c.metrics.SNMPReports != nil {
+		client.SetOptions(func(g *gosnmp.GoSNMP) {
+			g.Conn = newReportConn(g.Conn, c.metrics.SNMPReports)
+		})
+	}
+	return c.wrapSession(client, auth, key), nil
+}
+
+// wrapSession wraps a connected session for a scrape. Sessions with a key
+// are returned to the pool when closed.
+func (c Collector) wrapSession(client scraper.SNMPScraper, auth *config.Auth, key *sessionKey) scraper.SNMPScraper {
+	if key != nil {
+		client = &pooledScraper{SNMPScraper: client, pool: c.sessions, key: *key}
+	}
+	if c.recorder != nil {
+		client = c.recorder.Wrap(client)
+	}
+	if auth.Version == 3 && c.engines != nil {
+		client = &engineScraper{SNMPScraper: client, cache: c.engines, target: c.target}
+	}
+	return client
+}
+
+// localizeKeys sets the keys of an auth localized to the engine ID, from the
+// cache if possible. Auths with passwords only have their keys set if the
+// engine ID is known, as gosnmp localizes them once it discovers it.
+func (c Collector) localizeKeys(auth *config.Auth, usm *gosnmp.UsmSecurityParameters, engineID string) error {
+	if usm.AuthoritativeEngineID == "" && !auth.HasKeys() {
+		return nil
+	}
+	if engineID == "" {
+		engineID = usm.AuthoritativeEngineID
+	}
+	var fingerprint string
+	if c.engines != nil {
+		fingerprint = authFingerprint(auth)
+		if authKey, privKey, ok := c.engines.localizedKeys(engineID, fingerprint); ok {
+			usm.AuthoritativeEngineID = engineID
+			usm.SecretKey, usm.PrivacyKey = authKey, privKey
+			return nil
+		}
+	}
+	if err := auth.LocalizeKeys(usm, engineID); err != nil {
+		return err
+	}
+	if err := usm.InitSecurityKeys(); err != nil {
+		return err
+	}
+	if c.engines != nil {
+		c.engines.storeKeys(engineID, fingerprint, usm.SecretKey, usm.PrivacyKey)
+	}
+	return nil
+}
+
+// discoverEngine discovers the engine of the target for an auth with keys,
+// as gosnmp can only localize keys it derives from passwords when it
+// discovers the engine itself. The request sent after the discovery is
+// rejected by the target, as it has no auth.
+func (c Collector) discoverEngine(ctx context.Context, client scraper.SNMPScraper, auth *config.Auth, useUnconnectedUDPSocket bool) (*engine, error) {
+	var usm *gosnmp.UsmSecurityParameters
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		g.Context = ctx
+		g.UseUnconnectedUDPSocket = useUnconnectedUDPSocket
+		g.Version = gosnmp.Version3
+		g.SecurityModel = gosnmp.UserSecurityModel
+		g.MsgFlags = gosnmp.NoAuthNoPriv
+		usm = &gosnmp.UsmSecurityParameters{UserName: auth.Username}
+		g.SecurityParameters = usm
+		g.Retries = *config.DefaultWalkParams.Retries
+		g.Timeout = config.DefaultWalkParams.Timeout
+		if deadline, ok := ctx.Deadline(); ok {
+			g.Timeout, g.Retries = fitDeadline(g.Timeout, g.Retries, time.Until(deadline))
+		}
+	})
+	if usm == nil {
+		// Scrapers that aren't backed by gosnmp have no engine.
+		return nil, nil
+	}
+	if err := client.Connect(); err != nil {
+		return nil, err
+	}
+	_, err := client.Get([]string{sysUpTimeOID})
+	client.Close()
+	if usm.AuthoritativeEngineID == "" {
+		if err == nil {
+			err = errors.New("no engine ID discovered")
+		}
+		return nil, err
+	}
+	eng := &engine{
+		id:    usm.AuthoritativeEngineID,
+		boots: usm.AuthoritativeEngineBoots,
+		time:  usm.AuthoritativeEngineTime,
+		at:    time.Now(),
+	}
+	if c.engines != nil {
+		c.engines.storeEngine(c.target, *eng)
+	}
+	return eng, nil
+}
+
+// drainFailed reports the modules that no worker can scrape.
+func drainFailed(ch chan<- prometheus.Metric, modules <-chan *NamedModule, shared *sharedWalks, reason string) {
+	for m := range modules {
+		shared.release(m)
+		moduleFailed(ch, m.name, reason)
+	}
+}
+
+func moduleSuccessMetric(module string, success bool) prometheus.Metric {
+	v := 0.0
+	if success {
+		v = 1
+	}
+	return prometheus.MustNewConstMetric(
+		prometheus.NewDesc("snmp_scrape_module_success", "Whether the scrape of the module succeeded.", nil, prometheus.Labels{"module": module}),
+		prometheus.GaugeValue,
+		v)
+}
+
+// moduleFailed reports a module that failed, and why.
+func moduleFailed(ch chan<- prometheus.Metric, module, reason string) {
+	ch <- moduleSuccessMetric(module, false)
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc("snmp_scrape_error_info", "The reason the scrape of the module failed.", []string{"reason"}, prometheus.Labels{"module": module}),
+		prometheus.GaugeValue,
+		1, reason)
+}
+
+func truncatedMetric(module string, truncated bool) prometheus.Metric {
+	v := 0.0
+	if truncated {
+		v = 1
+	}
+	return prometheus.MustNewConstMetric(
+		prometheus.NewDesc("snmp_scrape_truncated", "Whether the scrape ran out of time and returned partial results.", nil, prometheus.Labels{"module": module}),
+		prometheus.GaugeValue,
+		v)
+}
+
+// fitDeadline shrinks the timeout and retries of a request so that all of
+// its attempts fit in the remaining time. The timeout is shortened first, down
+// to minAttemptTimeout, then retries are dropped.
+func fitDeadline(timeout time.Duration, retries int, remaining time.Duration) (time.Duration, int) {
+	if remaining <= 0 || timeout*time.Duration(retries+1) <= remaining {
+		return timeout, retries
+	}
+	floor := min(timeout, minAttemptTimeout)
+	attempts := retries + 1
+	if remaining/time.Duration(attempts) < floor {
+		attempts = max(int(remaining/floor), 1)
+	}
+	return remaining / time.Duration(attempts), attempts - 1
 }
 
 func getPduValue(pdu *gosnmp.SnmpPDU) float64 {
@@ -615,7 +1121,7 @@ func parseNtpTimestamp(pdu *gosnmp.SnmpPDU) (float64, error) {
 	return float64(t.Unix()), nil
 }
 
-func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *config.Metric, oidToPdu map[string]gosnmp.SnmpPDU, logger *slog.Logger, metrics Metrics) []prometheus.Metric {
+func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *preparedMetric, oidToPdu map[string]gosnmp.SnmpPDU, logger *slog.Logger, metrics Metrics) []prometheus.Metric {
 	var err error
 	// The part of the OID that is the indexes.
 	labels := indexesToLabels(indexOids, metric, oidToPdu, metrics)
@@ -646,7 +1152,7 @@ func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *config.Metric, o
 		}
 	case "ParseDateAndTime":
 		t = prometheus.GaugeValue
-		value, err = parseDateAndTimeWithPattern(metric, pdu, metrics)
+		value, err = parseDateAndTimeWithPattern(metric.Metric, pdu, metrics)
 		if err != nil {
 			logger.Debug("Error parsing ParseDateAndTime", "err", err)
 			return []prometheus.Metric{}
@@ -659,11 +1165,11 @@ func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *config.Metric, o
 			return []prometheus.Metric{}
 		}
 	case "EnumAsInfo":
-		return enumAsInfo(metric, int(value), labelnames, labelvalues)
+		return enumAsInfo(metric.Metric, int(value), labelnames, labelvalues)
 	case "EnumAsStateSet":
-		return enumAsStateSet(metric, int(value), labelnames, labelvalues)
+		return enumAsStateSet(metric.Metric, int(value), labelnames, labelvalues)
 	case "Bits":
-		return bits(metric, pdu.Value, labelnames, labelvalues)
+		return bits(metric.Metric, pdu.Value, labelnames, labelvalues)
 	default:
 		// It's some form of string.
 		t = prometheus.GaugeValue
@@ -672,7 +1178,7 @@ func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *config.Metric, o
 
 		if typeMapping, ok := combinedTypeMapping[metricType]; ok {
 			// Lookup associated sub type in previous object.
-			prevOid := fmt.Sprintf("%s.%s", getPrevOid(metric.Oid), listToOid(indexOids))
+			prevOid := metric.typeOid + "." + listToOid(indexOids)
 			if prevPdu, ok := oidToPdu[prevOid]; ok {
 				val := int(getPduValue(&prevPdu))
 				if t, ok := typeMapping[val]; ok {
@@ -688,7 +1194,7 @@ func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *config.Metric, o
 		}
 
 		if len(metric.RegexpExtracts) > 0 {
-			return applyRegexExtracts(metric, pduValueAsString(pdu, metricType, metric.DisplayHint, metrics), labelnames, labelvalues, logger)
+			return applyRegexExtracts(metric.Metric, pduValueAsString(pdu, metricType, metric.DisplayHint, metrics), labelnames, labelvalues, logger)
 		}
 		// For strings we put the value as a label with the same name as the metric.
 		// If the name is already an index, we do not need to set it again.
@@ -907,102 +1413,76 @@ func pduValueAsString(pdu *gosnmp.SnmpPDU, typ, displayHint string, metrics Metr
 //
 // Returns the string, the oids that were used and the oids left over.
 func indexOidsAsString(indexOids []int, typ string, fixedSize int, implied bool, enumValues map[int]string) (string, []int, []int) {
-	if typeMapping, ok := combinedTypeMapping[typ]; ok {
-		subOid, valueOids := splitOid(indexOids, 2)
-		if typ == "InetAddressMissingSize" {
-			// The size of the main index value is missing.
-			subOid, valueOids = splitOid(indexOids, 1)
-		}
-		var str string
-		var used, remaining []int
-		if t, ok := typeMapping[subOid[0]]; ok {
-			str, used, remaining = indexOidsAsString(valueOids, t, 0, false, enumValues)
-			return str, append(subOid, used...), remaining
-		}
-		if typ == "InetAddressMissingSize" {
-			// We don't know the size, so pass everything remaining.
-			return indexOidsAsString(indexOids, "OctetString", 0, true, enumValues)
-		}
-		// The 2nd oid is the length.
-		return indexOidsAsString(indexOids, "OctetString", subOid[1]+2, false, enumValues)
-	}
-
-	switch typ {
-	case "Integer32", "Integer", "gauge", "counter":
-		// Extract the oid for this index, and keep the remainder for the next index.
-		subOid, indexOids := splitOid(indexOids, 1)
-		return fmt.Sprintf("%d", subOid[0]), subOid, indexOids
-	case "PhysAddress48":
-		subOid, indexOids := splitOid(indexOids, 6)
-		parts := make([]string, 6)
-		for i, o := range subOid {
-			parts[i] = fmt.Sprintf("%02X", o)
-		}
-		return strings.Join(parts, ":"), subOid, indexOids
-	case "OctetString":
-		var subOid []int
-		// The length of fixed size indexes come from the MIB.
-		// For varying size, we read it from the first oid.
-		length := fixedSize
-		if implied {
-			length = len(indexOids)
-		}
-		if length == 0 {
-			subOid, indexOids = splitOid(indexOids, 1)
-			length = subOid[0]
-		}
-		content, indexOids := splitOid(indexOids, length)
-		subOid = append(subOid, content...)
-		parts := make([]byte, length)
-		for i, o := range content {
-			parts[i] = byte(o)
-		}
-		if len(parts) == 0 {
-			return "", subOid, indexOids
-		}
-		return fmt.Sprintf("0x%X", string(parts)), subOid, indexOids
-	case "DisplayString":
-		var subOid []int
-		length := fixedSize
-		if implied {
-			length = len(indexOids)
-		}
-		if length == 0 {
-			subOid, indexOids = splitOid(indexOids, 1)
-			length = subOid[0]
-		}
-		content, indexOids := splitOid(indexOids, length)
-		subOid = append(subOid, content...)
-		parts := make([]byte, length)
-		for i, o := range content {
-			parts[i] = byte(o)
-		}
-		// ASCII, so can convert staight to utf-8.
-		return string(parts), subOid, indexOids
-	case "InetAddressIPv4":
-		subOid, indexOids := splitOid(indexOids, 4)
-		parts := make([]string, 4)
-		for i, o := range subOid {
-			parts[i] = strconv.Itoa(o)
-		}
-		return strings.Join(parts, "."), subOid, indexOids
-	case "InetAddressIPv6":
-		subOid, indexOids := splitOid(indexOids, 16)
-		parts := make([]any, 16)
-		for i, o := range subOid {
-			parts[i] = o
-		}
-		return fmt.Sprintf("%02X%02X:%02X%02X:%02X%02X:%02X%02X:%02X%02X:%02X%02X:%02X%02X:%02X%02X", parts...), subOid, indexOids
-	case "EnumAsInfo":
-		subOid, indexOids := splitOid(indexOids, 1)
-		value, ok := enumValues[subOid[0]]
-		if ok {
-			return value, subOid, indexOids
-		}
-		return fmt.Sprintf("%d", subOid[0]), subOid, indexOids
-	default:
-		panic(fmt.Sprintf("Unknown index type %s", typ))
+	return newIndexDecoder(typ, fixedSize, implied, enumValues)(indexOids)
+}
+
+func decodeInteger(indexOids []int) (string, []int, []int) {
+	// Extract the oid for this index, and keep the remainder for the next index.
+	subOid, indexOids := splitOid(indexOids, 1)
+	return strconv.Itoa(subOid[0]), subOid, indexOids
+}
+
+func decodePhysAddress48(indexOids []int) (string, []int, []int) {
+	subOid, indexOids := splitOid(indexOids, 6)
+	parts := make([]string, 6)
+	for i, o := range subOid {
+		parts[i] = fmt.Sprintf("%02X", o)
+	}
+	return strings.Join(parts, ":"), subOid, indexOids
+}
+
+// stringIndex splits the bytes of a string index from the oids.
+func stringIndex(indexOids []int, fixedSize int, implied bool) ([]byte, []int, []int) {
+	var subOid []int
+	// The length of fixed size indexes come from the MIB.
+	// For varying size, we read it from the first oid.
+	length := fixedSize
+	if implied {
+		length = len(indexOids)
+	}
+	if length == 0 {
+		subOid, indexOids = splitOid(indexOids, 1)
+		length = subOid[0]
 	}
+	content, indexOids := splitOid(indexOids, length)
+	subOid = append(subOid, content...)
+	parts := make([]byte, length)
+	for i, o := range content {
+		parts[i] = byte(o)
+	}
+	return parts, subOid, indexOids
+}
+
+func decodeOctetString(indexOids []int, fixedSize int, implied bool) (string, []int, []int) {
+	parts, subOid, indexOids := stringIndex(indexOids, fixedSize, implied)
+	if len(parts) == 0 {
+		return "", subOid, indexOids
+	}
+	return fmt.Sprintf("0x%X", string(parts)), subOid, indexOids
+}
+
+func decodeDisplayString(indexOids []int, fixedSize int, implied bool) (string, []int, []int) {
+	parts, subOid, indexOids := stringIndex(indexOids, fixedSize, implied)
+	// ASCII, so can convert staight to utf-8.
+	return string(parts), subOid, indexOids
+}
+
+func decodeIPv4(indexOids []int) (string, []int, []int) {
+	subOid, indexOids := splitOid(indexOids, 4)
+	parts := make([]string, 4)
+	for i, o := range subOid {
+		parts[i] = strconv.Itoa(o)
+	}
+	return strings.Join(parts, "."), subOid, indexOids
+}
+
+func decodeIPv6(indexOids []int) (string, []int, []int) {
+	subOid, indexOids := splitOid(indexOids, 16)
+	parts := make([]any, 16)
+	for i, o := range subOid {
+		parts[i] = o
+	}
+	return fmt.Sprintf("%02X%02X:%02X%02X:%02X%02X:%02X%02X:%02X%02X:%02X%02X:%02X%02X:%02X%02X", parts...), subOid, indexOids
 }
 
 func getPrevOid(oid string) string {
@@ -1012,13 +1492,13 @@ func getPrevOid(oid string) string {
 	return strings.Join(oids, ".")
 }
 
-func indexesToLabels(indexOids []int, metric *config.Metric, oidToPdu map[string]gosnmp.SnmpPDU, metrics Metrics) map[string]string {
+func indexesToLabels(indexOids []int, metric *preparedMetric, oidToPdu map[string]gosnmp.SnmpPDU, metrics Metrics) map[string]string {
 	labels := map[string]string{}
 	labelOids := map[string][]int{}
 
 	// Covert indexes to useful strings.
-	for _, index := range metric.Indexes {
-		str, subOid, remainingOids := indexOidsAsString(indexOids, index.Type, index.FixedSize, index.Implied, index.EnumValues)
+	for i, index := range metric.Indexes {
+		str, subOid, remainingOids := metric.indexes[i](indexOids)
 		// The labelvalue is the text form of the index oids. Ensure it is valid UTF-8,
 		// as required for Prometheus label values.
 		labels[index.Labelname] = strings.ToValidUTF8(str, "�")
@@ -1029,26 +1509,18 @@ func indexesToLabels(indexOids []int, metric *config.Metric, oidToPdu map[string
 	}
 
 	// Perform lookups.
-	for _, lookup := range metric.Lookups {
+	for _, lookup := range metric.lookups {
 		if len(lookup.Labels) == 0 {
 			delete(labels, lookup.Labelname)
 			continue
 		}
-		oid := lookup.Oid
-		for _, label := range lookup.Labels {
-			oid = fmt.Sprintf("%s.%s", oid, listToOid(labelOids[label]))
-		}
-		if pdu, ok := oidToPdu[oid]; ok {
+		if pdu, ok := oidToPdu[lookupOid(lookup.Oid, lookup.Labels, labelOids)]; ok {
 			t := lookup.Type
-			if typeMapping, ok := combinedTypeMapping[lookup.Type]; ok {
+			if lookup.typeOid != "" {
 				// Lookup associated sub type in previous object.
-				prevOid := getPrevOid(lookup.Oid)
-				for _, label := range lookup.Labels {
-					prevOid = fmt.Sprintf("%s.%s", prevOid, listToOid(labelOids[label]))
-				}
-				if prevPdu, ok := oidToPdu[prevOid]; ok {
+				if prevPdu, ok := oidToPdu[lookupOid(lookup.typeOid, lookup.Labels, labelOids)]; ok {
 					val := int(getPduValue(&prevPdu))
-					if ty, ok := typeMapping[val]; ok {
+					if ty, ok := combinedTypeMapping[lookup.Type][val]; ok {
 						t = ty
 					}
 				}
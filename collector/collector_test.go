@@ -14,19 +14,25 @@
 package collector
 
 import (
+	"context"
+	"encoding/hex"
 	"errors"
+	"net"
 	"reflect"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	kingpin "github.com/alecthomas/kingpin/v2"
 	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
 	io_prometheus_client "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/promslog"
 
 	"github.com/prometheus/snmp_exporter/config"
 	"github.com/prometheus/snmp_exporter/scraper"
+	"github.com/prometheus/snmp_exporter/simulator"
 )
 
 func TestPduToSample(t *testing.T) {
@@ -620,7 +626,7 @@ func TestPduToSample(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		metrics := pduToSamples(c.indexOids, c.pdu, c.metric, c.oidToPdu, promslog.NewNopLogger(), Metrics{})
+		metrics := pduToSamples(c.indexOids, c.pdu, newPreparedMetric(c.metric), c.oidToPdu, promslog.NewNopLogger(), Metrics{})
 		metric := &io_prometheus_client.Metric{}
 		expected := map[string]struct{}{}
 		for _, e := range c.expectedMetrics {
@@ -1300,7 +1306,7 @@ func TestIndexesToLabels(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
-		got := indexesToLabels(c.oid, &c.metric, c.oidToPdu, Metrics{})
+		got := indexesToLabels(c.oid, newPreparedMetric(&c.metric), c.oidToPdu, Metrics{})
 		if !reflect.DeepEqual(got, c.result) {
 			t.Errorf("indexesToLabels(%v, %v, %v): got %v, want %v", c.oid, c.metric, c.oidToPdu, got, c.result)
 		}
@@ -1350,6 +1356,9 @@ func TestFilterAllowedIndices(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
+		if err := c.filter.Compile(); err != nil {
+			t.Fatal(err)
+		}
 		got := filterAllowedIndices(promslog.NewNopLogger(), c.filter, pdus, c.allowedList, Metrics{})
 		if !reflect.DeepEqual(got, c.result) {
 			t.Errorf("filterAllowedIndices(%v): got %v, want %v", c.filter, got, c.result)
@@ -1666,3 +1675,210 @@ func TestScrapeTarget(t *testing.T) {
 		})
 	}
 }
+
+func TestScrapeTargetKeepsPartialWalk(t *testing.T) {
+	module := &config.Module{
+		Walk: []string{"1.3.6.1.2.1.2.2.1.2", "1.3.6.1.2.1.31.1.1.1.18"},
+	}
+	mock := scraper.NewMockSNMPScraper(nil, map[string][]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.2.2.1.2": {
+			{Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.2.2.1.2.1", Value: "lo"},
+		},
+	})
+	mock.WalkErrors = map[string]error{"1.3.6.1.2.1.2.2.1.2": context.DeadlineExceeded}
+
+	results, err := ScrapeTarget(mock, "someTarget", &config.Auth{Version: 2}, module, promslog.NewNopLogger(), Metrics{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded error, got %v", err)
+	}
+	if len(results.pdus) != 1 {
+		t.Fatalf("Expected the PDUs of the interrupted walk, got %v", results.pdus)
+	}
+	if !reflect.DeepEqual(mock.CallWalk(), []string{"1.3.6.1.2.1.2.2.1.2"}) {
+		t.Errorf("Expected walks to stop after the error, got %v", mock.CallWalk())
+	}
+}
+
+func TestScrapeTargetFailures(t *testing.T) {
+	walkErr := errors.New("request timeout (after 3 retries)")
+	getErr := errors.New("connection refused")
+	cases := []struct {
+		name         string
+		required     bool
+		expectPdus   int
+		expectErr    bool
+		expectFailed []scrapeFailure
+	}{
+		{
+			name:       "failures are skipped",
+			expectPdus: 2,
+			expectFailed: []scrapeFailure{
+				{oid: "1.3.6.1.2.1.1.2.0", reason: "error"},
+				{oid: "1.3.6.1.2.1.2.2.1.2", reason: "timeout"},
+			},
+		},
+		{
+			name:       "required module fails",
+			required:   true,
+			expectPdus: 1,
+			expectErr:  true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			module := &config.Module{
+				Get:        []string{"1.3.6.1.2.1.1.1.0", "1.3.6.1.2.1.1.2.0"},
+				Walk:       []string{"1.3.6.1.2.1.2.2.1.2", "1.3.6.1.2.1.31.1.1.1.18"},
+				WalkParams: config.WalkParams{MaxRepetitions: 1},
+				Required:   tc.required,
+			}
+			mock := scraper.NewMockSNMPScraper(map[string]gosnmp.SnmpPDU{
+				"1.3.6.1.2.1.1.1.0": {Type: gosnmp.OctetString, Name: "1.3.6.1.2.1.1.1.0", Value: "Test Device"},
+			}, map[string][]gosnmp.SnmpPDU{
+				"1.3.6.1.2.1.31.1.1.1.18": {
+					{Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.31.1.1.1.18.1", Value: "lo"},
+				},
+			})
+			mock.GetErrors = map[string]error{"1.3.6.1.2.1.1.2.0": getErr}
+			mock.WalkErrors = map[string]error{"1.3.6.1.2.1.2.2.1.2": walkErr}
+
+			results, err := ScrapeTarget(mock, "someTarget", &config.Auth{Version: 2}, module, promslog.NewNopLogger(), Metrics{})
+			if tc.expectErr != (err != nil) {
+				t.Fatalf("Expected error %v, got %v", tc.expectErr, err)
+			}
+			if len(results.pdus) != tc.expectPdus {
+				t.Errorf("Expected %d PDUs, got %v", tc.expectPdus, results.pdus)
+			}
+			if !reflect.DeepEqual(results.failures, tc.expectFailed) {
+				t.Errorf("Expected failures %v, got %v", tc.expectFailed, results.failures)
+			}
+		})
+	}
+}
+
+func TestFitDeadline(t *testing.T) {
+	cases := []struct {
+		name        string
+		timeout     time.Duration
+		retries     int
+		remaining   time.Duration
+		wantTimeout time.Duration
+		wantRetries int
+	}{
+		{"fits", 5 * time.Second, 3, time.Minute, 5 * time.Second, 3},
+		{"no time left", 5 * time.Second, 3, 0, 5 * time.Second, 3},
+		{"shorter timeout", 5 * time.Second, 3, 8 * time.Second, 2 * time.Second, 3},
+		{"fewer retries", 5 * time.Second, 3, 2500 * time.Millisecond, 1250 * time.Millisecond, 1},
+		{"single short attempt", 5 * time.Second, 3, 500 * time.Millisecond, 500 * time.Millisecond, 0},
+		{"short configured timeout", 200 * time.Millisecond, 3, 500 * time.Millisecond, 250 * time.Millisecond, 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			timeout, retries := fitDeadline(tc.timeout, tc.retries, tc.remaining)
+			if timeout != tc.wantTimeout || retries != tc.wantRetries {
+				t.Errorf("Expected timeout %s and %d retries, got %s and %d", tc.wantTimeout, tc.wantRetries, timeout, retries)
+			}
+		})
+	}
+}
+
+func TestCollectLocalizedKeys(t *testing.T) {
+	metrics := Metrics{
+		SNMPCollectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "d"}, []string{"module"}),
+		SNMPUnexpectedPduType:  prometheus.NewCounter(prometheus.CounterOpts{Name: "u"}),
+		SNMPDuration:           prometheus.NewHistogram(prometheus.HistogramOpts{Name: "p"}),
+		SNMPPackets:            prometheus.NewCounter(prometheus.CounterOpts{Name: "s"}),
+		SNMPRetries:            prometheus.NewCounter(prometheus.CounterOpts{Name: "r"}),
+		SNMPInflight:           prometheus.NewGauge(prometheus.GaugeOpts{Name: "i"}),
+	}
+	pdus, err := scraper.ReadSnmprec(strings.NewReader("1.3.6.1.2.1.1.3.0|67|12345\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwords := &config.Auth{
+		Username: "admin", SecurityLevel: "authPriv", Version: 3,
+		AuthProtocol: "SHA", Password: "maplesyrup",
+		PrivProtocol: "AES", PrivPassword: "pancakes",
+	}
+	engineID := []byte{0x80, 0x00, 0x1f, 0x88, 0x04, 0x73, 0x6e, 0x6d, 0x70}
+	agent, err := simulator.NewAgent(promslog.NewNopLogger(), pdus, []*config.Auth{passwords}, engineID, simulator.Faults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go agent.ServePacket(conn)
+	defer conn.Close()
+
+	// The keys gosnmp derives from the passwords for the engine ID.
+	g := &gosnmp.GoSNMP{}
+	passwords.ConfigureSNMP(g, "")
+	usm := g.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	usm.AuthoritativeEngineID = string(engineID)
+	if err := usm.InitSecurityKeys(); err != nil {
+		t.Fatal(err)
+	}
+	keys := *passwords
+	keys.Password, keys.PrivPassword = "", ""
+	keys.LocalizedKeys = map[string]config.LocalizedKeys{
+		hex.EncodeToString(engineID): {
+			AuthKey: config.Secret(hex.EncodeToString(usm.SecretKey)),
+			PrivKey: config.Secret(hex.EncodeToString(usm.PrivacyKey)),
+		},
+	}
+
+	retries := 0
+	module := NewNamedModule("system", &config.Module{
+		Get:        []string{"1.3.6.1.2.1.1.3.0"},
+		Metrics:    []*config.Metric{{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge"}},
+		WalkParams: config.WalkParams{Retries: &retries, Timeout: time.Second, MaxRepetitions: 2},
+	})
+	// The engine ID is discovered, or given with snmp_engineid.
+	for _, snmpEngineID := range []string{"", hex.EncodeToString(engineID)} {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		c := New(ctx, conn.LocalAddr().String(), "keys", "", snmpEngineID, &keys, []*NamedModule{module}, promslog.NewNopLogger(), metrics, 1, false)
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		cancel()
+		found := false
+		for m := range ch {
+			if strings.Contains(m.Desc().String(), `"sysUpTime"`) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("snmp_engineid %q: expected sysUpTime with the localized keys", snmpEngineID)
+		}
+	}
+}
+
+func TestNewNamedModulePrepares(t *testing.T) {
+	module := NewNamedModule("if_mib", &config.Module{
+		Metrics: []*config.Metric{{
+			Name:    "ifOperStatus",
+			Oid:     "1.3.6.1.2.1.2.2.1.8",
+			Type:    "gauge",
+			Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}},
+			Lookups: []*config.Lookup{{Labels: []string{"ifIndex"}, Labelname: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", Type: "DisplayString"}},
+		}},
+		Filters: []config.DynamicFilter{{Oid: "1.3.6.1.2.1.2.2.1.7", Values: []string{"^1$"}}},
+	})
+	// Filters that weren't loaded from a file are compiled too.
+	if !module.Filters[0].Matches("1") {
+		t.Error("expected the filter to be compiled")
+	}
+	metric, indexOids := findMetric(module.metricTree, oidToList("1.3.6.1.2.1.2.2.1.8.3"))
+	if metric == nil || len(metric.indexes) != 1 || len(metric.lookups) != 1 {
+		t.Fatalf("expected a prepared metric, got %+v", metric)
+	}
+	oidToPdu := map[string]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.2.2.1.2.3": {Name: ".1.3.6.1.2.1.2.2.1.2.3", Type: gosnmp.OctetString, Value: []byte("eth0")},
+	}
+	want := map[string]string{"ifIndex": "3", "ifDescr": "eth0"}
+	if got := indexesToLabels(indexOids, metric, oidToPdu, Metrics{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected labels %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// DiscoveredModule is what a target returned for the walks and gets of a
+// module.
+type DiscoveredModule struct {
+	Module string `json:"module"`
+	// Whether any walk or get returned data.
+	HasData bool             `json:"has_data"`
+	Roots   []DiscoveredRoot `json:"roots"`
+	// Estimated number of requests a scrape of the module sends.
+	EstimatedPackets int `json:"estimated_packets"`
+}
+
+// DiscoveredRoot is what a target returned for a walked subtree or a got OID.
+type DiscoveredRoot struct {
+	OID     string `json:"oid"`
+	Get     bool   `json:"get,omitempty"`
+	HasData bool   `json:"has_data"`
+	// Rows in the first column of the subtree that has data, or PDUs in the
+	// subtree if the module has no metric for that column.
+	Rows int `json:"rows"`
+	// Estimated number of requests a walk of the subtree sends.
+	EstimatedPackets int    `json:"estimated_packets,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// errProbed stops a walk after its first PDU.
+var errProbed = errors.New("subtree probed")
+
+// probedRoot is what a target returned for a subtree or OID, shared by the
+// modules that walk or get it.
+type probedRoot struct {
+	hasData bool
+	// The column the rows were counted in, the subtree itself if the
+	// module has no metric for its first PDU.
+	column string
+	rows   int
+	err    error
+}
+
+// Discover finds which of the walks and gets of the modules return data from
+// the target, without scraping them. Each subtree is first probed with a
+// request for a single variable, and only the first column of the subtrees
+// that have data is walked, to count their rows. An error is returned if the
+// target can't be reached at all.
+func (c Collector) Discover() ([]DiscoveredModule, error) {
+	if c.authChain == nil {
+		return c.discover()
+	}
+	// Like scrapes, start with the auth the target accepted last, and only
+	// go through the chain again if it no longer does.
+	name, auth, ok := c.authChain.remembered(c.target)
+	if ok {
+		c.auth = auth
+		discovered, err := c.discover()
+		if err == nil || !authFailure(err) {
+			return discovered, err
+		}
+		c.logger.Info("Target no longer accepts auth, trying the chain", "chained_auth", name)
+	}
+	_, auth, err := c.resolveAuth(c.ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	c.auth = auth
+	return c.discover()
+}
+
+// discover probes the modules with the auth of the collector, over a session
+// borrowed from the session pool like the ones of scrapes.
+func (c Collector) discover() ([]DiscoveredModule, error) {
+	client, err := c.connect(c.ctx, c.logger)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	walked, got := map[string]probedRoot{}, map[string]probedRoot{}
+	discovered := make([]DiscoveredModule, 0, len(c.modules))
+	for _, m := range c.modules {
+		logger := c.logger.With("module", m.name)
+		c.setDiscoverOptions(client, m)
+		maxRepetitions := max(int(m.WalkParams.MaxRepetitions), 1)
+		d := DiscoveredModule{Module: m.name, Roots: []DiscoveredRoot{}}
+		for _, oid := range m.Walk {
+			r, ok := walked[oid]
+			if !ok {
+				r = c.probeWalk(client, m, oid)
+				if fatalDiscoverError(r.err) {
+					return nil, r.err
+				}
+				logger.Debug("Probed subtree", "oid", oid, "rows", r.rows, "err", r.err)
+				walked[oid] = r
+			}
+			root := DiscoveredRoot{OID: oid, HasData: r.hasData, Rows: r.rows, EstimatedPackets: 1}
+			if r.err != nil {
+				root.Error = r.err.Error()
+			}
+			if r.hasData {
+				// Every column the module reads is assumed to have as many
+				// rows as the first one.
+				pdus := r.rows
+				if r.column != oid {
+					pdus *= walkedColumns(m, oid)
+				}
+				if c.auth.Version == 1 {
+					root.EstimatedPackets = pdus + 1
+				} else {
+					root.EstimatedPackets = (pdus + maxRepetitions) / maxRepetitions
+				}
+			}
+			d.HasData = d.HasData || root.HasData
+			d.EstimatedPackets += root.EstimatedPackets
+			d.Roots = append(d.Roots, root)
+		}
+		for _, oid := range m.Get {
+			r, ok := got[oid]
+			if !ok {
+				r = c.probeGet(client, oid)
+				if fatalDiscoverError(r.err) {
+					return nil, r.err
+				}
+				logger.Debug("Probed OID", "oid", oid, "err", r.err)
+				got[oid] = r
+			}
+			root := DiscoveredRoot{OID: oid, Get: true, HasData: r.hasData, Rows: r.rows}
+			if r.err != nil {
+				root.Error = r.err.Error()
+			}
+			d.HasData = d.HasData || root.HasData
+			d.Roots = append(d.Roots, root)
+		}
+		// Gets are sent in batches.
+		d.EstimatedPackets += (len(m.Get) + maxRepetitions - 1) / maxRepetitions
+		discovered = append(discovered, d)
+	}
+	return discovered, nil
+}
+
+// setDiscoverOptions sets the walk parameters of a module on the client.
+func (c Collector) setDiscoverOptions(client scraper.SNMPScraper, m *NamedModule) {
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		g.Retries = *m.WalkParams.Retries
+		g.Timeout = m.WalkParams.Timeout
+		if deadline, ok := c.ctx.Deadline(); ok {
+			g.Timeout, g.Retries = fitDeadline(g.Timeout, g.Retries, time.Until(deadline))
+		}
+		g.MaxRepetitions = m.WalkParams.MaxRepetitions
+		g.AppOpts = nil
+		if m.WalkParams.AllowNonIncreasingOIDs {
+			g.AppOpts = map[string]any{
+				"c": true,
+			}
+		}
+	})
+}
+
+// probeWalk requests the first PDU of a subtree, and if there is one counts
+// the rows of its column.
+func (c Collector) probeWalk(client scraper.SNMPScraper, m *NamedModule, oid string) probedRoot {
+	var first string
+	client.SetOptions(func(g *gosnmp.GoSNMP) { g.MaxRepetitions = 1 })
+	err := client.Walk(oid, func(pdu gosnmp.SnmpPDU) error {
+		first = strings.TrimPrefix(pdu.Name, ".")
+		return errProbed
+	})
+	client.SetOptions(func(g *gosnmp.GoSNMP) { g.MaxRepetitions = m.WalkParams.MaxRepetitions })
+	if first == "" {
+		return probedRoot{err: err}
+	}
+
+	r := probedRoot{hasData: true, column: oid}
+	if metric, _ := findMetric(m.metricTree, oidToList(first)); metric != nil && inSubtree(metric.Oid, oid) {
+		r.column = metric.Oid
+	}
+	r.err = client.Walk(r.column, func(gosnmp.SnmpPDU) error {
+		r.rows++
+		return nil
+	})
+	return r
+}
+
+// probeGet gets a single OID.
+func (c Collector) probeGet(client scraper.SNMPScraper, oid string) probedRoot {
+	packet, err := client.Get([]string{oid})
+	if err != nil {
+		return probedRoot{err: err}
+	}
+	// SNMPv1 will return packet error for unsupported OIDs.
+	if packet.Error == gosnmp.NoSuchName && c.auth.Version == 1 {
+		return probedRoot{}
+	}
+	if packet.Error != gosnmp.NoError {
+		return probedRoot{err: agentError{target: c.target, status: packet.Error}}
+	}
+	for _, v := range packet.Variables {
+		switch v.Type {
+		case gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView, gosnmp.Null:
+			continue
+		}
+		return probedRoot{hasData: true, rows: 1}
+	}
+	return probedRoot{}
+}
+
+// walkedColumns returns how many columns of a subtree a module has metrics or
+// lookups for.
+func walkedColumns(m *NamedModule, root string) int {
+	columns := map[string]bool{}
+	for _, metric := range m.Metrics {
+		if inSubtree(root, metric.Oid) {
+			return 1
+		}
+		if inSubtree(metric.Oid, root) {
+			columns[metric.Oid] = true
+		}
+		for _, lookup := range metric.Lookups {
+			if lookup.Oid != "" && inSubtree(lookup.Oid, root) {
+				columns[lookup.Oid] = true
+			}
+		}
+	}
+	return max(len(columns), 1)
+}
+
+// fatalDiscoverError reports whether an error means that the target can't be
+// discovered at all, rather than that a subtree or OID failed.
+func fatalDiscoverError(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch errorReason(err) {
+	case reasonTimeout, reasonCanceled, reasonConnectionRefused, reasonAuth:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+	"github.com/prometheus/snmp_exporter/simulator"
+)
+
+func TestDiscover(t *testing.T) {
+	pdus, err := scraper.ReadSnmprec(strings.NewReader(`1.3.6.1.2.1.1.1.0|4|Test device
+1.3.6.1.2.1.1.3.0|67|12345
+1.3.6.1.2.1.2.2.1.1.1|2|1
+1.3.6.1.2.1.2.2.1.1.2|2|2
+1.3.6.1.2.1.2.2.1.1.3|2|3
+1.3.6.1.2.1.2.2.1.2.1|4|lo
+1.3.6.1.2.1.2.2.1.2.2|4|eth0
+1.3.6.1.2.1.2.2.1.2.3|4|eth1
+1.3.6.1.2.1.2.2.1.3.1|2|24
+1.3.6.1.2.1.2.2.1.3.2|2|6
+1.3.6.1.2.1.2.2.1.3.3|2|6
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &config.Auth{Community: "public", Version: 2}
+	agent, err := simulator.NewAgent(promslog.NewNopLogger(), pdus, []*config.Auth{auth}, nil, simulator.Faults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go agent.ServePacket(conn)
+	defer conn.Close()
+
+	retries := 0
+	walkParams := config.WalkParams{Retries: &retries, Timeout: 100 * time.Millisecond, MaxRepetitions: 2}
+	index := []*config.Index{{Labelname: "ifIndex", Type: "gauge"}}
+	modules := []*NamedModule{
+		NewNamedModule("if_mib", &config.Module{
+			Walk: []string{"1.3.6.1.2.1.2.2"},
+			Metrics: []*config.Metric{
+				{Name: "ifIndex", Oid: "1.3.6.1.2.1.2.2.1.1", Type: "gauge", Indexes: index},
+				{Name: "ifType", Oid: "1.3.6.1.2.1.2.2.1.3", Type: "gauge", Indexes: index, Lookups: []*config.Lookup{{Labels: []string{"ifIndex"}, Labelname: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", Type: "DisplayString"}}},
+			},
+			WalkParams: walkParams,
+		}),
+		NewNamedModule("host_resources", &config.Module{
+			Walk:       []string{"1.3.6.1.2.1.25"},
+			WalkParams: walkParams,
+		}),
+		NewNamedModule("system", &config.Module{
+			Get:        []string{"1.3.6.1.2.1.1.3.0", "1.3.6.1.2.1.1.5.0"},
+			WalkParams: walkParams,
+		}),
+	}
+	c := New(context.Background(), conn.LocalAddr().String(), "public_v2", "", "", auth, modules, promslog.NewNopLogger(), Metrics{}, 1, false)
+	got, err := c.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DiscoveredModule{
+		{
+			Module:  "if_mib",
+			HasData: true,
+			// 3 rows of 3 columns in bulks of 2, and the request leaving the table.
+			Roots:            []DiscoveredRoot{{OID: "1.3.6.1.2.1.2.2", HasData: true, Rows: 3, EstimatedPackets: 5}},
+			EstimatedPackets: 5,
+		},
+		{
+			Module:           "host_resources",
+			Roots:            []DiscoveredRoot{{OID: "1.3.6.1.2.1.25", EstimatedPackets: 1}},
+			EstimatedPackets: 1,
+		},
+		{
+			Module:  "system",
+			HasData: true,
+			Roots: []DiscoveredRoot{
+				{OID: "1.3.6.1.2.1.1.3.0", Get: true, HasData: true, Rows: 1},
+				{OID: "1.3.6.1.2.1.1.5.0", Get: true},
+			},
+			EstimatedPackets: 1,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+
+	// A target that doesn't answer can't be discovered at all.
+	conn.Close()
+	if _, err := c.Discover(); err == nil {
+		t.Error("expected an error for a target that doesn't answer")
+	}
+}
+
+func TestDiscoverSessionPool(t *testing.T) {
+	pdus, err := scraper.ReadSnmprec(strings.NewReader(`1.3.6.1.2.1.2.2.1.1.1|2|1
+1.3.6.1.2.1.2.2.1.1.2|2|2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &config.Auth{Community: "public", Version: 2}
+	agent, err := simulator.NewAgent(promslog.NewNopLogger(), pdus, []*config.Auth{auth}, nil, simulator.Faults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &connListener{Listener: l}
+	go agent.ServeStream(listener)
+	defer listener.Close()
+	defer listener.closeConns()
+
+	retries := 0
+	module := NewNamedModule("if_mib", &config.Module{
+		Walk:       []string{"1.3.6.1.2.1.2.2"},
+		Metrics:    []*config.Metric{{Name: "ifIndex", Oid: "1.3.6.1.2.1.2.2.1.1", Type: "gauge"}},
+		WalkParams: config.WalkParams{Retries: &retries, Timeout: time.Second, MaxRepetitions: 2},
+	})
+	pool := NewSessionPool(1, time.Hour)
+	// The walks stopped after their first PDU leave the session usable.
+	for i := range 2 {
+		c := New(context.Background(), "tcp://"+l.Addr().String(), "public_v2", "", "", auth, []*NamedModule{module}, promslog.NewNopLogger(), Metrics{}, 1, false)
+		c.UseSessionPool(pool)
+		discovered, err := c.Discover()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := discovered[0].Roots[0].Rows; got != 2 {
+			t.Fatalf("discovery %d: expected 2 rows, got %d", i, got)
+		}
+	}
+	if got := listener.accepted(); got != 1 {
+		t.Fatalf("expected the discoveries to share 1 connection, got %d", got)
+	}
+	if got := metricValue(pool.evictions.WithLabelValues("failed")); got != 0 {
+		t.Fatalf("expected no failed sessions, got %v", got)
+	}
+}
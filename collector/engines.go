@@ -0,0 +1,428 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// EngineCache caches the SNMPv3 engines of targets and the keys of auths
+// localized to them across scrapes, so that scrapes skip engine discovery
+// and key localization. It is shared by all scrapes.
+type EngineCache struct {
+	ttl    time.Duration
+	hits   *prometheus.CounterVec
+	misses *prometheus.CounterVec
+
+	mu        sync.Mutex
+	engines   map[string]engine
+	keys      map[keysKey]localizedKeys
+	lastSweep time.Time
+}
+
+// engine is the SNMPv3 engine of a target, as of when its time was read.
+type engine struct {
+	id    string
+	boots uint32
+	time  uint32
+	at    time.Time
+}
+
+type keysKey struct {
+	engineID string
+	// The fingerprint of the auth.
+	auth string
+}
+
+type localizedKeys struct {
+	auth []byte
+	priv []byte
+	at   time.Time
+}
+
+// NewEngineCache returns a cache whose entries expire after a TTL, or nil if
+// the TTL isn't positive.
+func NewEngineCache(ttl time.Duration) *EngineCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &EngineCache{
+		ttl: ttl,
+		hits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "snmp_engine_cache_hits_total",
+			Help: "Lookups of SNMPv3 engines and localized keys that were cached.",
+		}, []string{"cache"}),
+		misses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "snmp_engine_cache_misses_total",
+			Help: "Lookups of SNMPv3 engines and localized keys that weren't cached.",
+		}, []string{"cache"}),
+		engines:   map[string]engine{},
+		keys:      map[keysKey]localizedKeys{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (e *EngineCache) Describe(ch chan<- *prometheus.Desc) {
+	e.hits.Describe(ch)
+	e.misses.Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (e *EngineCache) Collect(ch chan<- prometheus.Metric) {
+	e.hits.Collect(ch)
+	e.misses.Collect(ch)
+}
+
+// engine returns the engine of a target, with its time moved on to now.
+func (e *EngineCache) engine(target string) (engine, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	eng, ok := e.engines[target]
+	if ok && time.Since(eng.at) > e.ttl {
+		delete(e.engines, target)
+		ok = false
+	}
+	if !ok {
+		e.misses.WithLabelValues("engine").Inc()
+		return engine{}, false
+	}
+	e.hits.WithLabelValues("engine").Inc()
+	eng.time += uint32(time.Since(eng.at) / time.Second)
+	return eng, true
+}
+
+func (e *EngineCache) storeEngine(target string, eng engine) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.engines[target] = eng
+	e.sweep()
+}
+
+// forgetEngine drops the engine of a target, such as when the target no
+// longer accepts it.
+func (e *EngineCache) forgetEngine(target string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.engines, target)
+}
+
+// localizedKeys returns the keys of an auth localized to an engine ID.
+func (e *EngineCache) localizedKeys(engineID, auth string) ([]byte, []byte, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	key := keysKey{engineID: engineID, auth: auth}
+	keys, ok := e.keys[key]
+	if ok && time.Since(keys.at) > e.ttl {
+		delete(e.keys, key)
+		ok = false
+	}
+	if !ok {
+		e.misses.WithLabelValues("keys").Inc()
+		return nil, nil, false
+	}
+	e.hits.WithLabelValues("keys").Inc()
+	return keys.auth, keys.priv, true
+}
+
+func (e *EngineCache) storeKeys(engineID, auth string, authKey, privKey []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.keys[keysKey{engineID: engineID, auth: auth}] = localizedKeys{auth: authKey, priv: privKey, at: time.Now()}
+	e.sweep()
+}
+
+// sweep drops the expired entries once per TTL. It must be called with the
+// lock held.
+func (e *EngineCache) sweep() {
+	if time.Since(e.lastSweep) < e.ttl {
+		return
+	}
+	e.lastSweep = time.Now()
+	for target, eng := range e.engines {
+		if time.Since(eng.at) > e.ttl {
+			delete(e.engines, target)
+		}
+	}
+	for key, keys := range e.keys {
+		if time.Since(keys.at) > e.ttl {
+			delete(e.keys, key)
+		}
+	}
+}
+
+// authFingerprint identifies the settings of an auth that its localized keys
+// are derived from.
+func authFingerprint(auth *config.Auth) string {
+	h := sha256.New()
+	for _, s := range []string{auth.Username, auth.SecurityLevel, auth.AuthProtocol, auth.PrivProtocol,
+		string(auth.Password), string(auth.PrivPassword), string(auth.AuthKey), string(auth.PrivKey)} {
+		fmt.Fprintf(h, "%q", s)
+	}
+	engineIDs := make([]string, 0, len(auth.LocalizedKeys))
+	for engineID := range auth.LocalizedKeys {
+		engineIDs = append(engineIDs, engineID)
+	}
+	slices.Sort(engineIDs)
+	for _, engineID := range engineIDs {
+		keys := auth.LocalizedKeys[engineID]
+		fmt.Fprintf(h, "%q%q%q", engineID, string(keys.AuthKey), string(keys.PrivKey))
+	}
+	return string(h.Sum(nil))
+}
+
+// engineScraper keeps the engine of a target in the cache up to date with
+// the security parameters of the scrape, which gosnmp updates from each
+// response and from the reports of the target.
+type engineScraper struct {
+	scraper.SNMPScraper
+	cache  *EngineCache
+	target string
+	// When the last response was received, if any.
+	last  time.Time
+	stale bool
+}
+
+func (s *engineScraper) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	packet, err := s.SNMPScraper.Get(oids)
+	s.check(err)
+	return packet, err
+}
+
+func (s *engineScraper) WalkAll(oid string) ([]gosnmp.SnmpPDU, error) {
+	pdus, err := s.SNMPScraper.WalkAll(oid)
+	s.check(err)
+	return pdus, err
+}
+
+func (s *engineScraper) Walk(oid string, fn func(gosnmp.SnmpPDU) error) error {
+	stopped, err := walkStopped(s.SNMPScraper, oid, fn)
+	if stopped {
+		// The engine answered before fn stopped the walk.
+		s.check(nil)
+	} else {
+		s.check(err)
+	}
+	return err
+}
+
+func (s *engineScraper) check(err error) {
+	switch {
+	case err == nil:
+		s.last = time.Now()
+	case errors.Is(err, gosnmp.ErrNotInTimeWindow), errors.Is(err, gosnmp.ErrUnknownEngineID):
+		// gosnmp already retried with the engine of the report.
+		s.stale = true
+	case errorReason(err) == reasonAuth:
+		// The reports of an engine that replaced the cached one aren't
+		// authentic to gosnmp, so it can't recover from them.
+		s.stale = true
+	}
+}
+
+func (s *engineScraper) Close() error {
+	if s.stale {
+		s.cache.forgetEngine(s.target)
+	} else if !s.last.IsZero() {
+		s.SetOptions(func(g *gosnmp.GoSNMP) {
+			usm, ok := g.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+			if ok && usm.AuthoritativeEngineID != "" {
+				s.cache.storeEngine(s.target, engine{
+					id:    usm.AuthoritativeEngineID,
+					boots: usm.AuthoritativeEngineBoots,
+					time:  usm.AuthoritativeEngineTime,
+					at:    s.last,
+				})
+			}
+		})
+	}
+	return s.SNMPScraper.Close()
+}
+
+// targetEngine is the engine of the target as of the last response of a
+// scrape, which is reported once for all the modules of the scrape.
+type targetEngine struct {
+	mu  sync.Mutex
+	eng engine
+}
+
+// record keeps the engine a client last heard from.
+func (t *targetEngine) record(client scraper.SNMPScraper) {
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		usm, ok := g.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+		if !ok || usm.AuthoritativeEngineID == "" {
+			return
+		}
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.eng = engine{
+			id:    usm.AuthoritativeEngineID,
+			boots: usm.AuthoritativeEngineBoots,
+			time:  usm.AuthoritativeEngineTime,
+			at:    time.Now(),
+		}
+	})
+}
+
+// metrics reports the engine of the target, if the scrape heard from it.
+func (t *targetEngine) metrics(ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.eng.id == "" {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc("snmp_engine_info", "The SNMPv3 engine ID of the target.", []string{"engine_id"}, nil),
+		prometheus.GaugeValue, 1, hex.EncodeToString([]byte(t.eng.id)))
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc("snmp_engine_boots", "The number of times the SNMPv3 engine of the target was restarted.", nil, nil),
+		prometheus.GaugeValue, float64(t.eng.boots))
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc("snmp_engine_time_seconds", "The time since the SNMPv3 engine of the target was last restarted.", nil, nil),
+		prometheus.GaugeValue, float64(t.eng.time))
+}
+
+// usmReports are the usmStats counters of RFC 3414 that are counted when
+// targets send them in reports. usmStatsUnknownEngineIDs isn't, as it
+// answers every engine discovery.
+var usmReports = map[string]string{
+	"1.3.6.1.6.3.15.1.1.1.0": "unsupportedSecLevel",
+	"1.3.6.1.6.3.15.1.1.2.0": "notInTimeWindow",
+	"1.3.6.1.6.3.15.1.1.3.0": "unknownUserName",
+	"1.3.6.1.6.3.15.1.1.5.0": "wrongDigest",
+	"1.3.6.1.6.3.15.1.1.6.0": "decryptionError",
+}
+
+// reportHeader is a v3 message as defined in RFC 3412, with the scoped PDU
+// left undecoded. Agents, gosnmp among them, don't always encode the message
+// ID and size minimally, which encoding/asn1 rejects for integers.
+type reportHeader struct {
+	Version    int
+	GlobalData struct {
+		ID            asn1.RawValue
+		MaxSize       asn1.RawValue
+		Flags         []byte
+		SecurityModel asn1.RawValue
+	}
+	SecurityParameters []byte
+	ScopedPDU          asn1.RawValue
+}
+
+// scopedPDUHeader is a scoped PDU, with the PDU left undecoded.
+type scopedPDUHeader struct {
+	ContextEngineID []byte
+	ContextName     []byte
+	PDU             asn1.RawValue
+}
+
+// isReport tells from its headers whether a message is a v3 report, so that
+// the responses to requests aren't decoded an extra time. Reports are never
+// encrypted, and never reportable themselves.
+func isReport(msg []byte) bool {
+	var header reportHeader
+	if _, err := asn1.Unmarshal(msg, &header); err != nil {
+		return false
+	}
+	if header.Version != int(gosnmp.Version3) || len(header.GlobalData.Flags) != 1 {
+		return false
+	}
+	privacy := gosnmp.AuthPriv &^ gosnmp.AuthNoPriv
+	if gosnmp.SnmpV3MsgFlags(header.GlobalData.Flags[0])&(privacy|gosnmp.Reportable) != 0 {
+		return false
+	}
+	var scoped scopedPDUHeader
+	if _, err := asn1.Unmarshal(header.ScopedPDU.FullBytes, &scoped); err != nil {
+		return false
+	}
+	return scoped.PDU.Class == asn1.ClassContextSpecific && scoped.PDU.Tag == int(gosnmp.Report&0x1f)
+}
+
+// usmReport returns the usmStats counter a message reports, if any. Only the
+// scoped PDUs of messages that aren't encrypted can be read, which reports
+// never are.
+func usmReport(msg []byte) string {
+	if !isReport(msg) {
+		return ""
+	}
+	g := &gosnmp.GoSNMP{
+		Version:       gosnmp.Version3,
+		SecurityModel: gosnmp.UserSecurityModel,
+		MsgFlags:      gosnmp.NoAuthNoPriv,
+		// gosnmp requires a user, which decoding doesn't use.
+		SecurityParameters: &gosnmp.UsmSecurityParameters{UserName: "report"},
+	}
+	packet, err := g.SnmpDecodePacket(msg)
+	if err != nil || packet.PDUType != gosnmp.Report || len(packet.Variables) == 0 {
+		return ""
+	}
+	return usmReports[strings.TrimPrefix(packet.Variables[0].Name, ".")]
+}
+
+// reportConn counts the USM reports read from a connection, which gosnmp
+// either recovers from or turns into errors.
+type reportConn struct {
+	net.Conn
+	reports *prometheus.CounterVec
+}
+
+func newReportConn(conn net.Conn, reports *prometheus.CounterVec) net.Conn {
+	c := &reportConn{Conn: conn, reports: reports}
+	if pc, ok := conn.(net.PacketConn); ok {
+		// gosnmp reads UDP responses with ReadFrom.
+		return &reportPacketConn{reportConn: c, pc: pc}
+	}
+	return c
+}
+
+func (c *reportConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.count(b[:n])
+	return n, err
+}
+
+func (c *reportConn) count(msg []byte) {
+	if report := usmReport(msg); report != "" {
+		c.reports.WithLabelValues(report).Inc()
+	}
+}
+
+type reportPacketConn struct {
+	*reportConn
+	pc net.PacketConn
+}
+
+func (c *reportPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.pc.ReadFrom(b)
+	c.count(b[:n])
+	return n, addr, err
+}
+
+func (c *reportPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.pc.WriteTo(b, addr)
+}
@@ -0,0 +1,273 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+	"github.com/prometheus/snmp_exporter/simulator"
+)
+
+func TestEngineCache(t *testing.T) {
+	metrics := Metrics{
+		SNMPCollectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "d"}, []string{"module"}),
+		SNMPUnexpectedPduType:  prometheus.NewCounter(prometheus.CounterOpts{Name: "u"}),
+		SNMPDuration:           prometheus.NewHistogram(prometheus.HistogramOpts{Name: "p"}),
+		SNMPPackets:            prometheus.NewCounter(prometheus.CounterOpts{Name: "s"}),
+		SNMPRetries:            prometheus.NewCounter(prometheus.CounterOpts{Name: "r"}),
+		SNMPInflight:           prometheus.NewGauge(prometheus.GaugeOpts{Name: "i"}),
+	}
+	pdus, err := scraper.ReadSnmprec(strings.NewReader("1.3.6.1.2.1.1.3.0|67|12345\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwords := &config.Auth{
+		Username: "admin", SecurityLevel: "authPriv", Version: 3,
+		AuthProtocol: "SHA", Password: "maplesyrup",
+		PrivProtocol: "AES", PrivPassword: "pancakes",
+	}
+	engineID := []byte{0x80, 0x00, 0x1f, 0x88, 0x04, 0x73, 0x6e, 0x6d, 0x70}
+	agent, err := simulator.NewAgent(promslog.NewNopLogger(), pdus, []*config.Auth{passwords}, engineID, simulator.Faults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go agent.ServePacket(conn)
+	defer conn.Close()
+	target := conn.LocalAddr().String()
+
+	retries := 0
+	module := NewNamedModule("system", &config.Module{
+		Get:        []string{"1.3.6.1.2.1.1.3.0"},
+		Metrics:    []*config.Metric{{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge"}},
+		WalkParams: config.WalkParams{Retries: &retries, Timeout: time.Second, MaxRepetitions: 2},
+	})
+	cache := NewEngineCache(time.Hour)
+	// scrape returns whether sysUpTime was scraped, and the packets sent.
+	scrape := func(auth *config.Auth) (bool, float64) {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		before := metricValue(metrics.SNMPPackets)
+		c := New(ctx, target, "v3", "", "", auth, []*NamedModule{module}, promslog.NewNopLogger(), metrics, 1, false)
+		c.UseEngineCache(cache)
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		found := false
+		for m := range ch {
+			if strings.Contains(m.Desc().String(), `"sysUpTime"`) {
+				found = true
+			}
+		}
+		return found, metricValue(metrics.SNMPPackets) - before
+	}
+
+	// Only the first scrape discovers the engine, and the keys are only
+	// localized once the engine is known.
+	for i, want := range []float64{2, 1, 1} {
+		if found, packets := scrape(passwords); !found || packets != want {
+			t.Fatalf("scrape %d: expected sysUpTime in %v packets, got %v in %v packets", i, want, found, packets)
+		}
+	}
+	for _, tc := range []struct {
+		counter *prometheus.CounterVec
+		cache   string
+		want    float64
+	}{
+		{cache.hits, "engine", 2},
+		{cache.misses, "engine", 1},
+		{cache.hits, "keys", 1},
+		{cache.misses, "keys", 1},
+	} {
+		if got := metricValue(tc.counter.WithLabelValues(tc.cache)); got != tc.want {
+			t.Errorf("expected %v for the %s cache, got %v", tc.want, tc.cache, got)
+		}
+	}
+
+	// An engine that changed is discovered again on the next scrape.
+	stale := engine{id: "\x80\x00\x00\x00\x05stale", at: time.Now()}
+	cache.storeEngine(target, stale)
+	if found, _ := scrape(passwords); found {
+		t.Fatal("expected no sysUpTime with the old engine")
+	}
+	if found, _ := scrape(passwords); !found {
+		t.Fatal("expected sysUpTime once the engine is discovered again")
+	}
+	if eng, ok := cache.engine(target); !ok || eng.id != string(engineID) {
+		t.Fatalf("expected the engine to be replaced, got %x", eng.id)
+	}
+
+	// Keys only localized to the new engine can't be used with the old one.
+	g := &gosnmp.GoSNMP{}
+	passwords.ConfigureSNMP(g, "")
+	usm := g.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	usm.AuthoritativeEngineID = string(engineID)
+	if err := usm.InitSecurityKeys(); err != nil {
+		t.Fatal(err)
+	}
+	keys := *passwords
+	keys.Password, keys.PrivPassword = "", ""
+	keys.LocalizedKeys = map[string]config.LocalizedKeys{
+		hex.EncodeToString(engineID): {
+			AuthKey: config.Secret(hex.EncodeToString(usm.SecretKey)),
+			PrivKey: config.Secret(hex.EncodeToString(usm.PrivacyKey)),
+		},
+	}
+	cache.storeEngine(target, stale)
+	if found, _ := scrape(&keys); found {
+		t.Fatal("expected no sysUpTime with keys for another engine")
+	}
+	if found, _ := scrape(&keys); !found {
+		t.Fatal("expected sysUpTime once the engine is discovered again")
+	}
+}
+
+func TestEngineMetrics(t *testing.T) {
+	metrics := Metrics{
+		SNMPCollectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "d"}, []string{"module"}),
+		SNMPUnexpectedPduType:  prometheus.NewCounter(prometheus.CounterOpts{Name: "u"}),
+		SNMPDuration:           prometheus.NewHistogram(prometheus.HistogramOpts{Name: "p"}),
+		SNMPPackets:            prometheus.NewCounter(prometheus.CounterOpts{Name: "s"}),
+		SNMPRetries:            prometheus.NewCounter(prometheus.CounterOpts{Name: "r"}),
+		SNMPInflight:           prometheus.NewGauge(prometheus.GaugeOpts{Name: "i"}),
+		SNMPReports:            prometheus.NewCounterVec(prometheus.CounterOpts{Name: "reports"}, []string{"report"}),
+	}
+	pdus, err := scraper.ReadSnmprec(strings.NewReader("1.3.6.1.2.1.1.3.0|67|12345\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auths := map[string]*config.Auth{
+		"admin_v3": {Username: "admin", SecurityLevel: "authNoPriv", Password: "maplesyrup", AuthProtocol: "SHA", Version: 3},
+		"wrong_v3": {Username: "admin", SecurityLevel: "authNoPriv", Password: "pancakes", AuthProtocol: "SHA", Version: 3},
+		"guest_v3": {Username: "guest", SecurityLevel: "authNoPriv", Password: "maplesyrup", AuthProtocol: "SHA", Version: 3},
+	}
+	engineID := []byte{0x80, 0x00, 0x1f, 0x88, 0x04, 0x73, 0x6e, 0x6d, 0x70}
+	agent, err := simulator.NewAgent(promslog.NewNopLogger(), pdus, []*config.Auth{auths["admin_v3"]}, engineID, simulator.Faults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go agent.ServePacket(conn)
+	defer conn.Close()
+
+	retries := 0
+	var modules []*NamedModule
+	for _, name := range []string{"system", "uptime"} {
+		modules = append(modules, NewNamedModule(name, &config.Module{
+			Get:        []string{"1.3.6.1.2.1.1.3.0"},
+			Metrics:    []*config.Metric{{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge"}},
+			WalkParams: config.WalkParams{Retries: &retries, Timeout: time.Second, MaxRepetitions: 2},
+		}))
+	}
+	for _, name := range []string{"admin_v3", "wrong_v3", "guest_v3"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		c := New(ctx, conn.LocalAddr().String(), name, "", "", auths[name], modules, promslog.NewNopLogger(), metrics, 1, false)
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		cancel()
+		// The engine is known even if the target rejects the auth, and is
+		// reported once for all modules.
+		var got []string
+		for m := range ch {
+			if !strings.Contains(m.Desc().String(), `"snmp_engine_info"`) {
+				continue
+			}
+			var pb io_prometheus_client.Metric
+			if err := m.Write(&pb); err != nil {
+				t.Fatal(err)
+			}
+			for _, l := range pb.GetLabel() {
+				got = append(got, l.GetName()+"="+l.GetValue())
+			}
+		}
+		if want := []string{"engine_id=" + hex.EncodeToString(engineID)}; !slices.Equal(got, want) {
+			t.Errorf("%s: expected engine labels %q, got %q", name, want, got)
+		}
+	}
+	for report, want := range map[string]float64{"wrongDigest": 2, "unknownUserName": 2, "notInTimeWindow": 0} {
+		if got := metricValue(metrics.SNMPReports.WithLabelValues(report)); got != want {
+			t.Errorf("expected %v %s reports, got %v", want, report, got)
+		}
+	}
+}
+
+func TestUSMReport(t *testing.T) {
+	msg := func(pduType gosnmp.PDUType, flags gosnmp.SnmpV3MsgFlags, oid string) []byte {
+		packet := &gosnmp.SnmpPacket{
+			Version:            gosnmp.Version3,
+			MsgFlags:           flags,
+			SecurityModel:      gosnmp.UserSecurityModel,
+			SecurityParameters: &gosnmp.UsmSecurityParameters{AuthoritativeEngineID: "\x80\x00\x00\x00\x05test"},
+			PDUType:            pduType,
+			Variables:          []gosnmp.SnmpPDU{{Name: oid, Type: gosnmp.Counter32, Value: uint(3)}},
+		}
+		b, err := packet.MarshalMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	for _, tc := range []struct {
+		msg  []byte
+		want string
+	}{
+		{msg(gosnmp.Report, gosnmp.NoAuthNoPriv, ".1.3.6.1.6.3.15.1.1.2.0"), "notInTimeWindow"},
+		{msg(gosnmp.Report, gosnmp.NoAuthNoPriv, ".1.3.6.1.6.3.15.1.1.6.0"), "decryptionError"},
+		// Engine discovery.
+		{msg(gosnmp.Report, gosnmp.NoAuthNoPriv, ".1.3.6.1.6.3.15.1.1.4.0"), ""},
+		{msg(gosnmp.GetResponse, gosnmp.NoAuthNoPriv, ".1.3.6.1.6.3.15.1.1.2.0"), ""},
+		// Reports are never reportable.
+		{msg(gosnmp.Report, gosnmp.Reportable, ".1.3.6.1.6.3.15.1.1.2.0"), ""},
+		{[]byte("garbage"), ""},
+	} {
+		if got := usmReport(tc.msg); got != tc.want {
+			t.Errorf("expected report %q, got %q", tc.want, got)
+		}
+	}
+}
+
+// metricValue returns the value of a collector holding a single counter or
+// gauge.
+func metricValue(c prometheus.Collector) float64 {
+	ch := make(chan prometheus.Metric, 1)
+	c.Collect(ch)
+	var pb io_prometheus_client.Metric
+	if err := (<-ch).Write(&pb); err != nil {
+		panic(err)
+	}
+	if pb.Counter != nil {
+		return pb.Counter.GetValue()
+	}
+	return pb.Gauge.GetValue()
+}
@@ -0,0 +1,89 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// Reasons a scrape, or part of it, failed.
+const (
+	reasonTimeout           = "timeout"
+	reasonAuth              = "auth"
+	reasonConnectionRefused = "connection_refused"
+	reasonAgentError        = "agent_error"
+	reasonDecode            = "decode"
+	reasonCanceled          = "canceled"
+	reasonNoMatchingRule    = "no_matching_rule"
+	reasonError             = "error"
+)
+
+// agentError is an error status the target reported in a response.
+type agentError struct {
+	target string
+	status gosnmp.SNMPError
+}
+
+func (e agentError) Error() string {
+	return fmt.Sprintf("error reported by target %s: %s", e.target, e.status)
+}
+
+// USM report PDUs, which the target sends when it rejects a request's
+// credentials.
+var authErrors = []error{
+	gosnmp.ErrUnknownUsername,
+	gosnmp.ErrWrongDigest,
+	gosnmp.ErrDecryption,
+	gosnmp.ErrNotInTimeWindow,
+	gosnmp.ErrUnknownEngineID,
+	gosnmp.ErrUnknownSecurityLevel,
+	gosnmp.ErrUnknownSecurityModels,
+}
+
+// errorReason classifies why a scrape, or a walk or get of it, failed.
+func errorReason(err error) string {
+	var agentErr agentError
+	switch {
+	case errors.As(err, &agentErr):
+		return reasonAgentError
+	case errors.Is(err, context.DeadlineExceeded), strings.Contains(err.Error(), "request timeout"):
+		return reasonTimeout
+	case errors.Is(err, context.Canceled):
+		return reasonCanceled
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return reasonConnectionRefused
+	case errors.Is(err, errNoMatchingRule):
+		return reasonNoMatchingRule
+	}
+	for _, authErr := range authErrors {
+		if errors.Is(err, authErr) {
+			return reasonAuth
+		}
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "not authentic"):
+		return reasonAuth
+	case errors.Is(err, gosnmp.ErrInvalidPacketLength), strings.Contains(msg, "unmarshal"),
+		strings.Contains(msg, "truncated packet"), strings.Contains(msg, "error parsing"):
+		return reasonDecode
+	}
+	return reasonError
+}
@@ -0,0 +1,341 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+	"github.com/prometheus/snmp_exporter/simulator"
+)
+
+func TestErrorReason(t *testing.T) {
+	refused := &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", syscall.ECONNREFUSED)}
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("scrape deadline exceeded: %w", context.DeadlineExceeded), reasonTimeout},
+		{errors.New("error walking target 192.0.2.1: request timeout (after 3 retries)"), reasonTimeout},
+		{fmt.Errorf("scrape canceled: %w", context.Canceled), reasonCanceled},
+		{fmt.Errorf("error getting target 192.0.2.1: %w", refused), reasonConnectionRefused},
+		{fmt.Errorf("error getting target 192.0.2.1: %w", gosnmp.ErrWrongDigest), reasonAuth},
+		{fmt.Errorf("error getting target 192.0.2.1: %w", gosnmp.ErrUnknownUsername), reasonAuth},
+		{errors.New("incoming packet is not authentic, discarding"), reasonAuth},
+		{agentError{target: "192.0.2.1", status: gosnmp.GenErr}, reasonAgentError},
+		{errors.New("error in unmarshalResponse: bad value"), reasonDecode},
+		{errors.New("something else"), reasonError},
+	}
+	for _, tc := range cases {
+		if got := errorReason(tc.err); got != tc.want {
+			t.Errorf("errorReason(%q) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestAgentErrorString(t *testing.T) {
+	err := agentError{target: "192.0.2.1", status: gosnmp.NoAccess}
+	if want := "error reported by target 192.0.2.1: NoAccess"; err.Error() != want {
+		t.Errorf("expected %q, got %q", want, err.Error())
+	}
+}
+
+func TestCollectModuleSuccess(t *testing.T) {
+	metrics := Metrics{
+		SNMPCollectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "d"}, []string{"module"}),
+		SNMPUnexpectedPduType:  prometheus.NewCounter(prometheus.CounterOpts{Name: "u"}),
+		SNMPDuration:           prometheus.NewHistogram(prometheus.HistogramOpts{Name: "p"}),
+		SNMPPackets:            prometheus.NewCounter(prometheus.CounterOpts{Name: "s"}),
+		SNMPRetries:            prometheus.NewCounter(prometheus.CounterOpts{Name: "r"}),
+		SNMPInflight:           prometheus.NewGauge(prometheus.GaugeOpts{Name: "i"}),
+	}
+	retries := 3
+	agentErr := agentError{target: "192.0.2.1", status: gosnmp.GenErr}
+	cases := []struct {
+		name        string
+		required    bool
+		walkErr     error
+		wantSuccess float64
+		wantReason  string
+		wantSamples int
+	}{
+		{name: "optional walk fails", walkErr: agentErr, wantSuccess: 1, wantSamples: 1},
+		{name: "required walk fails", required: true, walkErr: agentErr, wantReason: reasonAgentError},
+		{name: "optional walk times out", walkErr: context.DeadlineExceeded, wantReason: reasonTimeout, wantSamples: 1},
+		{name: "required walk times out", required: true, walkErr: context.DeadlineExceeded, wantReason: reasonTimeout},
+		{name: "required walk canceled", required: true, walkErr: context.Canceled, wantReason: reasonCanceled},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := scraper.NewMockSNMPScraper(map[string]gosnmp.SnmpPDU{
+				"1.3.6.1.2.1.1.3.0": {Name: "1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: uint32(12345)},
+			}, nil)
+			mock.WalkErrors = map[string]error{"1.3.6.1.2.1.2": tc.walkErr}
+			module := NewNamedModule("if_mib", &config.Module{
+				Get:        []string{"1.3.6.1.2.1.1.3.0"},
+				Walk:       []string{"1.3.6.1.2.1.2"},
+				Metrics:    []*config.Metric{{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge"}},
+				WalkParams: config.WalkParams{Retries: &retries},
+				Required:   tc.required,
+			})
+			c := Collector{ctx: context.Background(), target: "192.0.2.1", auth: &config.Auth{Version: 2}, metrics: metrics}
+
+			ch := make(chan prometheus.Metric, 100)
+			c.collect(ch, promslog.NewNopLogger(), mock, module)
+			close(ch)
+
+			var (
+				success = -1.0
+				reason  string
+				samples int
+			)
+			for m := range ch {
+				var pb io_prometheus_client.Metric
+				if err := m.Write(&pb); err != nil {
+					t.Fatal(err)
+				}
+				desc := m.Desc().String()
+				switch {
+				case strings.Contains(desc, `"sysUpTime"`):
+					samples++
+				case strings.Contains(desc, `"snmp_scrape_module_success"`):
+					success = pb.GetGauge().GetValue()
+				case strings.Contains(desc, `"snmp_scrape_error_info"`):
+					for _, l := range pb.GetLabel() {
+						if l.GetName() == "reason" {
+							reason = l.GetValue()
+						}
+					}
+				}
+			}
+			if success != tc.wantSuccess {
+				t.Errorf("expected module success %v, got %v", tc.wantSuccess, success)
+			}
+			if reason != tc.wantReason {
+				t.Errorf("expected reason %q, got %q", tc.wantReason, reason)
+			}
+			if samples != tc.wantSamples {
+				t.Errorf("expected %d samples, got %d", tc.wantSamples, samples)
+			}
+		})
+	}
+}
+
+func TestCollectSimulatedAgentErrors(t *testing.T) {
+	metrics := Metrics{
+		SNMPCollectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "d"}, []string{"module"}),
+		SNMPUnexpectedPduType:  prometheus.NewCounter(prometheus.CounterOpts{Name: "u"}),
+		SNMPDuration:           prometheus.NewHistogram(prometheus.HistogramOpts{Name: "p"}),
+		SNMPPackets:            prometheus.NewCounter(prometheus.CounterOpts{Name: "s"}),
+		SNMPRetries:            prometheus.NewCounter(prometheus.CounterOpts{Name: "r"}),
+		SNMPInflight:           prometheus.NewGauge(prometheus.GaugeOpts{Name: "i"}),
+	}
+	pdus, err := scraper.ReadSnmprec(strings.NewReader(`1.3.6.1.2.1.1.1.0|4|Test device
+1.3.6.1.2.1.1.3.0|67|12345
+1.3.6.1.2.1.2.2.1.2.1|4|lo
+1.3.6.1.2.1.2.2.1.2.2|4|eth0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2 := &config.Auth{Community: "public", Version: 2}
+	v3 := &config.Auth{Username: "admin", SecurityLevel: "authNoPriv", Password: "maplesyrup", AuthProtocol: "SHA", Version: 3}
+	retries := 0
+
+	cases := []struct {
+		name               string
+		faults             simulator.Faults
+		auth               *config.Auth
+		allowNonIncreasing bool
+		wantReason         string
+	}{
+		{name: "success", auth: v3},
+		{name: "wrong community", auth: &config.Auth{Community: "private", Version: 2}, wantReason: reasonTimeout},
+		{name: "wrong password", auth: &config.Auth{Username: "admin", SecurityLevel: "authNoPriv", Password: "pancakes", AuthProtocol: "SHA", Version: 3}, wantReason: reasonAuth},
+		{name: "dropped requests", faults: simulator.Faults{DropRate: 1}, auth: v2, wantReason: reasonTimeout},
+		{name: "too big", faults: simulator.Faults{MaxVariables: 1}, auth: v2, wantReason: reasonAgentError},
+		{name: "non-increasing OIDs", faults: simulator.Faults{NonIncreasingOIDs: true}, auth: v2, wantReason: reasonError},
+		{name: "non-increasing OIDs allowed", faults: simulator.Faults{NonIncreasingOIDs: true}, auth: v2, allowNonIncreasing: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			agent, err := simulator.NewAgent(promslog.NewNopLogger(), pdus, []*config.Auth{v2, v3}, nil, tc.faults)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go agent.ServePacket(conn)
+			defer conn.Close()
+
+			module := NewNamedModule("system", &config.Module{
+				Get:  []string{"1.3.6.1.2.1.1.1.0", "1.3.6.1.2.1.1.3.0"},
+				Walk: []string{"1.3.6.1.2.1.2.2.1.2"},
+				Metrics: []*config.Metric{
+					{Name: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", Type: "DisplayString", Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}}},
+				},
+				WalkParams: config.WalkParams{
+					Retries:                &retries,
+					Timeout:                100 * time.Millisecond,
+					MaxRepetitions:         2,
+					AllowNonIncreasingOIDs: tc.allowNonIncreasing,
+				},
+				Required: true,
+			})
+			c := New(context.Background(), conn.LocalAddr().String(), "test", "", "", tc.auth, []*NamedModule{module}, promslog.NewNopLogger(), metrics, 1, false)
+
+			ch := make(chan prometheus.Metric, 100)
+			c.Collect(ch)
+			close(ch)
+
+			var (
+				reason  string
+				ifDescr int
+			)
+			for m := range ch {
+				var pb io_prometheus_client.Metric
+				if err := m.Write(&pb); err != nil {
+					t.Fatal(err)
+				}
+				desc := m.Desc().String()
+				switch {
+				case strings.Contains(desc, `"ifDescr"`):
+					ifDescr++
+				case strings.Contains(desc, `"snmp_scrape_error_info"`):
+					for _, l := range pb.GetLabel() {
+						if l.GetName() == "reason" {
+							reason = l.GetValue()
+						}
+					}
+				}
+			}
+			if reason != tc.wantReason {
+				t.Errorf("expected reason %q, got %q", tc.wantReason, reason)
+			}
+			if tc.wantReason == "" && ifDescr != 2 {
+				t.Errorf("expected 2 ifDescr samples, got %d", ifDescr)
+			}
+		})
+	}
+}
+
+func TestCollectWorkerConnectFails(t *testing.T) {
+	metrics := Metrics{
+		SNMPCollectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "d"}, []string{"module"}),
+		SNMPUnexpectedPduType:  prometheus.NewCounter(prometheus.CounterOpts{Name: "u"}),
+		SNMPDuration:           prometheus.NewHistogram(prometheus.HistogramOpts{Name: "p"}),
+		SNMPPackets:            prometheus.NewCounter(prometheus.CounterOpts{Name: "s"}),
+		SNMPRetries:            prometheus.NewCounter(prometheus.CounterOpts{Name: "r"}),
+		SNMPInflight:           prometheus.NewGauge(prometheus.GaugeOpts{Name: "i"}),
+	}
+	pdus, err := scraper.ReadSnmprec(strings.NewReader("1.3.6.1.2.1.1.3.0|67|12345\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent, err := simulator.NewAgent(promslog.NewNopLogger(), pdus, []*config.Auth{{Community: "public", Version: 2}}, nil, simulator.Faults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go agent.ServePacket(conn)
+	defer conn.Close()
+
+	// The community of the first worker to connect can't be fetched.
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "public")
+	}))
+	defer server.Close()
+	configPath := filepath.Join(t.TempDir(), "snmp.yml")
+	content := `
+secret_providers:
+  broker:
+    http:
+      url: ` + server.URL + `
+    ttl: 0s
+auths:
+  public_v2:
+    community: {provider: broker, key: public}
+`
+	if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadFile(promslog.NewNopLogger(), []string{configPath}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retries := 0
+	var modules []*NamedModule
+	for _, name := range []string{"a", "b", "c"} {
+		modules = append(modules, NewNamedModule(name, &config.Module{
+			Get:        []string{"1.3.6.1.2.1.1.3.0"},
+			Metrics:    []*config.Metric{{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge"}},
+			WalkParams: config.WalkParams{Retries: &retries, Timeout: time.Second},
+		}))
+	}
+	c := New(context.Background(), conn.LocalAddr().String(), "public_v2", "", "", cfg.Auths["public_v2"], modules, promslog.NewNopLogger(), metrics, 2, false)
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+
+	// The worker that connected scrapes all the modules.
+	succeeded := 0
+	for m := range ch {
+		if !strings.Contains(m.Desc().String(), `"snmp_scrape_module_success"`) {
+			continue
+		}
+		var pb io_prometheus_client.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		if pb.GetGauge().GetValue() != 1 {
+			t.Errorf("expected module to succeed: %s", m.Desc())
+		}
+		succeeded++
+	}
+	if succeeded != len(modules) {
+		t.Fatalf("expected %d modules to succeed, got %d", len(modules), succeeded)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Fatalf("expected 2 secret requests, got %d", got)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"log/slog"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gosnmp/gosnmp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// PDUMatch is what a module made of a PDU.
+type PDUMatch struct {
+	Module string `json:"module"`
+	// The metric the PDU is a sample of, if any.
+	Metric  string `json:"metric,omitempty"`
+	Samples int    `json:"samples"`
+	// Why the PDU produced no samples.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// ExplainedPDU is a PDU of a scrape, along with what each of the modules
+// that asked for it made of it.
+type ExplainedPDU struct {
+	OID     string     `json:"oid"`
+	Type    string     `json:"type"`
+	Value   string     `json:"value"`
+	Modules []PDUMatch `json:"modules"`
+}
+
+// ExplainPDUs tells for each PDU of a scrape which metric of each module it
+// matched, or why it was skipped.
+func ExplainPDUs(pdus []gosnmp.SnmpPDU, modules []*NamedModule, logger *slog.Logger, metrics Metrics) []ExplainedPDU {
+	oidToPdu := make(map[string]gosnmp.SnmpPDU, len(pdus))
+	for _, pdu := range pdus {
+		oidToPdu[strings.TrimPrefix(pdu.Name, ".")] = pdu
+	}
+	explained := make([]ExplainedPDU, 0, len(pdus))
+	for _, pdu := range pdus {
+		oid := strings.TrimPrefix(pdu.Name, ".")
+		e := ExplainedPDU{
+			OID:     oid,
+			Type:    pdu.Type.String(),
+			Value:   explainValue(&pdu, metrics),
+			Modules: []PDUMatch{},
+		}
+		for _, m := range modules {
+			if m.requested(oid) {
+				e.Modules = append(e.Modules, m.explain(pdu, oidToPdu, logger, metrics))
+			}
+		}
+		explained = append(explained, e)
+	}
+	return explained
+}
+
+// requested reports whether the module gets or walks an OID.
+func (m *NamedModule) requested(oid string) bool {
+	for _, get := range m.Get {
+		if strings.TrimPrefix(get, ".") == oid {
+			return true
+		}
+	}
+	for _, walk := range m.Walk {
+		if inSubtree(oid, strings.TrimPrefix(walk, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *NamedModule) explain(pdu gosnmp.SnmpPDU, oidToPdu map[string]gosnmp.SnmpPDU, logger *slog.Logger, metrics Metrics) PDUMatch {
+	match := PDUMatch{Module: m.name}
+	switch pdu.Type {
+	case gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView:
+		match.Skipped = "not supported by the target"
+		return match
+	}
+	oidList := oidToList(strings.TrimPrefix(pdu.Name, "."))
+	metric, indexOids := findMetric(m.metricTree, oidList)
+	if metric == nil {
+		if m.lookupTree.find(oidList) != "" {
+			match.Skipped = "only used by lookups"
+		} else {
+			match.Skipped = "no metric for the OID"
+		}
+		return match
+	}
+	match.Metric = metric.Name
+	for _, sample := range pduToSamples(indexOids, &pdu, metric, oidToPdu, logger, metrics) {
+		if err := sample.Write(&dto.Metric{}); err != nil {
+			match.Skipped = err.Error()
+			continue
+		}
+		match.Samples++
+	}
+	if match.Samples == 0 && match.Skipped == "" {
+		match.Skipped = "the value produced no samples, see the debug log"
+	}
+	return match
+}
+
+// explainValue formats the value of a PDU, as text if it is printable.
+func explainValue(pdu *gosnmp.SnmpPDU, metrics Metrics) string {
+	if b, ok := pdu.Value.([]byte); ok && utf8.Valid(b) && !strings.ContainsFunc(string(b), unicode.IsControl) {
+		return string(b)
+	}
+	return pduValueAsString(pdu, "", "", metrics)
+}
@@ -0,0 +1,73 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+func TestExplainPDUs(t *testing.T) {
+	ifIndex := []*config.Index{{Labelname: "ifIndex", Type: "gauge"}}
+	ifMIB := NewNamedModule("if_mib", &config.Module{
+		Walk: []string{"1.3.6.1.2.1.2.2.1"},
+		Metrics: []*config.Metric{
+			{
+				Name: "ifInOctets", Oid: "1.3.6.1.2.1.2.2.1.10", Type: "counter", Indexes: ifIndex,
+				Lookups: []*config.Lookup{{Labels: []string{"ifIndex"}, Labelname: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", Type: "DisplayString"}},
+			},
+		},
+	})
+	system := NewNamedModule("system", &config.Module{
+		Get: []string{"1.3.6.1.2.1.1.1.0", "1.3.6.1.2.1.1.3.0", "1.3.6.1.2.1.1.5.0"},
+		Metrics: []*config.Metric{
+			{
+				Name: "sysDescr", Oid: "1.3.6.1.2.1.1.1", Type: "DisplayString",
+				RegexpExtracts: map[string][]config.RegexpExtract{"Version": {{Regex: config.Regexp{Regexp: regexp.MustCompile(`(\d+\.\d+)`)}, Value: "$1"}}},
+			},
+			{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge"},
+		},
+	})
+	pdus := []gosnmp.SnmpPDU{
+		{Name: ".1.3.6.1.2.1.1.1.0", Type: gosnmp.OctetString, Value: []byte("Test device")},
+		{Name: ".1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: uint32(12345)},
+		{Name: ".1.3.6.1.2.1.1.5.0", Type: gosnmp.NoSuchInstance},
+		{Name: ".1.3.6.1.2.1.2.2.1.2.1", Type: gosnmp.OctetString, Value: []byte("eth0")},
+		{Name: ".1.3.6.1.2.1.2.2.1.3.1", Type: gosnmp.Integer, Value: 6},
+		{Name: ".1.3.6.1.2.1.2.2.1.6.1", Type: gosnmp.OctetString, Value: []byte{0x00, 0x1b, 0x21}},
+		{Name: ".1.3.6.1.2.1.2.2.1.10.1", Type: gosnmp.Counter32, Value: uint(100)},
+	}
+	metrics := Metrics{SNMPUnexpectedPduType: prometheus.NewCounter(prometheus.CounterOpts{Name: "u"})}
+
+	got := ExplainPDUs(pdus, []*NamedModule{ifMIB, system}, promslog.NewNopLogger(), metrics)
+	want := []ExplainedPDU{
+		{OID: "1.3.6.1.2.1.1.1.0", Type: "OctetString", Value: "Test device", Modules: []PDUMatch{{Module: "system", Metric: "sysDescr", Skipped: "the value produced no samples, see the debug log"}}},
+		{OID: "1.3.6.1.2.1.1.3.0", Type: "TimeTicks", Value: "12345", Modules: []PDUMatch{{Module: "system", Metric: "sysUpTime", Samples: 1}}},
+		{OID: "1.3.6.1.2.1.1.5.0", Type: "NoSuchInstance", Modules: []PDUMatch{{Module: "system", Skipped: "not supported by the target"}}},
+		{OID: "1.3.6.1.2.1.2.2.1.2.1", Type: "OctetString", Value: "eth0", Modules: []PDUMatch{{Module: "if_mib", Skipped: "only used by lookups"}}},
+		{OID: "1.3.6.1.2.1.2.2.1.3.1", Type: "Integer", Value: "6", Modules: []PDUMatch{{Module: "if_mib", Skipped: "no metric for the OID"}}},
+		{OID: "1.3.6.1.2.1.2.2.1.6.1", Type: "OctetString", Value: "0x001B21", Modules: []PDUMatch{{Module: "if_mib", Skipped: "no metric for the OID"}}},
+		{OID: "1.3.6.1.2.1.2.2.1.10.1", Type: "Counter32", Value: "100", Modules: []PDUMatch{{Module: "if_mib", Metric: "ifInOctets", Samples: 1}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected\n%+v\ngot\n%+v", want, got)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// DecodeVarbinds renders the variables of a trap or inform the way a scrape
+// would render them as labels, using the metrics of the given modules. The
+// result maps the names of the metrics and of their indexes to their values,
+// with enums resolved to their names. Variables that no metric covers are
+// left out.
+func DecodeVarbinds(vars []gosnmp.SnmpPDU, modules []*NamedModule, metrics Metrics) map[string]string {
+	oidToPdu := make(map[string]gosnmp.SnmpPDU, len(vars))
+	for _, pdu := range vars {
+		oidToPdu[strings.TrimPrefix(pdu.Name, ".")] = pdu
+	}
+	labels := map[string]string{}
+	for _, pdu := range vars {
+		oidList := oidToList(strings.TrimPrefix(pdu.Name, "."))
+		for _, m := range modules {
+			metric, indexOids := findMetric(m.metricTree, oidList)
+			if metric == nil {
+				continue
+			}
+			for k, v := range indexesToLabels(indexOids, metric, oidToPdu, metrics) {
+				labels[k] = v
+			}
+			labels[metric.Name] = varbindValue(&pdu, metric, indexOids, oidToPdu, metrics)
+			break
+		}
+	}
+	return labels
+}
+
+func varbindValue(pdu *gosnmp.SnmpPDU, metric *preparedMetric, indexOids []int, oidToPdu map[string]gosnmp.SnmpPDU, metrics Metrics) string {
+	switch metric.Type {
+	case "Bits":
+		b, ok := pdu.Value.([]byte)
+		if !ok {
+			return pduValueAsString(pdu, "", "", metrics)
+		}
+		var set []string
+		for k := range len(b) * 8 {
+			if b[k/8]&(128>>(k%8)) != 0 {
+				if name, ok := metric.EnumValues[k]; ok {
+					set = append(set, name)
+				} else {
+					set = append(set, strconv.Itoa(k))
+				}
+			}
+		}
+		return strings.Join(set, ",")
+	case "counter", "gauge", "EnumAsInfo", "EnumAsStateSet":
+		if len(metric.EnumValues) > 0 {
+			value := int(getPduValue(pdu))
+			if name, ok := metric.EnumValues[value]; ok {
+				return name
+			}
+			return strconv.Itoa(value)
+		}
+		return pduValueAsString(pdu, "", "", metrics)
+	}
+	metricType := metric.Type
+	if typeMapping, ok := combinedTypeMapping[metricType]; ok {
+		metricType = "OctetString"
+		prevOid := metric.typeOid + "." + listToOid(indexOids)
+		if prevPdu, ok := oidToPdu[prevOid]; ok {
+			if t, ok := typeMapping[int(getPduValue(&prevPdu))]; ok {
+				metricType = t
+			}
+		}
+	}
+	return pduValueAsString(pdu, metricType, metric.DisplayHint, metrics)
+}
@@ -0,0 +1,60 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+func TestDecodeVarbinds(t *testing.T) {
+	module := NewNamedModule("if_mib", &config.Module{
+		Metrics: []*config.Metric{
+			{
+				Name:    "ifOperStatus",
+				Oid:     "1.3.6.1.2.1.2.2.1.8",
+				Type:    "gauge",
+				Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}},
+				EnumValues: map[int]string{
+					1: "up",
+					2: "down",
+				},
+			},
+			{
+				Name:    "ifDescr",
+				Oid:     "1.3.6.1.2.1.2.2.1.2",
+				Type:    "DisplayString",
+				Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}},
+			},
+		},
+	})
+	vars := []gosnmp.SnmpPDU{
+		{Name: ".1.3.6.1.6.3.1.1.4.1.0", Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.6.3.1.1.5.3"},
+		{Name: ".1.3.6.1.2.1.2.2.1.8.3", Type: gosnmp.Integer, Value: 2},
+		{Name: ".1.3.6.1.2.1.2.2.1.2.3", Type: gosnmp.OctetString, Value: []byte("eth0")},
+	}
+	got := DecodeVarbinds(vars, []*NamedModule{module}, Metrics{})
+	want := map[string]string{
+		"ifIndex":      "3",
+		"ifOperStatus": "down",
+		"ifDescr":      "eth0",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+// PollKey identifies how a target is scraped. Requests that resolve to the
+// same settings are served from the results of the background polls.
+type PollKey struct {
+	Target       string
+	AuthName     string
+	SNMPContext  string
+	SNMPEngineID string
+}
+
+// PollTarget is a target that is scraped in the background.
+type PollTarget struct {
+	Key  PollKey
+	Auth *config.Auth
+	// Set if the auth has a chain.
+	AuthChain *AuthChain
+	Modules   []*NamedModule
+	Interval  time.Duration
+}
+
+type pollKey struct {
+	PollKey
+	module string
+}
+
+type pollResult struct {
+	module  string
+	metrics []prometheus.Metric
+	time    time.Time
+}
+
+// Poller scrapes targets on its own schedule, and keeps the samples of the
+// last scrape of each target and module.
+type Poller struct {
+	logger      *slog.Logger
+	metrics     Metrics
+	concurrency int
+	engines     *EngineCache
+	sessions    *SessionPool
+
+	// updateMu serializes updates, so that the polls of two target sets
+	// never run at once.
+	updateMu sync.Mutex
+	mu       sync.RWMutex
+	results  map[pollKey]pollResult
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func NewPoller(logger *slog.Logger, metrics Metrics, conc int) *Poller {
+	return &Poller{
+		logger:      logger,
+		metrics:     metrics,
+		concurrency: conc,
+		results:     map[pollKey]pollResult{},
+	}
+}
+
+// UseEngineCache makes the polls reuse the SNMPv3 engines of targets and the
+// keys localized to them. It must be called before Update.
+func (p *Poller) UseEngineCache(cache *EngineCache) {
+	p.engines = cache
+}
+
+// UseSessionPool makes the polls borrow their sessions from a pool. It must
+// be called before Update.
+func (p *Poller) UseSessionPool(pool *SessionPool) {
+	p.sessions = pool
+}
+
+// Update replaces the polled targets, typically after a configuration reload.
+// Results of target and module pairs that are still polled are kept.
+func (p *Poller) Update(targets []PollTarget) {
+	p.updateMu.Lock()
+	defer p.updateMu.Unlock()
+	p.stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	keep := map[pollKey]bool{}
+	for _, t := range targets {
+		for _, m := range t.Modules {
+			keep[pollKey{t.Key, m.name}] = true
+			p.wg.Add(1)
+			go p.run(ctx, t, m)
+		}
+	}
+	p.mu.Lock()
+	p.cancel = cancel
+	for k := range p.results {
+		if !keep[k] {
+			delete(p.results, k)
+		}
+	}
+	p.mu.Unlock()
+}
+
+// Stop stops all polling and waits for running polls to finish.
+func (p *Poller) Stop() {
+	p.updateMu.Lock()
+	defer p.updateMu.Unlock()
+	p.stop()
+}
+
+func (p *Poller) stop() {
+	p.mu.Lock()
+	cancel := p.cancel
+	p.cancel = nil
+	p.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	p.wg.Wait()
+}
+
+func (p *Poller) run(ctx context.Context, t PollTarget, m *NamedModule) {
+	defer p.wg.Done()
+	// Spread the polls over the interval, rather than starting them all at once.
+	timer := time.NewTimer(rand.N(t.Interval))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		p.poll(ctx, t, m)
+		timer.Reset(t.Interval)
+	}
+}
+
+func (p *Poller) poll(ctx context.Context, t PollTarget, m *NamedModule) {
+	// A walk may take up to the whole interval.
+	pollCtx, cancel := context.WithTimeout(ctx, t.Interval)
+	defer cancel()
+	logger := p.logger.With("auth", t.Key.AuthName, "target", t.Key.Target, "poll", true)
+	c := New(pollCtx, t.Key.Target, t.Key.AuthName, t.Key.SNMPContext, t.Key.SNMPEngineID, t.Auth, []*NamedModule{m}, logger, p.metrics, p.concurrency, false)
+	if t.AuthChain != nil {
+		c.UseAuthChain(t.AuthChain)
+	}
+	c.UseEngineCache(p.engines)
+	c.UseSessionPool(p.sessions)
+
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	var metrics []prometheus.Metric
+	go func() {
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		close(done)
+	}()
+	c.Collect(ch)
+	close(ch)
+	<-done
+
+	// Don't keep results of polls aborted by an update.
+	if ctx.Err() != nil {
+		return
+	}
+	p.mu.Lock()
+	p.results[pollKey{t.Key, m.name}] = pollResult{module: m.name, metrics: metrics, time: time.Now()}
+	p.mu.Unlock()
+}
+
+// Collector returns a collector serving the cached samples of the given
+// modules, along with the modules that have no cached samples yet. The
+// collector is nil if no module has cached samples.
+func (p *Poller) Collector(key PollKey, modules []*NamedModule) (prometheus.Collector, []*NamedModule) {
+	var (
+		results  []pollResult
+		uncached []*NamedModule
+	)
+	p.mu.RLock()
+	for _, m := range modules {
+		if r, ok := p.results[pollKey{key, m.name}]; ok {
+			results = append(results, r)
+		} else {
+			uncached = append(uncached, m)
+		}
+	}
+	p.mu.RUnlock()
+	if len(results) == 0 {
+		return nil, uncached
+	}
+	return cachedCollector{results: results}, uncached
+}
+
+// cachedCollector serves the samples of earlier polls.
+type cachedCollector struct {
+	results []pollResult
+}
+
+// Describe implements Prometheus.Collector.
+func (c cachedCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- prometheus.NewDesc("dummy", "dummy", nil, nil)
+}
+
+// Collect implements Prometheus.Collector.
+func (c cachedCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, r := range c.results {
+		for _, m := range r.metrics {
+			ch <- m
+		}
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc("snmp_scrape_cache_age_seconds", "Time since the cached samples were polled from the target.", nil, prometheus.Labels{"module": r.module}),
+			prometheus.GaugeValue,
+			time.Since(r.time).Seconds())
+	}
+}
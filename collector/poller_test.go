@@ -0,0 +1,91 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+func TestPollerCollector(t *testing.T) {
+	p := NewPoller(promslog.NewNopLogger(), Metrics{}, 1)
+	key := PollKey{Target: "192.0.2.1", AuthName: "public_v2"}
+	ifMib := NewNamedModule("if_mib", &config.Module{})
+	system := NewNamedModule("system", &config.Module{})
+
+	c, uncached := p.Collector(key, []*NamedModule{ifMib, system})
+	if c != nil {
+		t.Fatal("expected no collector before the first poll")
+	}
+	if len(uncached) != 2 {
+		t.Fatalf("expected 2 uncached modules, got %d", len(uncached))
+	}
+
+	sample := prometheus.MustNewConstMetric(prometheus.NewDesc("sysUpTime", "", nil, nil), prometheus.GaugeValue, 42)
+	p.results[pollKey{key, "system"}] = pollResult{module: "system", metrics: []prometheus.Metric{sample}, time: time.Now()}
+
+	c, uncached = p.Collector(key, []*NamedModule{ifMib, system})
+	if c == nil {
+		t.Fatal("expected a collector for the cached module")
+	}
+	if len(uncached) != 1 || uncached[0].name != "if_mib" {
+		t.Fatalf("expected only if_mib to be uncached, got %v", uncached)
+	}
+	ch := make(chan prometheus.Metric, 10)
+	c.Collect(ch)
+	close(ch)
+	var names []string
+	for m := range ch {
+		names = append(names, m.Desc().String())
+	}
+	if len(names) != 2 || !strings.Contains(names[0], `"sysUpTime"`) || !strings.Contains(names[1], `"snmp_scrape_cache_age_seconds"`) {
+		t.Fatalf("expected the cached sample and its age, got %v", names)
+	}
+
+	// Other settings for the same target must not hit the cache.
+	other := key
+	other.AuthName = "private_v2"
+	if c, _ := p.Collector(other, []*NamedModule{system}); c != nil {
+		t.Fatal("expected no cached samples for a different auth")
+	}
+
+	// Results of pairs that are no longer polled are dropped on update.
+	p.Update(nil)
+	if c, _ := p.Collector(key, []*NamedModule{system}); c != nil {
+		t.Fatal("expected cached samples to be dropped")
+	}
+}
+
+func TestPollerConcurrentUpdates(t *testing.T) {
+	p := NewPoller(promslog.NewNopLogger(), Metrics{}, 1)
+	system := NewNamedModule("system", &config.Module{})
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Update([]PollTarget{{Key: PollKey{Target: strconv.Itoa(i)}, Modules: []*NamedModule{system}, Interval: time.Hour}})
+		}()
+	}
+	wg.Wait()
+	p.Stop()
+}
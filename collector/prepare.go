@@ -0,0 +1,138 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+// preparedMetric is a metric with how its indexes are decoded and where its
+// lookups are found resolved once per configuration load, rather than for
+// every PDU.
+type preparedMetric struct {
+	*config.Metric
+	// The column with the type of a combined type, such as InetAddressType.
+	typeOid string
+	indexes []indexDecoder
+	lookups []preparedLookup
+	// The columns the metric reads from other PDUs.
+	lookupColumns []string
+}
+
+type preparedLookup struct {
+	*config.Lookup
+	// The column with the type of a combined type.
+	typeOid string
+}
+
+func newPreparedMetric(metric *config.Metric) *preparedMetric {
+	p := &preparedMetric{Metric: metric, lookupColumns: lookupColumns(metric)}
+	if _, ok := combinedTypeMapping[metric.Type]; ok {
+		p.typeOid = getPrevOid(metric.Oid)
+	}
+	for _, index := range metric.Indexes {
+		p.indexes = append(p.indexes, newIndexDecoder(index.Type, index.FixedSize, index.Implied, index.EnumValues))
+	}
+	for _, lookup := range metric.Lookups {
+		l := preparedLookup{Lookup: lookup}
+		if _, ok := combinedTypeMapping[lookup.Type]; ok {
+			l.typeOid = getPrevOid(lookup.Oid)
+		}
+		p.lookups = append(p.lookups, l)
+	}
+	return p
+}
+
+// lookupOid returns the OID of a column for the values of the labels.
+func lookupOid(column string, labels []string, labelOids map[string][]int) string {
+	var b strings.Builder
+	b.WriteString(column)
+	for _, label := range labels {
+		b.WriteByte('.')
+		b.WriteString(listToOid(labelOids[label]))
+	}
+	return b.String()
+}
+
+// indexDecoder converts the OIDs of an index to its string value. It returns
+// the string, the OIDs that were used and the OIDs left over.
+type indexDecoder func(indexOids []int) (string, []int, []int)
+
+// newIndexDecoder resolves how an index of the type is decoded. Unknown types
+// panic when decoded.
+func newIndexDecoder(typ string, fixedSize int, implied bool, enumValues map[int]string) indexDecoder {
+	if typeMapping, ok := combinedTypeMapping[typ]; ok {
+		// The decoders of the types the first OID selects.
+		decoders := make(map[int]indexDecoder, len(typeMapping))
+		for value, t := range typeMapping {
+			decoders[value] = newIndexDecoder(t, 0, false, enumValues)
+		}
+		if typ == "InetAddressMissingSize" {
+			return func(indexOids []int) (string, []int, []int) {
+				// The size of the main index value is missing.
+				subOid, valueOids := splitOid(indexOids, 1)
+				if decode, ok := decoders[subOid[0]]; ok {
+					str, used, remaining := decode(valueOids)
+					return str, append(subOid, used...), remaining
+				}
+				// We don't know the size, so pass everything remaining.
+				return decodeOctetString(indexOids, 0, true)
+			}
+		}
+		return func(indexOids []int) (string, []int, []int) {
+			subOid, valueOids := splitOid(indexOids, 2)
+			if decode, ok := decoders[subOid[0]]; ok {
+				str, used, remaining := decode(valueOids)
+				return str, append(subOid, used...), remaining
+			}
+			// The 2nd oid is the length.
+			return decodeOctetString(indexOids, subOid[1]+2, false)
+		}
+	}
+
+	switch typ {
+	case "Integer32", "Integer", "gauge", "counter":
+		return decodeInteger
+	case "PhysAddress48":
+		return decodePhysAddress48
+	case "OctetString":
+		return func(indexOids []int) (string, []int, []int) {
+			return decodeOctetString(indexOids, fixedSize, implied)
+		}
+	case "DisplayString":
+		return func(indexOids []int) (string, []int, []int) {
+			return decodeDisplayString(indexOids, fixedSize, implied)
+		}
+	case "InetAddressIPv4":
+		return decodeIPv4
+	case "InetAddressIPv6":
+		return decodeIPv6
+	case "EnumAsInfo":
+		return func(indexOids []int) (string, []int, []int) {
+			subOid, indexOids := splitOid(indexOids, 1)
+			if value, ok := enumValues[subOid[0]]; ok {
+				return value, subOid, indexOids
+			}
+			return strconv.Itoa(subOid[0]), subOid, indexOids
+		}
+	default:
+		return func([]int) (string, []int, []int) {
+			panic(fmt.Sprintf("Unknown index type %s", typ))
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+const (
+	sysDescrOID    = "1.3.6.1.2.1.1.1.0"
+	sysObjectIDOID = "1.3.6.1.2.1.1.2.0"
+)
+
+// ModuleSelector picks the modules of targets scraped without any, going by
+// the module selection rules. The modules picked for a target are cached.
+type ModuleSelector struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	rules    []selectionRule
+	selected map[selectionKey]selection
+}
+
+type selectionRule struct {
+	rule    *config.ModuleSelectionRule
+	modules []*NamedModule
+}
+
+type selectionKey struct {
+	target, authName, snmpContext string
+}
+
+type selection struct {
+	// The rule that picked the modules.
+	rule    int
+	modules []*NamedModule
+	expires time.Time
+}
+
+// errNoMatchingRule is returned when no rule matches a target.
+var errNoMatchingRule = errors.New("no module selection rule matches")
+
+// NewModuleSelector returns a selector for the rules of a configuration, whose
+// modules are looked up in modules. It returns nil if there are no rules.
+func NewModuleSelector(c *config.ModuleSelection, modules map[string]*NamedModule) *ModuleSelector {
+	if c == nil {
+		return nil
+	}
+	s := &ModuleSelector{selected: map[selectionKey]selection{}}
+	s.ttl, s.rules = c.CacheTTL, selectionRules(c, modules)
+	return s
+}
+
+func selectionRules(c *config.ModuleSelection, modules map[string]*NamedModule) []selectionRule {
+	var rules []selectionRule
+	for _, r := range c.Rules {
+		sr := selectionRule{rule: r}
+		for _, name := range r.Modules {
+			if m, ok := modules[name]; ok {
+				sr.modules = append(sr.modules, m)
+			}
+		}
+		rules = append(rules, sr)
+	}
+	return rules
+}
+
+// Update replaces the rules and modules of the selector with those of a
+// reloaded configuration. The modules picked for targets are kept if the
+// rules didn't change, and looked up again in modules.
+func (s *ModuleSelector) Update(c *config.ModuleSelection, modules map[string]*NamedModule) {
+	rules := selectionRules(c, modules)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	same := len(rules) == len(s.rules)
+	for i := 0; same && i < len(rules); i++ {
+		same = sameRule(rules[i].rule, s.rules[i].rule)
+	}
+	s.ttl, s.rules = c.CacheTTL, rules
+	if !same {
+		clear(s.selected)
+		return
+	}
+	for key, sel := range s.selected {
+		sel.modules = rules[sel.rule].modules
+		s.selected[key] = sel
+	}
+}
+
+func sameRule(a, b *config.ModuleSelectionRule) bool {
+	if a.SysObjectID != b.SysObjectID || !slices.Equal(a.Modules, b.Modules) || (a.SysDescr == nil) != (b.SysDescr == nil) {
+		return false
+	}
+	return a.SysDescr == nil || a.SysDescr.String() == b.SysDescr.String()
+}
+
+// Selected returns the modules last picked for a target, if they haven't
+// expired.
+func (s *ModuleSelector) Selected(target, authName, snmpContext string) ([]*NamedModule, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sel, ok := s.selected[selectionKey{target, authName, snmpContext}]
+	if !ok || time.Now().After(sel.expires) {
+		return nil, false
+	}
+	return sel.modules, true
+}
+
+// selectFor picks the modules of the first rule that matches a sysObjectID
+// and sysDescr, and remembers them for the target.
+func (s *ModuleSelector) selectFor(key selectionKey, sysObjectID, sysDescr string) ([]*NamedModule, bool) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rule, ok := s.match(sysObjectID, sysDescr)
+	if !ok {
+		return nil, false
+	}
+	for k, sel := range s.selected {
+		if now.After(sel.expires) {
+			delete(s.selected, k)
+		}
+	}
+	modules := s.rules[rule].modules
+	s.selected[key] = selection{rule: rule, modules: modules, expires: now.Add(s.ttl)}
+	return modules, true
+}
+
+// match returns the first rule that matches a sysObjectID and sysDescr.
+func (s *ModuleSelector) match(sysObjectID, sysDescr string) (int, bool) {
+	sysObjectID = strings.TrimPrefix(sysObjectID, ".")
+	for i, r := range s.rules {
+		if r.rule.SysObjectID != "" && !inSubtree(sysObjectID, strings.TrimPrefix(r.rule.SysObjectID, ".")) {
+			continue
+		}
+		if r.rule.SysDescr != nil && !r.rule.SysDescr.MatchString(sysDescr) {
+			continue
+		}
+		return i, true
+	}
+	return 0, false
+}
+
+// SelectModules makes the collector pick the modules of its target with s,
+// rather than scraping the modules it was created with.
+func (c *Collector) SelectModules(s *ModuleSelector) {
+	c.selector = s
+}
+
+// selectModules returns the modules picked for the target, getting its
+// sysObjectID and sysDescr unless they were picked recently.
+func (c Collector) selectModules(ctx context.Context) ([]*NamedModule, error) {
+	key := selectionKey{c.target, c.authName, c.snmpContext}
+	if modules, ok := c.selector.Selected(key.target, key.authName, key.snmpContext); ok {
+		return modules, nil
+	}
+	logger := c.logger.With("selecting_modules", true)
+	client, err := c.connect(ctx, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		g.Retries = *config.DefaultWalkParams.Retries
+		g.Timeout = config.DefaultWalkParams.Timeout
+		if deadline, ok := c.ctx.Deadline(); ok {
+			g.Timeout, g.Retries = fitDeadline(g.Timeout, g.Retries, time.Until(deadline))
+		}
+	})
+	packet, err := c.gate.scraper(client).Get([]string{sysObjectIDOID, sysDescrOID})
+	if err != nil {
+		return nil, err
+	}
+	if packet.Error != gosnmp.NoError {
+		return nil, agentError{target: c.target, status: packet.Error}
+	}
+	var sysObjectID, sysDescr string
+	for _, v := range packet.Variables {
+		switch strings.TrimPrefix(v.Name, ".") {
+		case sysObjectIDOID:
+			if oid, ok := v.Value.(string); ok && v.Type == gosnmp.ObjectIdentifier {
+				sysObjectID = oid
+			}
+		case sysDescrOID:
+			switch value := v.Value.(type) {
+			case []byte:
+				sysDescr = string(value)
+			case string:
+				sysDescr = value
+			}
+		}
+	}
+	modules, ok := c.selector.selectFor(key, sysObjectID, sysDescr)
+	if !ok {
+		return nil, fmt.Errorf("%w sysObjectID %q and sysDescr %q", errNoMatchingRule, sysObjectID, sysDescr)
+	}
+	names := make([]string, 0, len(modules))
+	for _, m := range modules {
+		names = append(names, m.name)
+	}
+	logger.Debug("Selected modules", "sys_object_id", sysObjectID, "modules", names)
+	return modules, nil
+}
+
+// selectionMetrics reports whether the modules of the target could be picked,
+// and why not.
+func selectionMetrics(ch chan<- prometheus.Metric, err error) {
+	v := 1.0
+	if err != nil {
+		v = 0
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc("snmp_scrape_module_selection_error_info", "The reason the modules of the target couldn't be picked.", []string{"reason"}, nil),
+			prometheus.GaugeValue,
+			1, errorReason(err))
+	}
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc("snmp_scrape_module_selection_success", "Whether the modules of the target could be picked by the module selection rules.", nil, nil),
+		prometheus.GaugeValue,
+		v)
+}
@@ -0,0 +1,229 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+	"github.com/prometheus/snmp_exporter/simulator"
+)
+
+func TestModuleSelectorMatch(t *testing.T) {
+	modules := map[string]*NamedModule{
+		"juniper": NewNamedModule("juniper", &config.Module{}),
+		"cisco":   NewNamedModule("cisco", &config.Module{}),
+		"if_mib":  NewNamedModule("if_mib", &config.Module{}),
+	}
+	selection := &config.ModuleSelection{
+		CacheTTL: time.Hour,
+		Rules: []*config.ModuleSelectionRule{
+			{SysObjectID: ".1.3.6.1.4.1.2636", Modules: []string{"juniper", "if_mib"}},
+			{SysObjectID: "1.3.6.1.4.1.9", SysDescr: &config.Regexp{Regexp: regexp.MustCompile("^(?:Cisco .*)$")}, Modules: []string{"cisco"}},
+		},
+	}
+	s := NewModuleSelector(selection, modules)
+
+	cases := []struct {
+		sysObjectID, sysDescr string
+		want                  []string
+	}{
+		{".1.3.6.1.4.1.2636.1.1.1.2.21", "Juniper Networks", []string{"juniper", "if_mib"}},
+		{".1.3.6.1.4.1.9.1.1208", "Cisco IOS Software", []string{"cisco"}},
+		{".1.3.6.1.4.1.9.1.1208", "Linux", nil},
+		{".1.3.6.1.4.1.26360.1", "Juniper Networks", nil},
+	}
+	for _, tc := range cases {
+		rule, ok := s.match(tc.sysObjectID, tc.sysDescr)
+		if ok != (tc.want != nil) {
+			t.Errorf("%s %q: expected match %t, got %t", tc.sysObjectID, tc.sysDescr, tc.want != nil, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		var names []string
+		for _, m := range s.rules[rule].modules {
+			names = append(names, m.name)
+		}
+		if strings.Join(names, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%s %q: expected modules %v, got %v", tc.sysObjectID, tc.sysDescr, tc.want, names)
+		}
+	}
+}
+
+func TestModuleSelectorUpdate(t *testing.T) {
+	newModules := func() map[string]*NamedModule {
+		return map[string]*NamedModule{
+			"juniper": NewNamedModule("juniper", &config.Module{}),
+			"if_mib":  NewNamedModule("if_mib", &config.Module{}),
+		}
+	}
+	rules := func(modules ...string) *config.ModuleSelection {
+		return &config.ModuleSelection{
+			CacheTTL: time.Hour,
+			Rules:    []*config.ModuleSelectionRule{{SysObjectID: "1.3.6.1.4.1.2636", Modules: modules}},
+		}
+	}
+	s := NewModuleSelector(rules("juniper"), newModules())
+	key := selectionKey{target: "router"}
+	if _, ok := s.selectFor(key, "1.3.6.1.4.1.2636.1", ""); !ok {
+		t.Fatal("expected the rule to match")
+	}
+
+	// The modules picked are kept across a reload that doesn't change the
+	// rules, with the reloaded modules.
+	modules := newModules()
+	s.Update(rules("juniper"), modules)
+	selected, ok := s.Selected(key.target, "", "")
+	if !ok || len(selected) != 1 || selected[0] != modules["juniper"] {
+		t.Fatalf("expected the reloaded juniper module to be kept, got %v", selected)
+	}
+
+	s.Update(rules("juniper", "if_mib"), newModules())
+	if selected, ok := s.Selected(key.target, "", ""); ok {
+		t.Fatalf("expected the modules picked to be forgotten when the rules change, got %v", selected)
+	}
+}
+
+func TestCollectSelectsModules(t *testing.T) {
+	metrics := Metrics{
+		SNMPCollectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "d"}, []string{"module"}),
+		SNMPUnexpectedPduType:  prometheus.NewCounter(prometheus.CounterOpts{Name: "u"}),
+		SNMPDuration:           prometheus.NewHistogram(prometheus.HistogramOpts{Name: "p"}),
+		SNMPPackets:            prometheus.NewCounter(prometheus.CounterOpts{Name: "s"}),
+		SNMPRetries:            prometheus.NewCounter(prometheus.CounterOpts{Name: "r"}),
+		SNMPInflight:           prometheus.NewGauge(prometheus.GaugeOpts{Name: "i"}),
+	}
+	pdus, err := scraper.ReadSnmprec(strings.NewReader(`1.3.6.1.2.1.1.1.0|4|Cisco IOS Software
+1.3.6.1.2.1.1.2.0|6|1.3.6.1.4.1.9.1.1208
+1.3.6.1.2.1.1.3.0|67|12345
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &config.Auth{Community: "public", Version: 2}
+	agent, err := simulator.NewAgent(promslog.NewNopLogger(), pdus, []*config.Auth{auth}, nil, simulator.Faults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go agent.ServePacket(conn)
+	defer conn.Close()
+
+	retries := 0
+	walkParams := config.WalkParams{Retries: &retries, Timeout: 100 * time.Millisecond, MaxRepetitions: 2}
+	modules := map[string]*NamedModule{
+		"cisco": NewNamedModule("cisco", &config.Module{
+			Get:        []string{"1.3.6.1.2.1.1.3.0"},
+			Metrics:    []*config.Metric{{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge"}},
+			WalkParams: walkParams,
+		}),
+		"juniper": NewNamedModule("juniper", &config.Module{WalkParams: walkParams}),
+	}
+
+	cases := []struct {
+		name    string
+		rules   []*config.ModuleSelectionRule
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "matching rule",
+			rules: []*config.ModuleSelectionRule{
+				{SysObjectID: "1.3.6.1.4.1.2636", Modules: []string{"juniper"}},
+				{SysObjectID: "1.3.6.1.4.1.9", Modules: []string{"cisco"}},
+			},
+			want: "cisco",
+		},
+		{
+			name:    "no matching rule",
+			rules:   []*config.ModuleSelectionRule{{SysObjectID: "1.3.6.1.4.1.2636", Modules: []string{"juniper"}}},
+			wantErr: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewModuleSelector(&config.ModuleSelection{CacheTTL: time.Hour, Rules: tc.rules}, modules)
+			c := New(context.Background(), conn.LocalAddr().String(), "public_v2", "", "", auth, nil, promslog.NewNopLogger(), metrics, 1, false)
+			c.SelectModules(s)
+
+			ch := make(chan prometheus.Metric, 100)
+			c.Collect(ch)
+			close(ch)
+
+			var (
+				errs      int
+				succeeded []string
+				upTime    float64
+				selection = -1.0
+				reason    string
+			)
+			for m := range ch {
+				var pb io_prometheus_client.Metric
+				if err := m.Write(&pb); err != nil {
+					errs++
+					continue
+				}
+				desc := m.Desc().String()
+				switch {
+				case strings.Contains(desc, `"snmp_scrape_module_success"`) && pb.GetGauge().GetValue() == 1:
+					for _, l := range pb.GetLabel() {
+						if l.GetName() == "module" {
+							succeeded = append(succeeded, l.GetValue())
+						}
+					}
+				case strings.Contains(desc, `"sysUpTime"`):
+					upTime = pb.GetGauge().GetValue()
+				case strings.Contains(desc, `"snmp_scrape_module_selection_success"`):
+					selection = pb.GetGauge().GetValue()
+				case strings.Contains(desc, `"snmp_scrape_module_selection_error_info"`):
+					reason = pb.GetLabel()[0].GetValue()
+				}
+			}
+			if errs != 0 {
+				t.Fatalf("expected no invalid metrics, got %d", errs)
+			}
+			if tc.wantErr {
+				if selection != 0 || reason != reasonNoMatchingRule || len(succeeded) != 0 {
+					t.Fatalf("expected the selection to fail with no matching rule, got success %v, reason %q and modules %v", selection, reason, succeeded)
+				}
+				if _, ok := s.Selected(conn.LocalAddr().String(), "public_v2", ""); ok {
+					t.Fatal("expected a failed selection not to be cached")
+				}
+				return
+			}
+			if selection != 1 || strings.Join(succeeded, ",") != tc.want || upTime != 12345 {
+				t.Fatalf("expected module %s with sysUpTime 12345, got selection success %v, modules %v and sysUpTime %v", tc.want, selection, succeeded, upTime)
+			}
+			selected, ok := s.Selected(conn.LocalAddr().String(), "public_v2", "")
+			if !ok || len(selected) != 1 || selected[0].name != tc.want {
+				t.Fatalf("expected module %s to be cached, got %v", tc.want, selected)
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// SessionPool keeps the connected sessions of targets between scrapes, so
+// that scrapes of TCP targets skip the handshake, and those of SNMPv3 targets
+// the engine discovery. Scrapes borrow sessions for themselves, so a session
+// is never used by two workers at once. It is shared by all scrapes.
+type SessionPool struct {
+	size        int
+	idleTimeout time.Duration
+	hits        prometheus.Counter
+	misses      prometheus.Counter
+	evictions   *prometheus.CounterVec
+
+	mu sync.Mutex
+	// The idle sessions by key, least recently used first.
+	idle  map[sessionKey][]idleSession
+	count int
+}
+
+// sessionKey is what a session is reused for. The auth is a fingerprint of
+// its resolved settings, so sessions aren't reused once they change, such as
+// after a config reload.
+type sessionKey struct {
+	target       string
+	source       string
+	auth         string
+	snmpContext  string
+	snmpEngineID string
+}
+
+type idleSession struct {
+	client scraper.SNMPScraper
+	since  time.Time
+}
+
+// NewSessionPool returns a pool keeping up to size idle sessions, each for up
+// to the idle timeout, or nil if the size isn't positive.
+func NewSessionPool(size int, idleTimeout time.Duration) *SessionPool {
+	if size <= 0 {
+		return nil
+	}
+	return &SessionPool{
+		size:        size,
+		idleTimeout: idleTimeout,
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "snmp_session_pool_hits_total",
+			Help: "Sessions borrowed from the pool.",
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "snmp_session_pool_misses_total",
+			Help: "Sessions opened as the pool had none for the target.",
+		}),
+		evictions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "snmp_session_pool_evictions_total",
+			Help: "Sessions closed instead of being kept in or borrowed from the pool, by reason.",
+		}, []string{"reason"}),
+		idle: map[sessionKey][]idleSession{},
+	}
+}
+
+var idleSessionsDesc = prometheus.NewDesc("snmp_session_pool_idle_sessions", "Sessions kept in the pool.", nil, nil)
+
+// Describe implements the prometheus.Collector interface.
+func (p *SessionPool) Describe(ch chan<- *prometheus.Desc) {
+	p.hits.Describe(ch)
+	p.misses.Describe(ch)
+	p.evictions.Describe(ch)
+	ch <- idleSessionsDesc
+}
+
+// Collect implements the prometheus.Collector interface.
+func (p *SessionPool) Collect(ch chan<- prometheus.Metric) {
+	p.hits.Collect(ch)
+	p.misses.Collect(ch)
+	p.evictions.Collect(ch)
+	p.mu.Lock()
+	count := p.count
+	p.mu.Unlock()
+	ch <- prometheus.MustNewConstMetric(idleSessionsDesc, prometheus.GaugeValue, float64(count))
+}
+
+// get borrows the most recently used idle session for a key.
+func (p *SessionPool) get(key sessionKey) (scraper.SNMPScraper, bool) {
+	p.mu.Lock()
+	expired := p.sweep()
+	var sessions []idleSession
+	for {
+		idle := p.idle[key]
+		if len(idle) == 0 {
+			break
+		}
+		s := idle[len(idle)-1]
+		p.remove(key, len(idle)-1)
+		if alive(s.client) {
+			p.mu.Unlock()
+			closeSessions(expired)
+			closeSessions(sessions)
+			p.hits.Inc()
+			return s.client, true
+		}
+		p.evictions.WithLabelValues("closed").Inc()
+		sessions = append(sessions, s)
+	}
+	p.mu.Unlock()
+	closeSessions(expired)
+	closeSessions(sessions)
+	p.misses.Inc()
+	return nil, false
+}
+
+// put returns a session to the pool, closing the least recently used one if
+// the pool is full.
+func (p *SessionPool) put(key sessionKey, client scraper.SNMPScraper) {
+	p.mu.Lock()
+	expired := p.sweep()
+	p.idle[key] = append(p.idle[key], idleSession{client: client, since: time.Now()})
+	p.count++
+	if p.count > p.size {
+		var (
+			oldest    sessionKey
+			oldestAge time.Time
+		)
+		for k, idle := range p.idle {
+			if oldestAge.IsZero() || idle[0].since.Before(oldestAge) {
+				oldest, oldestAge = k, idle[0].since
+			}
+		}
+		expired = append(expired, p.idle[oldest][0])
+		p.remove(oldest, 0)
+		p.evictions.WithLabelValues("full").Inc()
+	}
+	p.mu.Unlock()
+	closeSessions(expired)
+}
+
+// sweep takes the sessions idle for longer than the timeout out of the pool,
+// to be closed once the lock is released. It must be called with the lock
+// held.
+func (p *SessionPool) sweep() []idleSession {
+	var expired []idleSession
+	for key, idle := range p.idle {
+		n := 0
+		for n < len(idle) && time.Since(idle[n].since) > p.idleTimeout {
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		expired = append(expired, idle[:n]...)
+		p.evictions.WithLabelValues("idle").Add(float64(n))
+		p.count -= n
+		if n == len(idle) {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = append([]idleSession(nil), idle[n:]...)
+		}
+	}
+	return expired
+}
+
+// remove takes a session out of the pool. It must be called with the lock
+// held.
+func (p *SessionPool) remove(key sessionKey, i int) {
+	idle := append(p.idle[key][:i:i], p.idle[key][i+1:]...)
+	if len(idle) == 0 {
+		delete(p.idle, key)
+	} else {
+		p.idle[key] = idle
+	}
+	p.count--
+}
+
+func closeSessions(sessions []idleSession) {
+	for _, s := range sessions {
+		s.client.Close()
+	}
+}
+
+// alive reports whether a TCP session was neither closed by the target nor
+// sent anything while it was idle, either of which leaves it unusable.
+// Datagram sessions are always usable, as gosnmp skips stale responses.
+func alive(client scraper.SNMPScraper) bool {
+	var conn net.Conn
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		conn = g.Conn
+	})
+	if conn == nil {
+		return false
+	}
+	if _, ok := conn.(net.PacketConn); ok {
+		return true
+	}
+	// A deadline that has already passed fails reads before they check the
+	// connection. gosnmp sets the deadline of each request, so it needn't be
+	// reset.
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	var netErr net.Error
+	_, err := conn.Read(make([]byte, 1))
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// pooledTransport reports whether the sessions of a target can be pooled,
+// which unconnected UDP sockets can't as they aren't tied to the target.
+func pooledTransport(target string, useUnconnectedUDPSocket bool) bool {
+	if strings.HasPrefix(target, "file://") {
+		return false
+	}
+	return strings.HasPrefix(target, "tcp") || !useUnconnectedUDPSocket
+}
+
+// sessionFingerprint identifies the settings of an auth that a session is
+// configured with.
+func sessionFingerprint(auth *config.Auth) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d%q%q", auth.Version, string(auth.Community), auth.ContextName)
+	h.Write([]byte(authFingerprint(auth)))
+	return string(h.Sum(nil))
+}
+
+// pooledScraper returns its session to the pool when closed, unless a request
+// failed. A session whose request timed out could still get the response,
+// which on TCP would be read as the response to the next request.
+type pooledScraper struct {
+	scraper.SNMPScraper
+	pool   *SessionPool
+	key    sessionKey
+	failed bool
+}
+
+func (s *pooledScraper) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	packet, err := s.SNMPScraper.Get(oids)
+	s.failed = s.failed || err != nil
+	return packet, err
+}
+
+func (s *pooledScraper) WalkAll(oid string) ([]gosnmp.SnmpPDU, error) {
+	pdus, err := s.SNMPScraper.WalkAll(oid)
+	s.failed = s.failed || err != nil
+	return pdus, err
+}
+
+func (s *pooledScraper) Walk(oid string, fn func(gosnmp.SnmpPDU) error) error {
+	stopped, err := walkStopped(s.SNMPScraper, oid, fn)
+	s.failed = s.failed || (err != nil && !stopped)
+	return err
+}
+
+// walkStopped walks a subtree, and reports whether the error is the one fn
+// stopped the walk with. Such walks got all the responses they asked for, so
+// they leave the session usable.
+func walkStopped(client scraper.SNMPScraper, oid string, fn func(gosnmp.SnmpPDU) error) (bool, error) {
+	var stop error
+	err := client.Walk(oid, func(pdu gosnmp.SnmpPDU) error {
+		stop = fn(pdu)
+		return stop
+	})
+	return stop != nil && errors.Is(err, stop), err
+}
+
+func (s *pooledScraper) Close() error {
+	if s.failed {
+		s.pool.evictions.WithLabelValues("failed").Inc()
+		return s.SNMPScraper.Close()
+	}
+	s.pool.put(s.key, s.SNMPScraper)
+	return nil
+}
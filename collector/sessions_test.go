@@ -0,0 +1,204 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+	"github.com/prometheus/snmp_exporter/simulator"
+)
+
+// connListener keeps the connections it accepts.
+type connListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, conn)
+		l.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (l *connListener) accepted() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.conns)
+}
+
+func (l *connListener) closeConns() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+}
+
+func TestSessionPool(t *testing.T) {
+	metrics := Metrics{
+		SNMPCollectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "d"}, []string{"module"}),
+		SNMPUnexpectedPduType:  prometheus.NewCounter(prometheus.CounterOpts{Name: "u"}),
+		SNMPDuration:           prometheus.NewHistogram(prometheus.HistogramOpts{Name: "p"}),
+		SNMPPackets:            prometheus.NewCounter(prometheus.CounterOpts{Name: "s"}),
+		SNMPRetries:            prometheus.NewCounter(prometheus.CounterOpts{Name: "r"}),
+		SNMPInflight:           prometheus.NewGauge(prometheus.GaugeOpts{Name: "i"}),
+	}
+	pdus, err := scraper.ReadSnmprec(strings.NewReader("1.3.6.1.2.1.1.3.0|67|12345\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := &config.Auth{Community: "public", Version: 2}
+	private := &config.Auth{Community: "private", Version: 2}
+	agent, err := simulator.NewAgent(promslog.NewNopLogger(), pdus, []*config.Auth{public, private}, nil, simulator.Faults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &connListener{Listener: l}
+	go agent.ServeStream(listener)
+	defer listener.Close()
+	defer listener.closeConns()
+	target := "tcp://" + l.Addr().String()
+
+	retries := 0
+	newModule := func(name string) *NamedModule {
+		return NewNamedModule(name, &config.Module{
+			Get:        []string{"1.3.6.1.2.1.1.3.0"},
+			Metrics:    []*config.Metric{{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge"}},
+			WalkParams: config.WalkParams{Retries: &retries, Timeout: time.Second, MaxRepetitions: 2},
+		})
+	}
+	system := []*NamedModule{newModule("system")}
+	// scrape returns the number of modules sysUpTime was scraped for.
+	scrape := func(pool *SessionPool, auth *config.Auth, modules []*NamedModule) int {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		c := New(ctx, target, "v2", "", "", auth, modules, promslog.NewNopLogger(), metrics, len(modules), false)
+		c.UseSessionPool(pool)
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		found := 0
+		for m := range ch {
+			if strings.Contains(m.Desc().String(), `"sysUpTime"`) {
+				found++
+			}
+		}
+		return found
+	}
+
+	pool := NewSessionPool(1, time.Hour)
+	for i := range 3 {
+		if found := scrape(pool, public, system); found != 1 {
+			t.Fatalf("scrape %d: expected sysUpTime", i)
+		}
+	}
+	if got := listener.accepted(); got != 1 {
+		t.Fatalf("expected the scrapes to share 1 connection, got %d", got)
+	}
+	if hits, misses := metricValue(pool.hits), metricValue(pool.misses); hits != 2 || misses != 1 {
+		t.Fatalf("expected 2 hits and 1 miss, got %v and %v", hits, misses)
+	}
+
+	// Sessions aren't shared between auths, and the pool keeps only one.
+	if found := scrape(pool, private, system); found != 1 {
+		t.Fatal("expected sysUpTime with another auth")
+	}
+	if got := listener.accepted(); got != 2 {
+		t.Fatalf("expected a connection for the other auth, got %d connections", got)
+	}
+	if got := metricValue(pool.evictions.WithLabelValues("full")); got != 1 {
+		t.Fatalf("expected 1 session evicted from the full pool, got %v", got)
+	}
+
+	// Sessions the target closed are replaced.
+	listener.closeConns()
+	if found := scrape(pool, private, system); found != 1 {
+		t.Fatal("expected sysUpTime once the closed session is replaced")
+	}
+	if got := metricValue(pool.evictions.WithLabelValues("closed")); got != 1 {
+		t.Fatalf("expected 1 closed session evicted, got %v", got)
+	}
+
+	// Concurrent workers each borrow a session of their own.
+	if found := scrape(pool, private, []*NamedModule{system[0], newModule("system2")}); found != 2 {
+		t.Fatalf("expected sysUpTime for both modules, got %d", found)
+	}
+	if got := listener.accepted(); got != 4 {
+		t.Fatalf("expected a connection for the second worker, got %d connections", got)
+	}
+	if got := metricValue(pool.evictions.WithLabelValues("full")); got != 2 {
+		t.Fatalf("expected 2 sessions evicted from the full pool, got %v", got)
+	}
+
+	// Idle sessions expire.
+	pool = NewSessionPool(1, time.Nanosecond)
+	for i := range 2 {
+		if found := scrape(pool, public, system); found != 1 {
+			t.Fatalf("scrape %d: expected sysUpTime", i)
+		}
+	}
+	if got := listener.accepted(); got != 6 {
+		t.Fatalf("expected a connection per scrape, got %d connections", got)
+	}
+	if got := metricValue(pool.evictions.WithLabelValues("idle")); got != 1 {
+		t.Fatalf("expected 1 idle session evicted, got %v", got)
+	}
+
+	// SNMPv3 sessions over connected UDP skip the engine discovery.
+	v3 := &config.Auth{
+		Username: "admin", SecurityLevel: "authPriv", Version: 3,
+		AuthProtocol: "SHA", Password: "maplesyrup",
+		PrivProtocol: "AES", PrivPassword: "pancakes",
+	}
+	agent, err = simulator.NewAgent(promslog.NewNopLogger(), pdus, []*config.Auth{v3}, nil, simulator.Faults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go agent.ServePacket(conn)
+	defer conn.Close()
+	target = conn.LocalAddr().String()
+	pool = NewSessionPool(1, time.Hour)
+	for i, want := range []float64{2, 1} {
+		before := metricValue(metrics.SNMPPackets)
+		if found := scrape(pool, v3, system); found != 1 {
+			t.Fatalf("scrape %d: expected sysUpTime", i)
+		}
+		if got := metricValue(metrics.SNMPPackets) - before; got != want {
+			t.Fatalf("scrape %d: expected %v packets, got %v", i, want, got)
+		}
+	}
+}
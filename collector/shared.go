@@ -0,0 +1,300 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/gosnmp/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+var errNotWalked = errors.New("subtree was not walked")
+
+// sharedWalks lets the modules of a scrape use each other's walks, rather
+// than walking the same subtrees again. The walks of all the modules are
+// planned together, so that each subtree no other walk contains is walked
+// once. Each module only gets the PDUs under its own walks and gets, so the
+// samples it produces don't change. Modules with dynamic filters neither
+// share nor use walks.
+//
+// A subtree is walked by the first module that walks any of it, and is only
+// used by that module's later walks and by the modules after it. Modules are
+// handed to the workers in order, so the walk being waited on has always
+// been started.
+type sharedWalks struct {
+	plans   map[*NamedModule]*walkPlan
+	results map[string]*sharedWalk
+}
+
+// walkPlan is what a module walks for the others, and what it uses from
+// their walks.
+type walkPlan struct {
+	// owned maps walks of the module to the shared walk made in their place.
+	owned map[string]string
+	// covered maps OIDs to the shared walk that contains them.
+	covered map[string]string
+}
+
+type sharedWalk struct {
+	once sync.Once
+	done chan struct{}
+	// The OIDs the walk is used for, only the PDUs under them are kept.
+	needs []string
+	pdus  []gosnmp.SnmpPDU
+	err   error
+}
+
+func (w *sharedWalk) needed(oid string) bool {
+	for _, need := range w.needs {
+		if inSubtree(oid, need) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *sharedWalk) publish(pdus []gosnmp.SnmpPDU, err error) {
+	w.once.Do(func() {
+		w.pdus, w.err = pdus, err
+		close(w.done)
+	})
+}
+
+// newSharedWalks plans the walks of the modules of a scrape. It returns nil
+// if there is nothing to share.
+func newSharedWalks(modules []*NamedModule) *sharedWalks {
+	var sharing []*NamedModule
+	seen := map[*NamedModule]bool{}
+	for _, m := range modules {
+		if !seen[m] && len(m.Filters) == 0 {
+			sharing = append(sharing, m)
+		}
+		seen[m] = true
+	}
+	if len(sharing) < 2 {
+		return nil
+	}
+	// The roots are the walks no other walk contains.
+	var roots []string
+	for _, m := range sharing {
+		for _, oid := range m.Walk {
+			roots = addRoot(roots, oid)
+		}
+	}
+
+	owners := map[string]*NamedModule{}
+	needs := map[string][]string{}
+	plans := map[*NamedModule]*walkPlan{}
+	for _, m := range sharing {
+		plan := &walkPlan{owned: map[string]string{}, covered: map[string]string{}}
+		// Gets are made before walks, so they can only use the walks of the
+		// modules before.
+		for _, oid := range m.Get {
+			if root := coveringWalk(roots, oid); owners[root] != nil {
+				plan.covered[oid] = root
+				needs[root] = append(needs[root], oid)
+			}
+		}
+		for _, oid := range m.Walk {
+			if _, ok := plan.owned[oid]; ok {
+				continue
+			}
+			root := coveringWalk(roots, oid)
+			if owners[root] == nil {
+				owners[root] = m
+				plan.owned[oid] = root
+				continue
+			}
+			plan.covered[oid] = root
+			needs[root] = append(needs[root], oid)
+		}
+		plans[m] = plan
+	}
+
+	s := &sharedWalks{
+		plans:   map[*NamedModule]*walkPlan{},
+		results: map[string]*sharedWalk{},
+	}
+	for m, plan := range plans {
+		// Walks nothing else uses are made as usual.
+		for oid, root := range plan.owned {
+			if len(needs[root]) == 0 {
+				delete(plan.owned, oid)
+				continue
+			}
+			s.results[root] = &sharedWalk{done: make(chan struct{}), needs: needs[root]}
+		}
+		if len(plan.owned) > 0 || len(plan.covered) > 0 {
+			s.plans[m] = plan
+		}
+	}
+	if len(s.results) == 0 {
+		return nil
+	}
+	return s
+}
+
+// addRoot adds a walk to the roots, unless one of them contains it, and
+// removes the roots it contains.
+func addRoot(roots []string, oid string) []string {
+	if coveringWalk(roots, oid) != "" {
+		return roots
+	}
+	kept := roots[:0]
+	for _, root := range roots {
+		if !inSubtree(root, oid) {
+			kept = append(kept, root)
+		}
+	}
+	return append(kept, oid)
+}
+
+// coveringWalk returns the walk that contains the OID, if any.
+func coveringWalk(roots []string, oid string) string {
+	for _, root := range roots {
+		if inSubtree(oid, root) {
+			return root
+		}
+	}
+	return ""
+}
+
+func inSubtree(oid, root string) bool {
+	return oid == root || strings.HasPrefix(oid, root+".")
+}
+
+// scraper returns the scraper a module is collected with.
+func (s *sharedWalks) scraper(ctx context.Context, client scraper.SNMPScraper, m *NamedModule) scraper.SNMPScraper {
+	if s == nil || s.plans[m] == nil {
+		return client
+	}
+	return &sharedScraper{SNMPScraper: client, ctx: ctx, walks: s, plan: s.plans[m]}
+}
+
+// release marks the walks of a module that weren't made as failed, so
+// modules waiting on them walk the subtrees themselves.
+func (s *sharedWalks) release(m *NamedModule) {
+	if s == nil || s.plans[m] == nil {
+		return
+	}
+	for _, root := range s.plans[m].owned {
+		s.results[root].publish(nil, errNotWalked)
+	}
+}
+
+// wait returns the PDUs of a shared walk, or false if that walk failed.
+func (s *sharedWalks) wait(ctx context.Context, root string) ([]gosnmp.SnmpPDU, bool) {
+	w := s.results[root]
+	select {
+	case <-w.done:
+		return w.pdus, w.err == nil
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// sharedScraper serves walks and gets from the shared walks where it can,
+// and publishes the shared walks its module makes.
+type sharedScraper struct {
+	scraper.SNMPScraper
+	ctx   context.Context
+	walks *sharedWalks
+	plan  *walkPlan
+}
+
+func (s *sharedScraper) WalkAll(oid string) ([]gosnmp.SnmpPDU, error) {
+	var pdus []gosnmp.SnmpPDU
+	err := s.Walk(oid, func(pdu gosnmp.SnmpPDU) error {
+		pdus = append(pdus, pdu)
+		return nil
+	})
+	return pdus, err
+}
+
+func (s *sharedScraper) Walk(oid string, fn func(gosnmp.SnmpPDU) error) error {
+	if root, ok := s.plan.owned[oid]; ok {
+		// The walk is made for others too, only the PDUs they use are kept.
+		w := s.walks.results[root]
+		var pdus []gosnmp.SnmpPDU
+		err := s.SNMPScraper.Walk(root, func(pdu gosnmp.SnmpPDU) error {
+			name := strings.TrimPrefix(pdu.Name, ".")
+			if w.needed(name) {
+				pdus = append(pdus, pdu)
+			}
+			if !inSubtree(name, oid) {
+				return nil
+			}
+			return fn(pdu)
+		})
+		w.publish(pdus, err)
+		return err
+	}
+	if root, ok := s.plan.covered[oid]; ok {
+		if pdus, ok := s.walks.wait(s.ctx, root); ok {
+			for _, pdu := range pdus {
+				if !inSubtree(strings.TrimPrefix(pdu.Name, "."), oid) {
+					continue
+				}
+				if err := fn(pdu); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		// Fall back to walking it here.
+	}
+	return s.SNMPScraper.Walk(oid, fn)
+}
+
+func (s *sharedScraper) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	var (
+		shared    []gosnmp.SnmpPDU
+		remaining []string
+	)
+	for _, oid := range oids {
+		root, ok := s.plan.covered[oid]
+		if !ok {
+			remaining = append(remaining, oid)
+			continue
+		}
+		pdus, ok := s.walks.wait(s.ctx, root)
+		if !ok {
+			remaining = append(remaining, oid)
+			continue
+		}
+		// An OID that wasn't in the walk doesn't exist on the target.
+		pdu := gosnmp.SnmpPDU{Name: oid, Type: gosnmp.NoSuchInstance}
+		for _, p := range pdus {
+			if strings.TrimPrefix(p.Name, ".") == oid {
+				pdu = p
+				break
+			}
+		}
+		shared = append(shared, pdu)
+	}
+	if len(remaining) == 0 {
+		return &gosnmp.SnmpPacket{Variables: shared, Error: gosnmp.NoError}, nil
+	}
+	packet, err := s.SNMPScraper.Get(remaining)
+	if err != nil || packet.Error != gosnmp.NoError {
+		return packet, err
+	}
+	packet.Variables = append(shared, packet.Variables...)
+	return packet, nil
+}
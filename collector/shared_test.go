@@ -0,0 +1,155 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+func TestSharedWalks(t *testing.T) {
+	interfaces := NewNamedModule("interfaces", &config.Module{
+		Walk: []string{"1.3.6.1.2.1.2"},
+	})
+	ifDescr := NewNamedModule("if_descr", &config.Module{
+		Walk:       []string{"1.3.6.1.2.1.2.2.1.2", "1.3.6.1.2.1.31.1.1.1.1"},
+		Get:        []string{"1.3.6.1.2.1.2.1.0", "1.3.6.1.2.1.1.3.0"},
+		WalkParams: config.WalkParams{MaxRepetitions: 10},
+	})
+	filtered := NewNamedModule("filtered", &config.Module{
+		Walk:    []string{"1.3.6.1.2.1.2.2.1.2"},
+		Filters: []config.DynamicFilter{{Oid: "1.3.6.1.2.1.2.2.1.7", Values: []string{"1"}}},
+	})
+	shared := newSharedWalks([]*NamedModule{interfaces, ifDescr, filtered})
+
+	mock := scraper.NewMockSNMPScraper(map[string]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.1.3.0": {Type: gosnmp.TimeTicks, Name: ".1.3.6.1.2.1.1.3.0", Value: uint32(10)},
+	}, map[string][]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.2": {
+			{Type: gosnmp.Integer, Name: ".1.3.6.1.2.1.2.1.0", Value: 2},
+			{Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.2.2.1.2.1", Value: "lo"},
+			{Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.2.2.1.2.2", Value: "eth0"},
+			{Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.2.2.1.20.1", Value: "x"},
+		},
+		"1.3.6.1.2.1.31.1.1.1.1": {
+			{Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.31.1.1.1.1.1", Value: "lo"},
+		},
+		"1.3.6.1.2.1.2.2.1.2": {
+			{Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.2.2.1.2.1", Value: "lo"},
+		},
+	})
+	scrape := func(m *NamedModule) ScrapeResults {
+		t.Helper()
+		results, err := ScrapeTarget(shared.scraper(context.Background(), mock, m), "someTarget", &config.Auth{Version: 2}, m.Module, promslog.NewNopLogger(), Metrics{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		shared.release(m)
+		return results
+	}
+
+	if got := scrape(interfaces).pdus; len(got) != 4 {
+		t.Fatalf("expected 4 PDUs from the interfaces walk, got %v", got)
+	}
+	got := scrape(ifDescr).pdus
+	want := []string{".1.3.6.1.2.1.2.1.0", ".1.3.6.1.2.1.1.3.0", ".1.3.6.1.2.1.2.2.1.2.1", ".1.3.6.1.2.1.2.2.1.2.2", ".1.3.6.1.2.1.31.1.1.1.1.1"}
+	var names []string
+	for _, pdu := range got {
+		names = append(names, pdu.Name)
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("expected PDUs %v, got %v", want, names)
+	}
+	scrape(filtered)
+
+	if want := []string{"1.3.6.1.2.1.2", "1.3.6.1.2.1.31.1.1.1.1", "1.3.6.1.2.1.2.2.1.7", "1.3.6.1.2.1.2.2.1.2"}; !reflect.DeepEqual(mock.CallWalk(), want) {
+		t.Errorf("expected walks %v, got %v", want, mock.CallWalk())
+	}
+	if want := []string{"1.3.6.1.2.1.1.3.0"}; !reflect.DeepEqual(mock.CallGet(), want) {
+		t.Errorf("expected gets %v, got %v", want, mock.CallGet())
+	}
+}
+
+func TestSharedWalksFallBack(t *testing.T) {
+	first := NewNamedModule("first", &config.Module{Walk: []string{"1.3.6.1.2.1.2"}})
+	second := NewNamedModule("second", &config.Module{Walk: []string{"1.3.6.1.2.1.2.2.1.2"}})
+	shared := newSharedWalks([]*NamedModule{first, second})
+	// The first module never ran, e.g. its worker failed to connect.
+	shared.release(first)
+
+	mock := scraper.NewMockSNMPScraper(nil, nil)
+	if _, err := shared.scraper(context.Background(), mock, second).WalkAll("1.3.6.1.2.1.2.2.1.2"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1.3.6.1.2.1.2.2.1.2"}; !reflect.DeepEqual(mock.CallWalk(), want) {
+		t.Errorf("expected walks %v, got %v", want, mock.CallWalk())
+	}
+}
+
+func TestSharedWalksPlan(t *testing.T) {
+	mock := scraper.NewMockSNMPScraper(nil, map[string][]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.2": {
+			{Type: gosnmp.Integer, Name: ".1.3.6.1.2.1.2.1.0", Value: 2},
+			{Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.2.2.1.2.1", Value: "lo"},
+			{Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.2.2.1.2.2", Value: "eth0"},
+		},
+	})
+	scrape := func(shared *sharedWalks, m *NamedModule) int {
+		t.Helper()
+		results, err := ScrapeTarget(shared.scraper(context.Background(), mock, m), "someTarget", &config.Auth{Version: 2}, m.Module, promslog.NewNopLogger(), Metrics{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		shared.release(m)
+		return len(results.pdus)
+	}
+
+	// A module before the one walking the whole subtree walks it in its place.
+	ifDescr := NewNamedModule("if_descr", &config.Module{Walk: []string{"1.3.6.1.2.1.2.2.1.2"}})
+	interfaces := NewNamedModule("interfaces", &config.Module{Walk: []string{"1.3.6.1.2.1.2"}})
+	shared := newSharedWalks([]*NamedModule{ifDescr, interfaces})
+	if got := scrape(shared, ifDescr); got != 2 {
+		t.Fatalf("expected 2 PDUs for ifDescr, got %d", got)
+	}
+	if got := scrape(shared, interfaces); got != 3 {
+		t.Fatalf("expected 3 PDUs for interfaces, got %d", got)
+	}
+	if want := []string{"1.3.6.1.2.1.2"}; !reflect.DeepEqual(mock.CallWalk(), want) {
+		t.Errorf("expected walks %v, got %v", want, mock.CallWalk())
+	}
+
+	// Only the PDUs later modules use are kept.
+	ifNumber := NewNamedModule("if_number", &config.Module{Get: []string{"1.3.6.1.2.1.2.1.0"}})
+	shared = newSharedWalks([]*NamedModule{interfaces, ifNumber})
+	scrape(shared, interfaces)
+	if got := shared.results["1.3.6.1.2.1.2"].pdus; len(got) != 1 || got[0].Name != ".1.3.6.1.2.1.2.1.0" {
+		t.Errorf("expected only ifNumber to be kept, got %v", got)
+	}
+	if got := scrape(shared, ifNumber); got != 1 {
+		t.Fatalf("expected 1 PDU for ifNumber, got %d", got)
+	}
+
+	// Walks no other module uses aren't shared.
+	system := NewNamedModule("system", &config.Module{Walk: []string{"1.3.6.1.2.1.1"}})
+	if shared := newSharedWalks([]*NamedModule{system, interfaces}); shared != nil {
+		t.Errorf("expected nothing to share, got %+v", shared.plans)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+// pduSink receives the PDUs of a scrape as they arrive.
+type pduSink interface {
+	// walking is called once the gets are done, with the subtrees that are
+	// walked next.
+	walking(subtrees []string)
+	add(pdu gosnmp.SnmpPDU)
+	// walked is called when a walk is finished, whether it succeeded or not.
+	walked(subtree string)
+}
+
+func (r *ScrapeResults) walking([]string) {}
+
+func (r *ScrapeResults) add(pdu gosnmp.SnmpPDU) {
+	r.pdus = append(r.pdus, pdu)
+}
+
+func (r *ScrapeResults) walked(string) {}
+
+// oidTree is a set of OID subtrees.
+type oidTree struct {
+	// oid is set on the nodes that are the root of a subtree.
+	oid      string
+	children map[int]*oidTree
+}
+
+func (t *oidTree) add(oid string) {
+	head := t
+	for _, o := range oidToList(oid) {
+		if head.children == nil {
+			head.children = map[int]*oidTree{}
+		}
+		if _, ok := head.children[o]; !ok {
+			head.children[o] = &oidTree{}
+		}
+		head = head.children[o]
+	}
+	head.oid = oid
+}
+
+// find returns the subtree that contains the OID, if any.
+func (t *oidTree) find(oidList []int) string {
+	head := t
+	for _, o := range oidList {
+		var ok bool
+		if head, ok = head.children[o]; !ok {
+			return ""
+		}
+		if head.oid != "" {
+			return head.oid
+		}
+	}
+	return ""
+}
+
+// lookupColumns returns the columns a metric reads from other PDUs: those
+// of its lookups, and the columns holding the types of combined types.
+func lookupColumns(metric *config.Metric) []string {
+	var columns []string
+	if _, ok := combinedTypeMapping[metric.Type]; ok {
+		columns = append(columns, getPrevOid(metric.Oid))
+	}
+	for _, lookup := range metric.Lookups {
+		if len(lookup.Labels) == 0 {
+			continue
+		}
+		columns = append(columns, lookup.Oid)
+		if _, ok := combinedTypeMapping[lookup.Type]; ok {
+			columns = append(columns, getPrevOid(lookup.Oid))
+		}
+	}
+	return columns
+}
+
+// overlaps reports whether any of the OIDs is within the subtree of another,
+// so that the same PDU could be returned twice.
+func overlaps(oids []string) bool {
+	for i, a := range oids {
+		for _, b := range oids[i+1:] {
+			if inSubtree(a, b) || inSubtree(b, a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sampleStream turns the PDUs of a module into samples as they arrive, so
+// that whole walks don't have to be held in memory. Only the PDUs of columns
+// used by lookups are kept, and samples that use them wait until those
+// columns are complete.
+type sampleStream struct {
+	module  *NamedModule
+	logger  *slog.Logger
+	metrics Metrics
+	emit    func(prometheus.Metric)
+
+	pdus int
+	// kept holds the PDUs of lookup columns, by OID.
+	kept map[string]gosnmp.SnmpPDU
+	// seen is only used if the module could return a PDU twice.
+	seen    map[string]bool
+	pending []pendingPDU
+
+	started  bool
+	unwalked []string
+	// complete holds the lookup columns the current walk has gone past.
+	complete map[string]bool
+	column   string
+}
+
+type pendingPDU struct {
+	pdu        gosnmp.SnmpPDU
+	indexOids  []int
+	metric     *preparedMetric
+	lookupCols []string
+}
+
+func newSampleStream(module *NamedModule, logger *slog.Logger, metrics Metrics, emit func(prometheus.Metric)) *sampleStream {
+	s := &sampleStream{
+		module:   module,
+		logger:   logger,
+		metrics:  metrics,
+		emit:     emit,
+		kept:     map[string]gosnmp.SnmpPDU{},
+		complete: map[string]bool{},
+	}
+	if module.mayRepeat {
+		s.seen = map[string]bool{}
+	}
+	return s
+}
+
+func (s *sampleStream) walking(subtrees []string) {
+	s.started = true
+	s.unwalked = append([]string(nil), subtrees...)
+	s.flush()
+}
+
+func (s *sampleStream) walked(subtree string) {
+	for i, oid := range s.unwalked {
+		if oid == subtree {
+			s.unwalked = append(s.unwalked[:i], s.unwalked[i+1:]...)
+			break
+		}
+	}
+	s.column = ""
+	s.flush()
+}
+
+func (s *sampleStream) add(pdu gosnmp.SnmpPDU) {
+	s.pdus++
+	oid := strings.TrimPrefix(pdu.Name, ".")
+	if s.seen != nil {
+		if s.seen[oid] {
+			return
+		}
+		s.seen[oid] = true
+	}
+	oidList := oidToList(oid)
+
+	// Walks return OIDs in order, so a walk that left a column is done with it.
+	if s.column != "" && !inSubtree(oid, s.column) && !s.module.WalkParams.AllowNonIncreasingOIDs {
+		s.complete[s.column] = true
+		s.column = ""
+		s.flush()
+	}
+	if column := s.module.lookupTree.find(oidList); column != "" {
+		s.kept[oid] = pdu
+		s.column = column
+	}
+
+	metric, indexOids := findMetric(s.module.metricTree, oidList)
+	if metric == nil {
+		return
+	}
+	p := pendingPDU{pdu: pdu, indexOids: indexOids, metric: metric, lookupCols: metric.lookupColumns}
+	if s.ready(p) {
+		s.samples(p)
+	} else {
+		s.pending = append(s.pending, p)
+	}
+}
+
+// ready reports whether all the lookup columns of a PDU are complete.
+func (s *sampleStream) ready(p pendingPDU) bool {
+	if len(p.lookupCols) == 0 {
+		return true
+	}
+	if !s.started {
+		return false
+	}
+	for _, column := range p.lookupCols {
+		if s.complete[column] {
+			continue
+		}
+		for _, subtree := range s.unwalked {
+			if inSubtree(column, subtree) || inSubtree(subtree, column) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *sampleStream) flush() {
+	pending := s.pending[:0]
+	for _, p := range s.pending {
+		if s.ready(p) {
+			s.samples(p)
+		} else {
+			pending = append(pending, p)
+		}
+	}
+	s.pending = pending
+}
+
+// finish emits the samples still waiting on lookups, such as when the scrape
+// was cut short.
+func (s *sampleStream) finish() {
+	for _, p := range s.pending {
+		s.samples(p)
+	}
+	s.pending = nil
+}
+
+func (s *sampleStream) samples(p pendingPDU) {
+	for _, sample := range pduToSamples(p.indexOids, &p.pdu, p.metric, s.kept, s.logger, s.metrics) {
+		s.emit(sample)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+func TestSampleStream(t *testing.T) {
+	index := []*config.Index{{Labelname: "ifIndex", Type: "gauge"}}
+	module := NewNamedModule("if_mib", &config.Module{
+		Walk: []string{"1.3.6.1.2.1.2.2", "1.3.6.1.2.1.31.1.1"},
+		Metrics: []*config.Metric{
+			{Name: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", Type: "DisplayString", Indexes: index},
+			{
+				Name: "ifInOctets", Oid: "1.3.6.1.2.1.2.2.1.10", Type: "counter", Indexes: index,
+				Lookups: []*config.Lookup{{Labels: []string{"ifIndex"}, Labelname: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", Type: "DisplayString"}},
+			},
+			{
+				Name: "ifHCInOctets", Oid: "1.3.6.1.2.1.31.1.1.1.6", Type: "counter", Indexes: index,
+				Lookups: []*config.Lookup{{Labels: []string{"ifIndex"}, Labelname: "ifAlias", Oid: "1.3.6.1.2.1.31.1.1.1.18", Type: "DisplayString"}},
+			},
+		},
+	})
+
+	var samples []prometheus.Metric
+	s := newSampleStream(module, promslog.NewNopLogger(), Metrics{}, func(m prometheus.Metric) { samples = append(samples, m) })
+	expect := func(step string, n int) {
+		t.Helper()
+		if len(samples) != n {
+			t.Fatalf("%s: expected %d samples, got %d", step, n, len(samples))
+		}
+	}
+
+	s.walking([]string{"1.3.6.1.2.1.2.2", "1.3.6.1.2.1.31.1.1"})
+	s.add(gosnmp.SnmpPDU{Name: ".1.3.6.1.2.1.2.2.1.2.1", Type: gosnmp.OctetString, Value: []byte("eth0")})
+	expect("metric without lookups", 1)
+	s.add(gosnmp.SnmpPDU{Name: ".1.3.6.1.2.1.2.2.1.10.1", Type: gosnmp.Counter32, Value: uint(10)})
+	expect("lookup column passed", 2)
+	s.walked("1.3.6.1.2.1.2.2")
+	s.add(gosnmp.SnmpPDU{Name: ".1.3.6.1.2.1.31.1.1.1.6.1", Type: gosnmp.Counter64, Value: uint64(20)})
+	expect("lookup column not walked yet", 2)
+	s.add(gosnmp.SnmpPDU{Name: ".1.3.6.1.2.1.31.1.1.1.18.1", Type: gosnmp.OctetString, Value: []byte("uplink")})
+	expect("lookup column being walked", 2)
+	s.walked("1.3.6.1.2.1.31.1.1")
+	expect("walk done", 3)
+	s.finish()
+	expect("finish", 3)
+
+	// The samples with lookups got their labels.
+	var lookups []string
+	for _, sample := range samples[1:] {
+		var pb io_prometheus_client.Metric
+		if err := sample.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range pb.GetLabel() {
+			if l.GetName() == "ifDescr" || l.GetName() == "ifAlias" {
+				lookups = append(lookups, l.GetValue())
+			}
+		}
+	}
+	if !reflect.DeepEqual(lookups, []string{"eth0", "uplink"}) {
+		t.Errorf("expected lookup labels eth0 and uplink, got %v", lookups)
+	}
+	if s.pdus != 4 || len(s.kept) != 2 {
+		t.Errorf("expected 4 PDUs with 2 kept, got %d with %d kept", s.pdus, len(s.kept))
+	}
+}
+
+func TestSampleStreamRepeatedPDUs(t *testing.T) {
+	module := NewNamedModule("system", &config.Module{
+		Walk: []string{"1.3.6.1.2.1.1"},
+		Get:  []string{"1.3.6.1.2.1.1.3.0"},
+		Metrics: []*config.Metric{
+			{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge"},
+		},
+	})
+	if !module.mayRepeat {
+		t.Fatal("expected overlapping walk and get to be detected")
+	}
+	var samples []prometheus.Metric
+	s := newSampleStream(module, promslog.NewNopLogger(), Metrics{}, func(m prometheus.Metric) { samples = append(samples, m) })
+	pdu := gosnmp.SnmpPDU{Name: ".1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: uint32(10)}
+	s.add(pdu)
+	s.walking([]string{"1.3.6.1.2.1.1"})
+	s.add(pdu)
+	s.walked("1.3.6.1.2.1.1")
+	s.finish()
+	if len(samples) != 1 {
+		t.Errorf("expected 1 sample, got %d", len(samples))
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+var subtreeMetrics = kingpin.Flag("snmp.subtree-metrics", "Expose the duration, packets and PDUs of each walk and get batch of a module.").Default("false").Bool()
+
+// subtreeStats are the statistics of a single walk or get batch.
+type subtreeStats struct {
+	kind     string
+	oid      string
+	duration time.Duration
+	packets  uint64
+	retries  uint64
+	pdus     int
+}
+
+// statsScraper records the statistics of each walk and get batch made
+// through it. The packet and retry counters are those of the client.
+type statsScraper struct {
+	scraper.SNMPScraper
+	packets *uint64
+	retries *uint64
+	stats   []subtreeStats
+}
+
+func (s *statsScraper) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	start, packets, retries := time.Now(), *s.packets, *s.retries
+	packet, err := s.SNMPScraper.Get(oids)
+	st := subtreeStats{kind: "get", duration: time.Since(start), packets: *s.packets - packets, retries: *s.retries - retries}
+	// A get batch is identified by its first OID.
+	if len(oids) > 0 {
+		st.oid = oids[0]
+	}
+	if packet != nil {
+		st.pdus = len(packet.Variables)
+	}
+	s.stats = append(s.stats, st)
+	return packet, err
+}
+
+func (s *statsScraper) WalkAll(oid string) ([]gosnmp.SnmpPDU, error) {
+	return s.walkAll("walk", oid)
+}
+
+func (s *statsScraper) walkAll(kind, oid string) ([]gosnmp.SnmpPDU, error) {
+	start, packets, retries := time.Now(), *s.packets, *s.retries
+	pdus, err := s.SNMPScraper.WalkAll(oid)
+	s.stats = append(s.stats, subtreeStats{
+		kind:     kind,
+		oid:      oid,
+		duration: time.Since(start),
+		packets:  *s.packets - packets,
+		retries:  *s.retries - retries,
+		pdus:     len(pdus),
+	})
+	return pdus, err
+}
+
+func (s *statsScraper) Walk(oid string, fn func(gosnmp.SnmpPDU) error) error {
+	start, packets, retries := time.Now(), *s.packets, *s.retries
+	st := subtreeStats{kind: "walk", oid: oid}
+	err := s.SNMPScraper.Walk(oid, func(pdu gosnmp.SnmpPDU) error {
+		st.pdus++
+		return fn(pdu)
+	})
+	st.duration, st.packets, st.retries = time.Since(start), *s.packets-packets, *s.retries-retries
+	s.stats = append(s.stats, st)
+	return err
+}
+
+// walkFilter walks the OID of a dynamic filter. Its statistics are of kind
+// "filter", as the module may also walk the same OID.
+func walkFilter(snmp scraper.SNMPScraper, oid string) ([]gosnmp.SnmpPDU, error) {
+	if s, ok := snmp.(*statsScraper); ok {
+		return s.walkAll("filter", oid)
+	}
+	return snmp.WalkAll(oid)
+}
+
+// metricName returns the name of the metric whose OID is, or contains, the
+// given OID. It is empty if there is none, such as for walks of whole tables.
+func metricName(metrics []*config.Metric, oid string) string {
+	oid = strings.TrimPrefix(oid, ".")
+	name, length := "", 0
+	for _, m := range metrics {
+		if (oid == m.Oid || strings.HasPrefix(oid, m.Oid+".")) && len(m.Oid) > length {
+			name, length = m.Name, len(m.Oid)
+		}
+	}
+	return name
+}
+
+func subtreeStatsMetrics(ch chan<- prometheus.Metric, module *NamedModule, stats []subtreeStats) {
+	labels := []string{"kind", "oid", "name"}
+	moduleLabel := prometheus.Labels{"module": module.name}
+	var (
+		durationDesc = prometheus.NewDesc("snmp_scrape_subtree_duration_seconds", "Time the walk or get batch took.", labels, moduleLabel)
+		packetsDesc  = prometheus.NewDesc("snmp_scrape_subtree_packets_sent", "Packets sent for the walk or get batch, including retries.", labels, moduleLabel)
+		retriesDesc  = prometheus.NewDesc("snmp_scrape_subtree_packets_retried", "Packets retried for the walk or get batch.", labels, moduleLabel)
+		pdusDesc     = prometheus.NewDesc("snmp_scrape_subtree_pdus_returned", "PDUs returned from the walk or get batch.", labels, moduleLabel)
+	)
+	// Several filters may walk the same OID, so the statistics of the same
+	// kind and OID are summed.
+	type key struct{ kind, oid string }
+	var merged []subtreeStats
+	seen := map[key]int{}
+	for _, st := range stats {
+		i, ok := seen[key{st.kind, st.oid}]
+		if !ok {
+			seen[key{st.kind, st.oid}] = len(merged)
+			merged = append(merged, st)
+			continue
+		}
+		merged[i].duration += st.duration
+		merged[i].packets += st.packets
+		merged[i].retries += st.retries
+		merged[i].pdus += st.pdus
+	}
+	for _, st := range merged {
+		values := []string{st.kind, st.oid, metricName(module.Metrics, st.oid)}
+		ch <- prometheus.MustNewConstMetric(durationDesc, prometheus.GaugeValue, st.duration.Seconds(), values...)
+		ch <- prometheus.MustNewConstMetric(packetsDesc, prometheus.GaugeValue, float64(st.packets), values...)
+		ch <- prometheus.MustNewConstMetric(retriesDesc, prometheus.GaugeValue, float64(st.retries), values...)
+		ch <- prometheus.MustNewConstMetric(pdusDesc, prometheus.GaugeValue, float64(st.pdus), values...)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+func TestStatsScraper(t *testing.T) {
+	module := &config.Module{
+		Get:        []string{"1.3.6.1.2.1.1.3.0", "1.3.6.1.2.1.1.5.0"},
+		Walk:       []string{"1.3.6.1.2.1.2.2.1.2"},
+		WalkParams: config.WalkParams{MaxRepetitions: 1},
+	}
+	mock := scraper.NewMockSNMPScraper(map[string]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.1.3.0": {Type: gosnmp.TimeTicks, Name: "1.3.6.1.2.1.1.3.0", Value: uint32(10)},
+	}, map[string][]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.2.2.1.2": {
+			{Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.2.2.1.2.1", Value: "lo"},
+			{Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.2.2.1.2.2", Value: "eth0"},
+		},
+	})
+	var packets, retries uint64
+	stats := &statsScraper{SNMPScraper: mock, packets: &packets, retries: &retries}
+	if _, err := ScrapeTarget(stats, "someTarget", &config.Auth{Version: 2}, module, promslog.NewNopLogger(), Metrics{}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		kind string
+		oid  string
+		pdus int
+	}{
+		{"get", "1.3.6.1.2.1.1.3.0", 1},
+		{"get", "1.3.6.1.2.1.1.5.0", 1},
+		{"walk", "1.3.6.1.2.1.2.2.1.2", 2},
+	}
+	if len(stats.stats) != len(want) {
+		t.Fatalf("expected %d steps, got %+v", len(want), stats.stats)
+	}
+	for i, w := range want {
+		got := stats.stats[i]
+		if got.kind != w.kind || got.oid != w.oid || got.pdus != w.pdus {
+			t.Errorf("step %d: expected %+v, got %+v", i, w, got)
+		}
+	}
+}
+
+func TestStatsScraperFilters(t *testing.T) {
+	// Both filters walk ifOperStatus, which the module walks too.
+	filter := config.DynamicFilter{
+		Oid:     "1.3.6.1.2.1.2.2.1.8",
+		Targets: []string{"1.3.6.1.2.1.2.2.1.2"},
+		Values:  []string{"1"},
+	}
+	module := NewNamedModule("if_mib", &config.Module{
+		Walk:       []string{"1.3.6.1.2.1.2.2.1.2", "1.3.6.1.2.1.2.2.1.8"},
+		Filters:    []config.DynamicFilter{filter, filter},
+		WalkParams: config.WalkParams{MaxRepetitions: 1},
+	})
+	mock := scraper.NewMockSNMPScraper(map[string]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.2.2.1.2.1": {Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.2.2.1.2.1", Value: "lo"},
+	}, map[string][]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.2.2.1.8": {
+			{Type: gosnmp.Integer, Name: ".1.3.6.1.2.1.2.2.1.8.1", Value: 1},
+			{Type: gosnmp.Integer, Name: ".1.3.6.1.2.1.2.2.1.8.2", Value: 2},
+		},
+	})
+	var packets, retries uint64
+	stats := &statsScraper{SNMPScraper: mock, packets: &packets, retries: &retries}
+	if _, err := ScrapeTarget(stats, "someTarget", &config.Auth{Version: 2}, module.Module, promslog.NewNopLogger(), Metrics{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	subtreeStatsMetrics(ch, module, stats.stats)
+	close(ch)
+	pdus := map[string]float64{}
+	seen := map[string]bool{}
+	for m := range ch {
+		var pb io_prometheus_client.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		series := m.Desc().String()
+		labels := map[string]string{}
+		for _, l := range pb.GetLabel() {
+			series += l.GetName() + "=" + l.GetValue() + ","
+			labels[l.GetName()] = l.GetValue()
+		}
+		if seen[series] {
+			t.Fatalf("duplicate series %s", series)
+		}
+		seen[series] = true
+		if !strings.Contains(m.Desc().String(), `"snmp_scrape_subtree_pdus_returned"`) {
+			continue
+		}
+		pdus[labels["kind"]+" "+labels["oid"]] = pb.GetGauge().GetValue()
+	}
+	want := map[string]float64{
+		"filter 1.3.6.1.2.1.2.2.1.8": 4,
+		"walk 1.3.6.1.2.1.2.2.1.8":   2,
+		"get 1.3.6.1.2.1.2.2.1.2.1":  1,
+	}
+	if len(pdus) != len(want) {
+		t.Fatalf("expected %v, got %v", want, pdus)
+	}
+	for k, v := range want {
+		if pdus[k] != v {
+			t.Errorf("%s: expected %v PDUs, got %v", k, v, pdus[k])
+		}
+	}
+}
+
+func TestMetricName(t *testing.T) {
+	metrics := []*config.Metric{
+		{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3"},
+		{Name: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2"},
+		{Name: "ifDescrLong", Oid: "1.3.6.1.2.1.2.2.1.20"},
+	}
+	cases := map[string]string{
+		"1.3.6.1.2.1.1.3.0":      "sysUpTime",
+		".1.3.6.1.2.1.2.2.1.2":   "ifDescr",
+		"1.3.6.1.2.1.2.2.1.20.1": "ifDescrLong",
+		"1.3.6.1.2.1.2":          "",
+	}
+	for oid, want := range cases {
+		if got := metricName(metrics, oid); got != want {
+			t.Errorf("metricName(%q) = %q, want %q", oid, got, want)
+		}
+	}
+}
@@ -14,12 +14,17 @@
 package config
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/gosnmp/gosnmp"
@@ -36,10 +41,33 @@ type Auth struct {
 	PrivPassword  Secret `yaml:"priv_password,omitempty"`
 	ContextName   string `yaml:"context_name,omitempty"`
 	Version       int    `yaml:"version,omitempty"`
+	// Files the settings above are read from instead, relative to the
+	// configuration file.
+	CommunityFile    string `yaml:"community_file,omitempty"`
+	PasswordFile     string `yaml:"password_file,omitempty"`
+	PrivPasswordFile string `yaml:"priv_password_file,omitempty"`
+	ContextNameFile  string `yaml:"context_name_file,omitempty"`
+	// SNMPv3 keys in hex used instead of the passwords: master keys, which
+	// are localized to the engine ID of each target, and keys already
+	// localized to the engine IDs of targets, by engine ID.
+	AuthKey       Secret                   `yaml:"auth_key,omitempty"`
+	PrivKey       Secret                   `yaml:"priv_key,omitempty"`
+	LocalizedKeys map[string]LocalizedKeys `yaml:"localized_keys,omitempty"`
+
+	// The settings above that reference secrets of secret providers, and
+	// the providers.
+	secretRefs      map[string]SecretRef
+	secretProviders map[string]*SecretProvider
+
+	// Other auths that are tried in order until the target accepts one. The
+	// other settings of an auth with a chain are not used.
+	Chain []string `yaml:"chain,omitempty"`
 }
 
 func LoadFile(logger *slog.Logger, paths []string, expandEnvVars bool) (*Config, error) {
 	cfg := &Config{}
+	// The directories of the files that auths were loaded from.
+	authDirs := map[*Auth]string{}
 	for _, p := range paths {
 		files, err := filepath.Glob(p)
 		if err != nil {
@@ -57,9 +85,30 @@ func LoadFile(logger *slog.Logger, paths []string, expandEnvVars bool) (*Config,
 			if err != nil {
 				return nil, err
 			}
+			for _, auth := range cfg.Auths {
+				if _, ok := authDirs[auth]; !ok {
+					authDirs[auth] = filepath.Dir(f)
+				}
+			}
 		}
 	}
 
+	if err := cfg.validateSecretProviders(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateAuthChains(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateTargets(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateTraps(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateModuleSelection(); err != nil {
+		return nil, err
+	}
+
 	if expandEnvVars {
 		var err error
 		for i, auth := range cfg.Auths {
@@ -86,9 +135,59 @@ func LoadFile(logger *slog.Logger, paths []string, expandEnvVars bool) (*Config,
 		}
 	}
 
+	// Secrets read from files are used as they are, without expanding
+	// environment variables in them.
+	for name, auth := range cfg.Auths {
+		if err := auth.readFiles(authDirs[auth]); err != nil {
+			return nil, fmt.Errorf("auth %q: %w", name, err)
+		}
+	}
+
 	return cfg, nil
 }
 
+// readFiles reads the settings of the auth that are set from files, resolving
+// the paths of the files against dir.
+func (c *Auth) readFiles(dir string) error {
+	for _, f := range []struct {
+		path *string
+		set  func(string)
+	}{
+		{&c.CommunityFile, c.Community.Set},
+		{&c.PasswordFile, c.Password.Set},
+		{&c.PrivPasswordFile, c.PrivPassword.Set},
+		{&c.ContextNameFile, func(v string) { c.ContextName = v }},
+	} {
+		if *f.path == "" {
+			continue
+		}
+		if !filepath.IsAbs(*f.path) {
+			*f.path = filepath.Join(dir, *f.path)
+		}
+		content, err := os.ReadFile(*f.path)
+		if err != nil {
+			return err
+		}
+		// Files usually end with a newline that isn't part of the secret.
+		f.set(strings.TrimRight(string(content), "\r\n"))
+	}
+	return nil
+}
+
+// SecretFiles returns the paths of the files that auths read settings from.
+func (c *Config) SecretFiles() []string {
+	var files []string
+	for _, auth := range c.Auths {
+		for _, f := range []string{auth.CommunityFile, auth.PasswordFile, auth.PrivPasswordFile, auth.ContextNameFile} {
+			if f != "" && !slices.Contains(files, f) {
+				files = append(files, f)
+			}
+		}
+	}
+	slices.Sort(files)
+	return files
+}
+
 var (
 	defaultRetries = 3
 
@@ -112,13 +211,261 @@ var (
 	DefaultRegexpExtract = RegexpExtract{
 		Value: "$1",
 	}
+	DefaultAlertmanager = Alertmanager{
+		Retries: 3,
+		Timeout: time.Second * 10,
+	}
+	DefaultModuleSelection = ModuleSelection{
+		CacheTTL: time.Hour,
+	}
 )
 
 // Config for the snmp_exporter.
 type Config struct {
-	Auths   map[string]*Auth   `yaml:"auths,omitempty"`
-	Modules map[string]*Module `yaml:"modules,omitempty"`
-	Version int                `yaml:"version,omitempty"`
+	Auths           map[string]*Auth           `yaml:"auths,omitempty"`
+	SecretProviders map[string]*SecretProvider `yaml:"secret_providers,omitempty"`
+	Modules         map[string]*Module         `yaml:"modules,omitempty"`
+	ModuleSelection *ModuleSelection           `yaml:"module_selection,omitempty"`
+	Targets         map[string]*Target         `yaml:"targets,omitempty"`
+	Traps           Traps                      `yaml:"traps,omitempty"`
+	Version         int                        `yaml:"version,omitempty"`
+}
+
+// ModuleSelection picks the modules of the targets scraped without any, by
+// their sysObjectID and sysDescr.
+type ModuleSelection struct {
+	// How long the modules picked for a target are used for.
+	CacheTTL time.Duration `yaml:"cache_ttl,omitempty"`
+	// The first rule that matches a target picks its modules.
+	Rules []*ModuleSelectionRule `yaml:"rules"`
+}
+
+func (c *ModuleSelection) UnmarshalYAML(unmarshal func(any) error) error {
+	*c = DefaultModuleSelection
+	type plain ModuleSelection
+	return unmarshal((*plain)(c))
+}
+
+// ModuleSelectionRule matches the targets whose sysObjectID starts with an
+// OID and whose sysDescr matches a regular expression. A rule without either
+// matches every target.
+type ModuleSelectionRule struct {
+	SysObjectID string   `yaml:"sys_object_id,omitempty"`
+	SysDescr    *Regexp  `yaml:"sys_descr,omitempty"`
+	Modules     []string `yaml:"modules"`
+}
+
+// Traps configures how received traps and informs are handled.
+type Traps struct {
+	// Auths whose communities and users are accepted, all auths if empty.
+	Auths []string `yaml:"auths,omitempty"`
+	// Modules whose metrics decode the variables of traps, all modules if empty.
+	Modules []string `yaml:"modules,omitempty"`
+	// Names of trap OIDs, in addition to the standard SNMPv2 traps.
+	Names map[string]string `yaml:"names,omitempty"`
+	// Where the alerts raised for traps are sent.
+	Alertmanager *Alertmanager `yaml:"alertmanager,omitempty"`
+	Alerts       []*TrapAlert  `yaml:"alerts,omitempty"`
+}
+
+// Alertmanager is an Alertmanager that alerts are posted to, using its v2 API.
+type Alertmanager struct {
+	URL string `yaml:"url"`
+	// How often a failed delivery is retried.
+	Retries int           `yaml:"retries,omitempty"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+func (c *Alertmanager) UnmarshalYAML(unmarshal func(any) error) error {
+	*c = DefaultAlertmanager
+	type plain Alertmanager
+	return unmarshal((*plain)(c))
+}
+
+// TrapAlert raises an alert when a trap is received. Its labels and
+// annotations are templates, executed with the received trap.
+type TrapAlert struct {
+	Alert   string `yaml:"alert"`
+	TrapOID string `yaml:"trap_oid"`
+	// A trap that resolves the alert with the same labels.
+	ClearOID string `yaml:"clear_oid,omitempty"`
+	// The alert resolves by itself after this long.
+	TTL         time.Duration     `yaml:"ttl,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// Target is a statically configured device, scraped by using its name as the
+// target parameter.
+type Target struct {
+	// Address of the device, defaults to the name of the target.
+	Address      string            `yaml:"address,omitempty"`
+	Auth         string            `yaml:"auth,omitempty"`
+	Modules      []string          `yaml:"modules,omitempty"`
+	SNMPContext  string            `yaml:"snmp_context,omitempty"`
+	SNMPEngineID string            `yaml:"snmp_engineid,omitempty"`
+	Labels       map[string]string `yaml:"labels,omitempty"`
+	// If set, the target is scraped in the background at this interval and
+	// requests are served from the last results.
+	PollInterval time.Duration `yaml:"poll_interval,omitempty"`
+}
+
+// validateAuthChains checks that auth chains only reference known auths
+// without chains of their own.
+func (c *Config) validateAuthChains() error {
+	for name, a := range c.Auths {
+		for _, other := range a.Chain {
+			chained, ok := c.Auths[other]
+			if !ok {
+				return fmt.Errorf("auth %q chains unknown auth %q", name, other)
+			}
+			if len(chained.Chain) > 0 {
+				return fmt.Errorf("auth %q chains auth %q, which has a chain itself", name, other)
+			}
+		}
+	}
+	return nil
+}
+
+var labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// reservedLabels are the label names the exporter puts on the series of
+// targets itself, which the labels of targets can't use.
+var reservedLabels = map[string]bool{
+	// Batch requests label the series of each target.
+	"target":   true,
+	"instance": true,
+	// The scrape, subtree and engine metrics.
+	"module":    true,
+	"auth":      true,
+	"reason":    true,
+	"kind":      true,
+	"oid":       true,
+	"name":      true,
+	"engine_id": true,
+}
+
+// validateTargets checks that targets only reference known auths and modules.
+func (c *Config) validateTargets() error {
+	for name, t := range c.Targets {
+		if t == nil {
+			return fmt.Errorf("target %q is empty", name)
+		}
+		if t.Auth != "" {
+			if _, ok := c.Auths[t.Auth]; !ok {
+				return fmt.Errorf("target %q references unknown auth %q", name, t.Auth)
+			}
+		}
+		for _, m := range t.Modules {
+			if _, ok := c.Modules[m]; !ok {
+				return fmt.Errorf("target %q references unknown module %q", name, m)
+			}
+		}
+		if t.PollInterval < 0 {
+			return fmt.Errorf("target %q has negative poll_interval", name)
+		}
+		if t.SNMPEngineID != "" {
+			if _, err := hex.DecodeString(t.SNMPEngineID); err != nil {
+				return fmt.Errorf("target %q has invalid snmp_engineid: %w", name, err)
+			}
+		}
+		for l := range t.Labels {
+			if !labelNameRE.MatchString(l) || strings.HasPrefix(l, "__") {
+				return fmt.Errorf("target %q has invalid label name %q", name, l)
+			}
+			if reservedLabels[l] {
+				return fmt.Errorf("target %q has label %q, which the exporter sets itself", name, l)
+			}
+		}
+	}
+	return nil
+}
+
+var oidRE = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+
+// validateTraps checks that the trap settings only reference known auths and
+// modules.
+func (c *Config) validateTraps() error {
+	for _, a := range c.Traps.Auths {
+		if _, ok := c.Auths[a]; !ok {
+			return fmt.Errorf("traps reference unknown auth %q", a)
+		}
+	}
+	for _, m := range c.Traps.Modules {
+		if _, ok := c.Modules[m]; !ok {
+			return fmt.Errorf("traps reference unknown module %q", m)
+		}
+	}
+	for oid := range c.Traps.Names {
+		if !oidRE.MatchString(oid) {
+			return fmt.Errorf("trap name for invalid oid %q", oid)
+		}
+	}
+	if len(c.Traps.Alerts) > 0 && c.Traps.Alertmanager == nil {
+		return fmt.Errorf("trap alerts require an alertmanager")
+	}
+	if am := c.Traps.Alertmanager; am != nil {
+		if u, err := url.Parse(am.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid alertmanager url %q", am.URL)
+		}
+		if am.Retries < 0 || am.Timeout <= 0 {
+			return fmt.Errorf("alertmanager retries and timeout must be positive")
+		}
+	}
+	for _, a := range c.Traps.Alerts {
+		if a == nil || !labelNameRE.MatchString(a.Alert) {
+			return fmt.Errorf("trap alert has invalid name")
+		}
+		if !oidRE.MatchString(a.TrapOID) {
+			return fmt.Errorf("trap alert %q has invalid trap_oid %q", a.Alert, a.TrapOID)
+		}
+		if a.ClearOID != "" && !oidRE.MatchString(a.ClearOID) {
+			return fmt.Errorf("trap alert %q has invalid clear_oid %q", a.Alert, a.ClearOID)
+		}
+		if a.ClearOID == "" && a.TTL <= 0 {
+			// Nothing would ever resolve it.
+			return fmt.Errorf("trap alert %q needs a clear_oid or a ttl", a.Alert)
+		}
+		for name, text := range a.Labels {
+			if !labelNameRE.MatchString(name) || name == "alertname" {
+				return fmt.Errorf("trap alert %q has invalid label name %q", a.Alert, name)
+			}
+			if _, err := template.New(name).Option("missingkey=zero").Parse(text); err != nil {
+				return fmt.Errorf("trap alert %q has invalid template for label %q: %w", a.Alert, name, err)
+			}
+		}
+		for name, text := range a.Annotations {
+			if _, err := template.New(name).Option("missingkey=zero").Parse(text); err != nil {
+				return fmt.Errorf("trap alert %q has invalid template for annotation %q: %w", a.Alert, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateModuleSelection checks that the module selection rules only
+// reference known modules.
+func (c *Config) validateModuleSelection() error {
+	if c.ModuleSelection == nil {
+		return nil
+	}
+	if c.ModuleSelection.CacheTTL <= 0 {
+		return fmt.Errorf("module selection cache_ttl must be positive")
+	}
+	for i, r := range c.ModuleSelection.Rules {
+		if r == nil || len(r.Modules) == 0 {
+			return fmt.Errorf("module selection rule %d has no modules", i)
+		}
+		if r.SysObjectID != "" && !oidRE.MatchString(strings.TrimPrefix(r.SysObjectID, ".")) {
+			return fmt.Errorf("module selection rule %d has invalid sys_object_id %q", i, r.SysObjectID)
+		}
+		for _, m := range r.Modules {
+			if _, ok := c.Modules[m]; !ok {
+				return fmt.Errorf("module selection rule %d references unknown module %q", i, m)
+			}
+		}
+	}
+	return nil
 }
 
 type WalkParams struct {
@@ -136,6 +483,9 @@ type Module struct {
 	Metrics    []*Metric       `yaml:"metrics"`
 	WalkParams WalkParams      `yaml:",inline"`
 	Filters    []DynamicFilter `yaml:"filters,omitempty"`
+	// Fail the whole module if any walk or get fails, rather than
+	// returning the results of the others.
+	Required bool `yaml:"required,omitempty"`
 }
 
 func (c *Module) UnmarshalYAML(unmarshal func(any) error) error {
@@ -233,6 +583,51 @@ type DynamicFilter struct {
 	Oid     string   `yaml:"oid"`
 	Targets []string `yaml:"targets,omitempty"`
 	Values  []string `yaml:"values,omitempty"`
+
+	// Values compiled when the configuration is loaded.
+	regexps []*regexp.Regexp
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *DynamicFilter) UnmarshalYAML(unmarshal func(any) error) error {
+	type plain DynamicFilter
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	return c.Compile()
+}
+
+// Compile compiles the values of the filter, unless they already are.
+// Filters loaded from a file are compiled as they are loaded.
+func (c *DynamicFilter) Compile() error {
+	if c.compiled() {
+		return nil
+	}
+	regexps := make([]*regexp.Regexp, 0, len(c.Values))
+	for _, v := range c.Values {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return fmt.Errorf("invalid value %q in filter for oid %s: %w", v, c.Oid, err)
+		}
+		regexps = append(regexps, re)
+	}
+	c.regexps = regexps
+	return nil
+}
+
+func (c DynamicFilter) compiled() bool {
+	return c.regexps != nil && len(c.regexps) == len(c.Values)
+}
+
+// Matches reports whether the value matches any of the filter's values. The
+// filter must have been compiled, otherwise nothing matches.
+func (c DynamicFilter) Matches(value string) bool {
+	for _, re := range c.regexps {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
 }
 
 type Metric struct {
@@ -274,6 +669,22 @@ func (s *Secret) Set(value string) {
 	*s = Secret(value)
 }
 
+// UnmarshalYAML implements the yaml.Unmarshaler interface. A secret can also
+// reference a secret of a secret provider, which is kept by its auth.
+func (s *Secret) UnmarshalYAML(unmarshal func(any) error) error {
+	var value string
+	if err := unmarshal(&value); err == nil {
+		*s = Secret(value)
+		return nil
+	}
+	var ref SecretRef
+	if err := unmarshal(&ref); err != nil {
+		return err
+	}
+	*s = ""
+	return nil
+}
+
 // Hack for creating snmp.yml with the secret.
 var (
 	DoNotHideSecrets = false
@@ -296,6 +707,27 @@ func (c *Auth) UnmarshalYAML(unmarshal func(any) error) error {
 	if err := unmarshal((*plain)(c)); err != nil {
 		return err
 	}
+	if err := c.unmarshalSecretRefs(unmarshal); err != nil {
+		return err
+	}
+	_, communityRef := c.secretRefs["community"]
+	_, passwordRef := c.secretRefs["password"]
+	_, privPasswordRef := c.secretRefs["priv_password"]
+
+	for _, f := range []struct {
+		name     string
+		set      bool
+		fromFile string
+	}{
+		{"community", c.Community != DefaultAuth.Community || communityRef, c.CommunityFile},
+		{"password", c.Password != "" || passwordRef, c.PasswordFile},
+		{"priv_password", c.PrivPassword != "" || privPasswordRef, c.PrivPasswordFile},
+		{"context_name", c.ContextName != "", c.ContextNameFile},
+	} {
+		if f.set && f.fromFile != "" {
+			return fmt.Errorf("at most one of %s and %s_file must be set", f.name, f.name)
+		}
+	}
 
 	if c.Version < 1 || c.Version > 3 {
 		return fmt.Errorf("SNMP version must be 1, 2 or 3. Got: %d", c.Version)
@@ -303,7 +735,7 @@ func (c *Auth) UnmarshalYAML(unmarshal func(any) error) error {
 	if c.Version == 3 {
 		switch c.SecurityLevel {
 		case "authPriv":
-			if c.PrivPassword == "" {
+			if c.PrivPassword == "" && c.PrivPasswordFile == "" && !privPasswordRef && !c.HasKeys() {
 				return fmt.Errorf("priv password is missing, required for SNMPv3 with priv")
 			}
 			if c.PrivProtocol != "DES" && c.PrivProtocol != "AES" && c.PrivProtocol != "AES192" && c.PrivProtocol != "AES192C" && c.PrivProtocol != "AES256" && c.PrivProtocol != "AES256C" {
@@ -311,7 +743,7 @@ func (c *Auth) UnmarshalYAML(unmarshal func(any) error) error {
 			}
 			fallthrough
 		case "authNoPriv":
-			if c.Password == "" {
+			if c.Password == "" && c.PasswordFile == "" && !passwordRef && !c.HasKeys() {
 				return fmt.Errorf("auth password is missing, required for SNMPv3 with auth")
 			}
 			if c.AuthProtocol != "MD5" && c.AuthProtocol != "SHA" && c.AuthProtocol != "SHA224" && c.AuthProtocol != "SHA256" && c.AuthProtocol != "SHA384" && c.AuthProtocol != "SHA512" {
@@ -326,7 +758,7 @@ func (c *Auth) UnmarshalYAML(unmarshal func(any) error) error {
 			return fmt.Errorf("security level must be one of authPriv, authNoPriv or noAuthNoPriv")
 		}
 	}
-	return nil
+	return c.validateKeys()
 }
 
 type RegexpExtract struct {
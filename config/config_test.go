@@ -15,6 +15,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"go.yaml.in/yaml/v2"
 )
@@ -56,3 +57,147 @@ modules:
 		t.Error("BUG: module1 and module2 share the same Retries pointer!")
 	}
 }
+
+func TestDynamicFilterCompiledOnLoad(t *testing.T) {
+	content := `
+modules:
+  module1:
+    filters:
+      - oid: 1.3.6.1.2.1.2.2.1.7
+        targets: ["1.3.6.1.2.1.2.2.1.2"]
+        values: ["^1$", "up"]
+`
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict([]byte(content), cfg); err != nil {
+		t.Fatalf("Error unmarshaling content: %v", err)
+	}
+	filter := cfg.Modules["module1"].Filters[0]
+	if len(filter.regexps) != 2 {
+		t.Fatalf("expected 2 compiled values, got %d", len(filter.regexps))
+	}
+	if !filter.Matches("1") || !filter.Matches("is up") || filter.Matches("2") {
+		t.Error("filter values matched unexpectedly")
+	}
+
+	invalid := `
+modules:
+  module1:
+    filters:
+      - oid: 1.3.6.1.2.1.2.2.1.7
+        values: ["("]
+`
+	if err := yaml.UnmarshalStrict([]byte(invalid), &Config{}); err == nil {
+		t.Error("expected error for invalid filter value, got none")
+	}
+}
+
+func TestValidateTargetLabels(t *testing.T) {
+	// The labels the exporter sets itself, and invalid names.
+	for _, label := range []string{
+		"target", "instance", "module", "auth", "reason", "kind", "oid", "name", "engine_id",
+		"__name__", "1site", "site-name",
+	} {
+		cfg := &Config{Targets: map[string]*Target{"core1": {Labels: map[string]string{label: "x"}}}}
+		if err := cfg.validateTargets(); err == nil {
+			t.Errorf("expected error for label %q", label)
+		}
+	}
+	cfg := &Config{Targets: map[string]*Target{"core1": {Labels: map[string]string{"site": "ams1"}}}}
+	if err := cfg.validateTargets(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateTraps(t *testing.T) {
+	cfg := &Config{
+		Auths:   map[string]*Auth{"public_v2": {}},
+		Modules: map[string]*Module{"if_mib": {}},
+	}
+	for _, traps := range []Traps{
+		{Auths: []string{"nope"}},
+		{Modules: []string{"nope"}},
+		{Names: map[string]string{"1.3.6.x": "nope"}},
+	} {
+		cfg.Traps = traps
+		if err := cfg.validateTraps(); err == nil {
+			t.Errorf("expected error for %+v", traps)
+		}
+	}
+	cfg.Traps = Traps{Auths: []string{"public_v2"}, Modules: []string{"if_mib"}, Names: map[string]string{"1.3.6.1.4.1.9.9.117.2.0.2": "cefcPowerStatusChange"}}
+	if err := cfg.validateTraps(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateTrapAlerts(t *testing.T) {
+	am := &Alertmanager{URL: "http://alertmanager:9093", Retries: 3, Timeout: time.Second}
+	for _, traps := range []Traps{
+		{Alerts: []*TrapAlert{{Alert: "LinkDown", TrapOID: "1.3.6.1.6.3.1.1.5.3", TTL: time.Hour}}},
+		{Alertmanager: &Alertmanager{URL: "alertmanager", Timeout: time.Second}},
+		{Alertmanager: am, Alerts: []*TrapAlert{{Alert: "LinkDown", TrapOID: "1.3.6.1.6.3.1.1.5.3"}}},
+		{Alertmanager: am, Alerts: []*TrapAlert{{Alert: "LinkDown", TrapOID: "1.3.6.1.6.3.1.1.5.3", TTL: time.Hour, Labels: map[string]string{"interface": "{{ .Labels.ifDescr"}}}},
+	} {
+		cfg := &Config{Traps: traps}
+		if err := cfg.validateTraps(); err == nil {
+			t.Errorf("expected error for %+v", traps)
+		}
+	}
+}
+
+func TestAlertmanagerDefaults(t *testing.T) {
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict([]byte("traps:\n  alertmanager:\n    url: http://alertmanager:9093\n"), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if *cfg.Traps.Alertmanager != (Alertmanager{URL: "http://alertmanager:9093", Retries: 3, Timeout: 10 * time.Second}) {
+		t.Errorf("unexpected alertmanager %+v", cfg.Traps.Alertmanager)
+	}
+}
+
+func TestValidateModuleSelection(t *testing.T) {
+	cfg := &Config{Modules: map[string]*Module{"if_mib": {}}}
+	for _, selection := range []*ModuleSelection{
+		{Rules: []*ModuleSelectionRule{{Modules: []string{"if_mib"}}}},
+		{CacheTTL: time.Hour, Rules: []*ModuleSelectionRule{{SysObjectID: "1.3.6.1.4.1.9"}}},
+		{CacheTTL: time.Hour, Rules: []*ModuleSelectionRule{{Modules: []string{"nope"}}}},
+		{CacheTTL: time.Hour, Rules: []*ModuleSelectionRule{{SysObjectID: "1.3.6.x", Modules: []string{"if_mib"}}}},
+	} {
+		cfg.ModuleSelection = selection
+		if err := cfg.validateModuleSelection(); err == nil {
+			t.Errorf("expected error for %+v", selection)
+		}
+	}
+	cfg.ModuleSelection = &ModuleSelection{CacheTTL: time.Hour, Rules: []*ModuleSelectionRule{{SysObjectID: ".1.3.6.1.4.1.9", Modules: []string{"if_mib"}}}}
+	if err := cfg.validateModuleSelection(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestModuleSelectionDefaults(t *testing.T) {
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict([]byte("module_selection:\n  rules:\n  - sys_descr: Cisco.*\n    modules: [if_mib]\n"), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ModuleSelection.CacheTTL != time.Hour {
+		t.Errorf("unexpected cache_ttl %s", cfg.ModuleSelection.CacheTTL)
+	}
+	if re := cfg.ModuleSelection.Rules[0].SysDescr; !re.MatchString("Cisco IOS") || re.MatchString("Juniper, Cisco compatible") {
+		t.Errorf("unexpected sys_descr matching for %s", re)
+	}
+}
+
+func TestValidateAuthChains(t *testing.T) {
+	for _, auths := range []map[string]*Auth{
+		{"migrating": {Chain: []string{"nope"}}},
+		{"migrating": {Chain: []string{"other"}}, "other": {Chain: []string{"public_v2"}}, "public_v2": {}},
+	} {
+		cfg := &Config{Auths: auths}
+		if err := cfg.validateAuthChains(); err == nil {
+			t.Errorf("expected error for %+v", auths)
+		}
+	}
+	cfg := &Config{Auths: map[string]*Auth{"migrating": {Chain: []string{"my_v3", "public_v2"}}, "my_v3": {}, "public_v2": {}}}
+	if err := cfg.validateAuthChains(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// LocalizedKeys are the SNMPv3 keys of a user localized to an engine ID, as
+// described in RFC 3414.
+type LocalizedKeys struct {
+	AuthKey Secret `yaml:"auth_key,omitempty"`
+	PrivKey Secret `yaml:"priv_key,omitempty"`
+}
+
+// authHashes are the hash functions of the auth protocols.
+var authHashes = map[string]func() hash.Hash{
+	"MD5":    md5.New,
+	"SHA":    sha1.New,
+	"SHA224": sha256.New224,
+	"SHA256": sha256.New,
+	"SHA384": sha512.New384,
+	"SHA512": sha512.New,
+}
+
+// privKeyLengths are the lengths of the localized keys of the priv protocols.
+var privKeyLengths = map[string]int{
+	"DES":     16,
+	"AES":     16,
+	"AES192":  24,
+	"AES192C": 24,
+	"AES256":  32,
+	"AES256C": 32,
+}
+
+// HasKeys reports whether the auth has keys rather than passwords.
+func (c Auth) HasKeys() bool {
+	return c.AuthKey != "" || c.PrivKey != "" || len(c.LocalizedKeys) > 0
+}
+
+// decodeKey decodes a key or engine ID in hex, with an optional 0x prefix.
+func decodeKey(key string) ([]byte, error) {
+	return hex.DecodeString(strings.TrimPrefix(strings.ToLower(key), "0x"))
+}
+
+// validateKeys checks that the keys of an auth match its protocols, and
+// normalizes the engine IDs of its localized keys.
+func (c *Auth) validateKeys() error {
+	if !c.HasKeys() {
+		return nil
+	}
+	if c.Version != 3 || c.SecurityLevel == "noAuthNoPriv" {
+		return errors.New("auth_key, priv_key and localized_keys require SNMPv3 with auth")
+	}
+	_, passwordRef := c.secretRefs["password"]
+	_, privPasswordRef := c.secretRefs["priv_password"]
+	if c.Password != "" || c.PasswordFile != "" || passwordRef || c.PrivPassword != "" || c.PrivPasswordFile != "" || privPasswordRef {
+		return errors.New("passwords can't be set together with auth_key, priv_key or localized_keys")
+	}
+	hashLen := authHashes[c.AuthProtocol]().Size()
+	priv := c.SecurityLevel == "authPriv"
+	if c.AuthKey != "" || c.PrivKey != "" {
+		// Master keys are derived from the passwords with the hash of the
+		// auth protocol, whatever the priv protocol.
+		if err := checkKeys(c.AuthKey, c.PrivKey, hashLen, hashLen, priv); err != nil {
+			return fmt.Errorf("master keys: %w", err)
+		}
+	}
+	if c.LocalizedKeys == nil {
+		return nil
+	}
+	localized := make(map[string]LocalizedKeys, len(c.LocalizedKeys))
+	for engineID, keys := range c.LocalizedKeys {
+		id, err := decodeKey(engineID)
+		if err != nil || len(id) < 5 || len(id) > 32 {
+			return fmt.Errorf("engine ID %q of localized keys must be 5 to 32 bytes in hex", engineID)
+		}
+		normalized := hex.EncodeToString(id)
+		if _, ok := localized[normalized]; ok {
+			return fmt.Errorf("engine ID %q has localized keys more than once", engineID)
+		}
+		if err := checkKeys(keys.AuthKey, keys.PrivKey, hashLen, privKeyLengths[c.PrivProtocol], priv); err != nil {
+			return fmt.Errorf("localized keys of engine ID %q: %w", engineID, err)
+		}
+		localized[normalized] = keys
+	}
+	c.LocalizedKeys = localized
+	return nil
+}
+
+// checkKeys checks that keys are set when the security level needs them, and
+// have the expected lengths.
+func checkKeys(authKey, privKey Secret, authLen, privLen int, priv bool) error {
+	if authKey == "" {
+		return errors.New("auth_key is missing, required for SNMPv3 with auth")
+	}
+	if key, err := decodeKey(string(authKey)); err != nil || len(key) != authLen {
+		return fmt.Errorf("auth_key must be %d bytes in hex for the auth protocol", authLen)
+	}
+	if !priv {
+		if privKey != "" {
+			return errors.New("priv_key is only used for SNMPv3 with priv")
+		}
+		return nil
+	}
+	if privKey == "" {
+		return errors.New("priv_key is missing, required for SNMPv3 with priv")
+	}
+	if key, err := decodeKey(string(privKey)); err != nil || len(key) != privLen {
+		return fmt.Errorf("priv_key must be %d bytes in hex for the protocols", privLen)
+	}
+	return nil
+}
+
+// LocalizeKeys sets the authoritative engine ID of the SNMPv3 security
+// parameters of the auth. If the auth has keys rather than passwords, its
+// keys localized to the engine ID are set as well, as gosnmp can only derive
+// them from passwords.
+func (c Auth) LocalizeKeys(usm *gosnmp.UsmSecurityParameters, engineID string) error {
+	usm.AuthoritativeEngineID = engineID
+	if !c.HasKeys() {
+		return nil
+	}
+	if keys, ok := c.LocalizedKeys[hex.EncodeToString([]byte(engineID))]; ok {
+		authKey, err := decodeKey(string(keys.AuthKey))
+		if err != nil {
+			return fmt.Errorf("error decoding auth_key: %w", err)
+		}
+		privKey, err := decodeKey(string(keys.PrivKey))
+		if err != nil {
+			return fmt.Errorf("error decoding priv_key: %w", err)
+		}
+		usm.SecretKey, usm.PrivacyKey = authKey, privKey
+		return nil
+	}
+	if c.AuthKey == "" {
+		return fmt.Errorf("no localized keys for engine ID %x", engineID)
+	}
+	newHash, ok := authHashes[c.AuthProtocol]
+	if !ok {
+		return fmt.Errorf("unknown auth protocol %q", c.AuthProtocol)
+	}
+	authKey, err := decodeKey(string(c.AuthKey))
+	if err != nil {
+		return fmt.Errorf("error decoding auth_key: %w", err)
+	}
+	usm.SecretKey = localizeKey(newHash, authKey, engineID)
+	usm.PrivacyKey = nil
+	if c.PrivKey != "" {
+		privKey, err := decodeKey(string(c.PrivKey))
+		if err != nil {
+			return fmt.Errorf("error decoding priv_key: %w", err)
+		}
+		usm.PrivacyKey = localizePrivKey(newHash, c.PrivProtocol, privKey, engineID)
+	}
+	return nil
+}
+
+// localizeKey localizes a master key to an engine ID, as described in
+// RFC 3414 section 2.6.
+func localizeKey(newHash func() hash.Hash, key []byte, engineID string) []byte {
+	h := newHash()
+	h.Write(key)
+	h.Write([]byte(engineID))
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+// localizePrivKey localizes a master priv key to an engine ID, extending it
+// the way gosnmp does when the priv protocol needs a longer key than the
+// hash of the auth protocol.
+func localizePrivKey(newHash func() hash.Hash, protocol string, key []byte, engineID string) []byte {
+	localized := localizeKey(newHash, key, engineID)
+	length, ok := privKeyLengths[protocol]
+	if !ok {
+		return localized
+	}
+	if len(localized) < length {
+		switch protocol {
+		case "AES192C", "AES256C":
+			// The extension of draft-reeder-snmpv3-usm-3desede, used by Cisco.
+			localized = append(localized, localizeKey(newHash, passwordToKey(newHash, localized), engineID)...)
+		default:
+			// The extension of draft-blumenthal-aes-usm-04.
+			h := newHash()
+			h.Write(localized)
+			localized = h.Sum(localized)
+		}
+	}
+	return localized[:length]
+}
+
+// passwordToKey derives the master key of a password, as described in
+// RFC 3414 appendix A.2.
+func passwordToKey(newHash func() hash.Hash, password []byte) []byte {
+	h := newHash()
+	chunk := make([]byte, 64)
+	for i := 0; i < 1048576; i += len(chunk) {
+		for j := range chunk {
+			chunk[j] = password[(i+j)%len(password)]
+		}
+		h.Write(chunk)
+	}
+	return h.Sum(nil)
+}
@@ -0,0 +1,189 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"go.yaml.in/yaml/v2"
+)
+
+func TestLocalizeKeysRFC3414(t *testing.T) {
+	// The examples of RFC 3414 appendix A.3.
+	engineID := string([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2})
+	for _, tc := range []struct {
+		protocol  string
+		master    string
+		localized string
+	}{
+		{"MD5", "9faf3283884e92834ebc9847d8edd963", "526f5eed9fcce26f8964c2930787d82b"},
+		{"SHA", "9fb5cc0381497b3793528939ff788d5d79145211", "6695febc9288e36282235fc7151f128497b38f3f"},
+	} {
+		t.Run(tc.protocol, func(t *testing.T) {
+			if got := hex.EncodeToString(passwordToKey(authHashes[tc.protocol], []byte("maplesyrup"))); got != tc.master {
+				t.Fatalf("expected master key %s, got %s", tc.master, got)
+			}
+			auth := Auth{Version: 3, SecurityLevel: "authNoPriv", AuthProtocol: tc.protocol, AuthKey: Secret(tc.master)}
+			usm := &gosnmp.UsmSecurityParameters{}
+			if err := auth.LocalizeKeys(usm, engineID); err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(usm.SecretKey); got != tc.localized {
+				t.Fatalf("expected localized key %s, got %s", tc.localized, got)
+			}
+		})
+	}
+}
+
+func TestLocalizeKeysMatchesPasswords(t *testing.T) {
+	engineID := string([]byte{0x80, 0x00, 0x1f, 0x88, 0x04, 0x73, 0x6e, 0x6d, 0x70})
+	for authProtocol, newHash := range authHashes {
+		for privProtocol, length := range privKeyLengths {
+			t.Run(authProtocol+"/"+privProtocol, func(t *testing.T) {
+				passwords := Auth{
+					Version: 3, SecurityLevel: "authPriv", Username: "admin",
+					AuthProtocol: authProtocol, Password: "maplesyrup",
+					PrivProtocol: privProtocol, PrivPassword: "pancakes",
+				}
+				g := &gosnmp.GoSNMP{}
+				passwords.ConfigureSNMP(g, "")
+				want := g.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+				want.AuthoritativeEngineID = engineID
+				if err := want.InitSecurityKeys(); err != nil {
+					t.Fatal(err)
+				}
+
+				keys := passwords
+				keys.Password, keys.PrivPassword = "", ""
+				keys.AuthKey = Secret(hex.EncodeToString(passwordToKey(newHash, []byte("maplesyrup"))))
+				keys.PrivKey = Secret(hex.EncodeToString(passwordToKey(newHash, []byte("pancakes"))))
+				g = &gosnmp.GoSNMP{}
+				keys.ConfigureSNMP(g, "")
+				got := g.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+				if err := keys.LocalizeKeys(got, engineID); err != nil {
+					t.Fatal(err)
+				}
+				if hex.EncodeToString(got.SecretKey) != hex.EncodeToString(want.SecretKey) {
+					t.Errorf("expected auth key %x, got %x", want.SecretKey, got.SecretKey)
+				}
+				// gosnmp only uses the start of longer DES keys.
+				if hex.EncodeToString(got.PrivacyKey) != hex.EncodeToString(want.PrivacyKey[:length]) {
+					t.Errorf("expected priv key %x, got %x", want.PrivacyKey[:length], got.PrivacyKey)
+				}
+			})
+		}
+	}
+}
+
+func TestLocalizedKeys(t *testing.T) {
+	md5Key := strings.Repeat("11", md5.Size)
+	shaKey := strings.Repeat("22", sha1.Size)
+	content := `
+version: 3
+security_level: authPriv
+username: admin
+auth_protocol: SHA
+priv_protocol: AES
+auth_key: 0x` + shaKey + `
+priv_key: ` + shaKey + `
+localized_keys:
+  0x80001F8804736E6D70:
+    auth_key: ` + shaKey + `
+    priv_key: ` + md5Key + `
+`
+	auth := &Auth{}
+	if err := yaml.UnmarshalStrict([]byte(content), auth); err != nil {
+		t.Fatal(err)
+	}
+	// The localized keys of an engine ID are used as they are.
+	usm := &gosnmp.UsmSecurityParameters{}
+	if err := auth.LocalizeKeys(usm, string([]byte{0x80, 0x00, 0x1f, 0x88, 0x04, 0x73, 0x6e, 0x6d, 0x70})); err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(usm.SecretKey) != shaKey || hex.EncodeToString(usm.PrivacyKey) != md5Key {
+		t.Errorf("expected the localized keys, got %x and %x", usm.SecretKey, usm.PrivacyKey)
+	}
+	// The master keys are localized to other engine IDs.
+	usm = &gosnmp.UsmSecurityParameters{}
+	if err := auth.LocalizeKeys(usm, "\x80\x00\x00\x00\x05other"); err != nil {
+		t.Fatal(err)
+	}
+	if len(usm.SecretKey) != sha1.Size || len(usm.PrivacyKey) != 16 || hex.EncodeToString(usm.SecretKey) == shaKey {
+		t.Errorf("expected keys localized from the master keys, got %x and %x", usm.SecretKey, usm.PrivacyKey)
+	}
+
+	// Without master keys, only the engine IDs with localized keys work.
+	auth.AuthKey, auth.PrivKey = "", ""
+	if err := auth.LocalizeKeys(&gosnmp.UsmSecurityParameters{}, "\x80\x00\x00\x00\x05other"); err == nil {
+		t.Error("expected error for an engine ID without localized keys, got none")
+	}
+}
+
+func TestKeysInvalid(t *testing.T) {
+	shaKey := strings.Repeat("22", sha1.Size)
+	v3 := "version: 3\nusername: admin\nauth_protocol: SHA\npriv_protocol: AES\n"
+	for name, tc := range map[string]struct {
+		content string
+		err     string
+	}{
+		"v2": {
+			"version: 2\nauth_key: " + shaKey + "\n",
+			"require SNMPv3 with auth",
+		},
+		"with password": {
+			v3 + "security_level: authNoPriv\nauth_key: " + shaKey + "\npassword: maplesyrup\n",
+			"passwords can't be set together",
+		},
+		"not hex": {
+			v3 + "security_level: authNoPriv\nauth_key: maplesyrup\n",
+			"auth_key must be 20 bytes in hex",
+		},
+		"wrong length": {
+			v3 + "security_level: authNoPriv\nauth_key: " + shaKey[2:] + "\n",
+			"auth_key must be 20 bytes in hex",
+		},
+		"missing priv key": {
+			v3 + "security_level: authPriv\nauth_key: " + shaKey + "\n",
+			"priv_key is missing",
+		},
+		"unused priv key": {
+			v3 + "security_level: authNoPriv\nauth_key: " + shaKey + "\npriv_key: " + shaKey + "\n",
+			"priv_key is only used",
+		},
+		"localized priv key length": {
+			v3 + "security_level: authPriv\nlocalized_keys:\n  80001f8804736e6d70:\n    auth_key: " + shaKey + "\n    priv_key: " + shaKey + "\n",
+			"priv_key must be 16 bytes in hex",
+		},
+		"invalid engine ID": {
+			v3 + "security_level: authNoPriv\nlocalized_keys:\n  8000:\n    auth_key: " + shaKey + "\n",
+			"5 to 32 bytes",
+		},
+		"duplicate engine ID": {
+			v3 + "security_level: authNoPriv\nlocalized_keys:\n  80001f8804736e6d70:\n    auth_key: " + shaKey + "\n  0x80001F8804736E6D70:\n    auth_key: " + shaKey + "\n",
+			"more than once",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := yaml.UnmarshalStrict([]byte(tc.content), &Auth{})
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"go.yaml.in/yaml/v2"
+)
+
+var DefaultSecretProvider = SecretProvider{
+	TTL:     5 * time.Minute,
+	Timeout: 10 * time.Second,
+}
+
+// SecretFetcher fetches the secret stored under a key.
+type SecretFetcher interface {
+	Fetch(ctx context.Context, key string) (string, error)
+}
+
+// SecretProvider fetches secrets at runtime, with exactly one of its
+// fetchers, and caches them.
+type SecretProvider struct {
+	Exec *ExecSecretProvider `yaml:"exec,omitempty"`
+	HTTP *HTTPSecretProvider `yaml:"http,omitempty"`
+	// How long fetched secrets are used for before they are fetched again.
+	TTL     time.Duration `yaml:"ttl,omitempty"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// Only set for providers loaded from a file.
+	cache *secretCache
+}
+
+type secretCache struct {
+	mu      sync.Mutex
+	secrets map[string]cachedSecret
+}
+
+type cachedSecret struct {
+	value   string
+	expires time.Time
+}
+
+func (c *SecretProvider) UnmarshalYAML(unmarshal func(any) error) error {
+	*c = DefaultSecretProvider
+	type plain SecretProvider
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if (c.Exec == nil) == (c.HTTP == nil) {
+		return fmt.Errorf("secret provider must have exactly one of exec and http")
+	}
+	if c.TTL < 0 || c.Timeout <= 0 {
+		return fmt.Errorf("secret provider ttl and timeout must be positive")
+	}
+	c.cache = &secretCache{secrets: map[string]cachedSecret{}}
+	return nil
+}
+
+func (c *SecretProvider) fetcher() SecretFetcher {
+	if c.Exec != nil {
+		return c.Exec
+	}
+	return c.HTTP
+}
+
+// Fetch implements SecretFetcher, returning cached secrets until they expire.
+func (c *SecretProvider) Fetch(ctx context.Context, key string) (string, error) {
+	if c.cache != nil {
+		c.cache.mu.Lock()
+		cached, ok := c.cache.secrets[key]
+		c.cache.mu.Unlock()
+		if ok && time.Now().Before(cached.expires) {
+			return cached.value, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	value, err := c.fetcher().Fetch(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if c.cache != nil {
+		c.cache.mu.Lock()
+		c.cache.secrets[key] = cachedSecret{value: value, expires: time.Now().Add(c.TTL)}
+		c.cache.mu.Unlock()
+	}
+	return value, nil
+}
+
+// ExecSecretProvider runs a command with the key as its last argument, and
+// uses what it writes to stdout as the secret.
+type ExecSecretProvider struct {
+	Command []string `yaml:"command"`
+}
+
+func (c *ExecSecretProvider) UnmarshalYAML(unmarshal func(any) error) error {
+	type plain ExecSecretProvider
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if len(c.Command) == 0 {
+		return fmt.Errorf("exec secret provider has no command")
+	}
+	return nil
+}
+
+// Fetch implements SecretFetcher.
+func (c *ExecSecretProvider) Fetch(ctx context.Context, key string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Command[0], append(c.Command[1:], key)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("error running secret command for key %q: %w: %s", key, err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(stdout.String(), "\r\n"), nil
+}
+
+// HTTPSecretProvider gets the secret of a key from URL/key, and uses the body
+// of the response as the secret.
+type HTTPSecretProvider struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]Secret `yaml:"headers,omitempty"`
+}
+
+func (c *HTTPSecretProvider) UnmarshalYAML(unmarshal func(any) error) error {
+	type plain HTTPSecretProvider
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if u, err := url.Parse(c.URL); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid http secret provider url %q", c.URL)
+	}
+	for name, value := range c.Headers {
+		if value == "" {
+			return fmt.Errorf("http secret provider header %q is empty", name)
+		}
+	}
+	return nil
+}
+
+// Fetch implements SecretFetcher.
+func (c *HTTPSecretProvider) Fetch(ctx context.Context, key string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(c.URL, "/")+"/"+url.PathEscape(key), http.NoBody)
+	if err != nil {
+		return "", err
+	}
+	for name, value := range c.Headers {
+		req.Header.Set(name, string(value))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error fetching secret %q: %w", key, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return "", fmt.Errorf("error fetching secret %q: %w", key, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error fetching secret %q: unexpected status %s", key, resp.Status)
+	}
+	return strings.TrimRight(string(body), "\r\n"), nil
+}
+
+// SecretRef references a secret of a secret provider.
+type SecretRef struct {
+	Provider string `yaml:"provider"`
+	Key      string `yaml:"key"`
+}
+
+// secretSettings are the settings of auths that can reference secrets of
+// secret providers.
+var secretSettings = []string{"community", "password", "priv_password"}
+
+// unmarshalSecretRefs finds the settings of an auth that reference secrets of
+// secret providers.
+func (c *Auth) unmarshalSecretRefs(unmarshal func(any) error) error {
+	var raw map[string]any
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	c.secretRefs = nil
+	for _, name := range secretSettings {
+		if _, ok := raw[name].(map[any]any); !ok {
+			continue
+		}
+		b, err := yaml.Marshal(raw[name])
+		if err != nil {
+			return err
+		}
+		var ref SecretRef
+		if err := yaml.UnmarshalStrict(b, &ref); err != nil {
+			return fmt.Errorf("invalid secret reference for %s: %w", name, err)
+		}
+		if ref.Provider == "" || ref.Key == "" {
+			return fmt.Errorf("secret reference for %s needs a provider and a key", name)
+		}
+		if c.secretRefs == nil {
+			c.secretRefs = map[string]SecretRef{}
+		}
+		c.secretRefs[name] = ref
+	}
+	return nil
+}
+
+// MarshalYAML implements the yaml.Marshaler interface, keeping the references
+// to secrets of secret providers.
+func (c Auth) MarshalYAML() (any, error) {
+	type plain Auth
+	if len(c.secretRefs) == 0 {
+		return plain(c), nil
+	}
+	b, err := yaml.Marshal(plain(c))
+	if err != nil {
+		return nil, err
+	}
+	var out yaml.MapSlice
+	if err := yaml.Unmarshal(b, &out); err != nil {
+		return nil, err
+	}
+	for _, name := range secretSettings {
+		if ref, ok := c.secretRefs[name]; ok {
+			out = append(out, yaml.MapItem{Key: name, Value: ref})
+		}
+	}
+	return out, nil
+}
+
+// ResolveSecrets returns a copy of the auth with the secrets it references
+// fetched from their secret providers. An auth without references is returned
+// as it is.
+func (c *Auth) ResolveSecrets(ctx context.Context) (*Auth, error) {
+	if len(c.secretRefs) == 0 {
+		return c, nil
+	}
+	resolved := *c
+	for name, ref := range c.secretRefs {
+		provider, ok := c.secretProviders[ref.Provider]
+		if !ok {
+			return nil, fmt.Errorf("unknown secret provider %q", ref.Provider)
+		}
+		value, err := provider.Fetch(ctx, ref.Key)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching %s from secret provider %q: %w", name, ref.Provider, err)
+		}
+		switch name {
+		case "community":
+			resolved.Community.Set(value)
+		case "password":
+			resolved.Password.Set(value)
+		case "priv_password":
+			resolved.PrivPassword.Set(value)
+		}
+	}
+	return &resolved, nil
+}
+
+// SecretTTL returns the shortest TTL of the secret providers the auth
+// references secrets of, and false if it references none.
+func (c *Auth) SecretTTL() (time.Duration, bool) {
+	var ttl time.Duration
+	found := false
+	for _, ref := range c.secretRefs {
+		provider, ok := c.secretProviders[ref.Provider]
+		if !ok {
+			continue
+		}
+		if !found || provider.TTL < ttl {
+			ttl = provider.TTL
+		}
+		found = true
+	}
+	return ttl, found
+}
+
+// validateSecretProviders checks that auths only reference known secret
+// providers, and gives the auths their providers.
+func (c *Config) validateSecretProviders() error {
+	for name, a := range c.Auths {
+		for _, setting := range secretSettings {
+			ref, ok := a.secretRefs[setting]
+			if !ok {
+				continue
+			}
+			if _, ok := c.SecretProviders[ref.Provider]; !ok {
+				return fmt.Errorf("auth %q references unknown secret provider %q", name, ref.Provider)
+			}
+		}
+		a.secretProviders = c.SecretProviders
+	}
+	return nil
+}
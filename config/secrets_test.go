@@ -0,0 +1,142 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/common/promslog"
+	"go.yaml.in/yaml/v2"
+)
+
+func TestSecretProviders(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Authorization") != "Bearer broker-token" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/secrets/snmp/core" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, "maplesyrup")
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	content := `
+secret_providers:
+  broker:
+    http:
+      url: ` + server.URL + `/secrets
+      headers:
+        Authorization: Bearer broker-token
+  script:
+    exec:
+      command: [sh, -c, 'echo "community-$0"']
+    ttl: 0s
+auths:
+  core_v3:
+    version: 3
+    username: monitoring
+    security_level: authNoPriv
+    password: {provider: broker, key: snmp/core}
+  edge_v2:
+    community: {provider: script, key: edge}
+  missing_v3:
+    version: 3
+    username: monitoring
+    security_level: authNoPriv
+    password: {provider: broker, key: snmp/missing}
+`
+	configPath := filepath.Join(dir, "snmp.yml")
+	if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadFile(promslog.NewNopLogger(), []string{configPath}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		auth, err := cfg.Auths["core_v3"].ResolveSecrets(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth.Password != "maplesyrup" {
+			t.Fatalf("expected password from the http provider, got %q", auth.Password)
+		}
+	}
+	// The second resolution is served from the cache.
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected 1 request to the secrets broker, got %d", n)
+	}
+	if cfg.Auths["core_v3"].Password != "" {
+		t.Error("expected the fetched password not to be kept in the configuration")
+	}
+
+	auth, err := cfg.Auths["edge_v2"].ResolveSecrets(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Community != "community-edge" {
+		t.Errorf("expected community from the exec provider, got %q", auth.Community)
+	}
+
+	if _, err := cfg.Auths["missing_v3"].ResolveSecrets(context.Background()); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected an error for a missing secret, got %v", err)
+	}
+
+	// The configuration keeps the references, but no secrets.
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "maplesyrup") || strings.Contains(string(out), "broker-token") {
+		t.Fatalf("marshaled configuration reveals secrets:\n%s", out)
+	}
+	if !strings.Contains(string(out), "key: snmp/core") {
+		t.Errorf("marshaled configuration lost the secret reference:\n%s", out)
+	}
+}
+
+func TestSecretProvidersInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown provider": "auths:\n  v2:\n    community: {provider: nope, key: x}\n",
+		"missing key":      "secret_providers:\n  p:\n    exec:\n      command: [cat]\nauths:\n  v2:\n    community: {provider: p}\n",
+		"no fetcher":       "secret_providers:\n  p:\n    ttl: 1m\n",
+		"two fetchers":     "secret_providers:\n  p:\n    exec:\n      command: [cat]\n    http:\n      url: http://broker\n",
+		"with file":        "secret_providers:\n  p:\n    exec:\n      command: [cat]\nauths:\n  v2:\n    community: {provider: p, key: x}\n    community_file: community\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "snmp.yml")
+			if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadFile(promslog.NewNopLogger(), []string{configPath}, false); err == nil {
+				t.Fatal("expected error, got none")
+			}
+		})
+	}
+}
@@ -17,15 +17,19 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/prometheus/common/promslog"
 	"go.yaml.in/yaml/v2"
 
 	"github.com/prometheus/snmp_exporter/collector"
 	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/trap"
 )
 
 var nopLogger = promslog.NewNopLogger()
@@ -149,6 +153,84 @@ func TestEnvSecretsEmpty(t *testing.T) {
 	}
 }
 
+// When secrets are read from files.
+func TestFileSecrets(t *testing.T) {
+	sc := &SafeConfig{}
+	err := sc.ReloadConfig(nopLogger, []string{"testdata/snmp-auth-files.yml"}, false)
+	if err != nil {
+		t.Fatalf("Error loading config %v: %v", "testdata/snmp-auth-files.yml", err)
+	}
+
+	v2, v3 := sc.C.Auths["with_files_v2"], sc.C.Auths["with_files_v3"]
+	if v2.Community != "mysecret_community" || v3.Password != "mysecret_password" || v3.PrivPassword != "mysecret_priv_password" || v3.ContextName != "vrf-mgmt" {
+		t.Fatal("failed to read secrets from files")
+	}
+	want := []string{"testdata/secrets/community", "testdata/secrets/context_name", "testdata/secrets/password", "testdata/secrets/priv_password"}
+	if got := sc.C.SecretFiles(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected secret files %v, got %v", want, got)
+	}
+
+	// String method must not reveal authentication credentials.
+	c, err := yaml.Marshal(sc.C)
+	if err != nil {
+		t.Errorf("Error marshaling config: %v", err)
+	}
+	if strings.Contains(string(c), "mysecret") {
+		t.Fatal("config's String method reveals authentication credentials.")
+	}
+}
+
+func TestFileSecretsInvalid(t *testing.T) {
+	for name, auth := range map[string]string{
+		"missing file":  "community_file: secrets/nope",
+		"both set":      "password: mysecret\n    password_file: secrets/password\n    username: user\n    security_level: authNoPriv\n    version: 3",
+		"missing value": "username: user\n    security_level: authNoPriv\n    version: 3",
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.Mkdir(filepath.Join(dir, "secrets"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "secrets", "password"), []byte("mysecret"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			configPath := filepath.Join(dir, "snmp.yml")
+			if err := os.WriteFile(configPath, []byte("auths:\n  test:\n    "+auth+"\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := (&SafeConfig{}).ReloadConfig(nopLogger, []string{configPath}, false); err == nil {
+				t.Fatal("expected error, got none")
+			}
+		})
+	}
+}
+
+func TestSecretFilesChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(path, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := &secretFiles{}
+	if s.changed([]string{path}) {
+		t.Error("expected files seen for the first time not to count as changed")
+	}
+	if s.changed([]string{path}) {
+		t.Error("expected an unchanged file not to count as changed")
+	}
+	if err := os.WriteFile(path, []byte("new"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !s.changed([]string{path}) {
+		t.Error("expected a rewritten file to count as changed")
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if !s.changed([]string{path}) {
+		t.Error("expected a removed file to count as changed")
+	}
+}
+
 // When SNMPv2 was specified without credentials
 func TestEnvSecretsNotSpecified(t *testing.T) {
 	sc := &SafeConfig{}
@@ -166,9 +248,9 @@ func TestParseModules(t *testing.T) {
 		wantErr string
 	}{
 		{
-			name:  "defaults to if_mib when omitted",
+			name:  "returns no modules when omitted",
 			query: url.Values{},
-			want:  []string{"if_mib"},
+			want:  nil,
 		},
 		{
 			name:    "rejects explicit empty module",
@@ -234,3 +316,165 @@ func TestHandlerRejectsEmptyModuleParameter(t *testing.T) {
 		t.Fatalf("unexpected response body: %q", resp.Body.String())
 	}
 }
+
+func TestScrapeContext(t *testing.T) {
+	cases := []struct {
+		name      string
+		header    string
+		wantTime  time.Duration
+		noTimeout bool
+		wantErr   bool
+	}{
+		{name: "no header", noTimeout: true},
+		{name: "offset subtracted", header: "10", wantTime: 9500 * time.Millisecond},
+		{name: "timeout below offset", header: "0.25", wantTime: 250 * time.Millisecond},
+		{name: "invalid", header: "soon", wantErr: true},
+		{name: "negative", header: "-1", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/snmp?target=127.0.0.1", http.NoBody)
+			if tc.header != "" {
+				req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", tc.header)
+			}
+			start := time.Now()
+			ctx, cancel, err := scrapeContext(req, 500*time.Millisecond)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer cancel()
+			deadline, ok := ctx.Deadline()
+			if ok == tc.noTimeout {
+				t.Fatalf("expected deadline set to be %v", !tc.noTimeout)
+			}
+			if ok {
+				if got := deadline.Sub(start); got < tc.wantTime || got > tc.wantTime+time.Second {
+					t.Fatalf("expected timeout of %s, got %s", tc.wantTime, got)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveProbe(t *testing.T) {
+	sc := &SafeConfig{}
+	err := sc.ReloadConfig(nopLogger, []string{"testdata/snmp-targets.yml"}, false)
+	if err != nil {
+		t.Fatalf("Error loading config %v: %v", "testdata/snmp-targets.yml", err)
+	}
+
+	cases := []struct {
+		name       string
+		probe      probe
+		want       probe
+		wantLabels map[string]string
+	}{
+		{
+			name:  "unknown target uses defaults",
+			probe: probe{Target: "192.0.2.9"},
+			want:  probe{Target: "192.0.2.9", Auth: "public_v2", Modules: []string{"if_mib"}},
+		},
+		{
+			name:       "inventory target",
+			probe:      probe{Target: "core1"},
+			want:       probe{Target: "tcp://192.0.2.1:1161", Auth: "private_v2", Modules: []string{"if_mib", "system"}, SNMPContext: "vrf-mgmt"},
+			wantLabels: map[string]string{"site": "ams1"},
+		},
+		{
+			name:       "query overrides inventory",
+			probe:      probe{Target: "core1", Auth: "public_v2", Modules: []string{"system"}},
+			want:       probe{Target: "tcp://192.0.2.1:1161", Auth: "public_v2", Modules: []string{"system"}, SNMPContext: "vrf-mgmt"},
+			wantLabels: map[string]string{"site": "ams1"},
+		},
+		{
+			name:  "inventory target without settings uses defaults",
+			probe: probe{Target: "edge1"},
+			want:  probe{Target: "edge1", Auth: "public_v2", Modules: []string{"if_mib"}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, labels := resolveProbe(sc.C, tc.probe)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected probe %+v, got %+v", tc.want, got)
+			}
+			if !reflect.DeepEqual(labels, tc.wantLabels) {
+				t.Errorf("expected labels %v, got %v", tc.wantLabels, labels)
+			}
+		})
+	}
+
+	// With module selection rules, the modules are left for them to pick.
+	sc.C.ModuleSelection = &config.ModuleSelection{}
+	if got, _ := resolveProbe(sc.C, probe{Target: "edge1"}); len(got.Modules) != 0 {
+		t.Errorf("expected no modules with module selection, got %v", got.Modules)
+	}
+}
+
+func TestLoadConfigTargetsUnknownReference(t *testing.T) {
+	dir := t.TempDir()
+	content := `
+auths:
+  public_v2:
+    community: public
+modules:
+  if_mib: {}
+targets:
+  core1:
+    auth: public_v2
+    modules: [if_mib, missing]
+`
+	file := filepath.Join(dir, "snmp.yml")
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sc := &SafeConfig{}
+	err := sc.ReloadConfig(nopLogger, []string{file}, false)
+	if err == nil || !strings.Contains(err.Error(), `target "core1" references unknown module "missing"`) {
+		t.Fatalf("expected unknown module error, got %v", err)
+	}
+}
+
+func TestReloadConfigResolvesTrapAuthsUnlocked(t *testing.T) {
+	sc := &SafeConfig{}
+	// Whether the configuration could be read while the secret was fetched.
+	unlocked := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok := sc.mu.TryRLock()
+		if ok {
+			sc.mu.RUnlock()
+		}
+		unlocked <- ok
+		w.Write([]byte("public"))
+	}))
+	defer server.Close()
+	content := `
+secret_providers:
+  broker:
+    http:
+      url: ` + server.URL + `
+auths:
+  public_v2:
+    community: {provider: broker, key: public}
+modules:
+  if_mib: {}
+`
+	file := filepath.Join(t.TempDir(), "snmp.yml")
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sc.receiver = trap.NewReceiver(nopLogger, nil, trap.Metrics{}, collector.Metrics{})
+	if err := sc.ReloadConfig(nopLogger, []string{file}, false); err != nil {
+		t.Fatal(err)
+	}
+	if !<-unlocked {
+		t.Fatal("expected the configuration to be readable while trap secrets are fetched")
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/snmp_exporter/collector"
+)
+
+const discoverPath = "/snmp/discover"
+
+// discoveryReport is what the modules of the configuration return from a
+// target.
+type discoveryReport struct {
+	Target string `json:"target"`
+	Auth   string `json:"auth"`
+	// The modules that returned data, to scrape the target with.
+	Modules    []string                     `json:"modules"`
+	Discovered []collector.DiscoveredModule `json:"discovered"`
+}
+
+var discoveryTemplate = template.Must(template.New("discovery").Funcs(template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>SNMP discovery of {{ .Target }}</title></head>
+<body>
+<h1>SNMP discovery of {{ .Target }}</h1>
+<p>Modules returning data with auth <code>{{ .Auth }}</code>: <code>module={{ range $i, $m := .Modules }}{{ if $i }},{{ end }}{{ $m }}{{ end }}</code></p>
+<table border="1" cellpadding="4">
+<tr><th>Module</th><th>OID</th><th>Request</th><th>Data</th><th>Rows</th><th>Estimated packets</th><th>Error</th></tr>
+{{ range .Discovered }}<tr><th rowspan="{{ len .Roots | inc }}" align="left">{{ .Module }}</th><td></td><td></td><td>{{ .HasData }}</td><td></td><td>{{ .EstimatedPackets }}</td><td></td></tr>
+{{ range .Roots }}<tr><td>{{ .OID }}</td><td>{{ if .Get }}get{{ else }}walk{{ end }}</td><td>{{ .HasData }}</td><td>{{ .Rows }}</td><td>{{ if not .Get }}{{ .EstimatedPackets }}{{ end }}</td><td>{{ .Error }}</td></tr>
+{{ end }}{{ end }}</table>
+</body>
+</html>
+`))
+
+// discoverHandler reports which walks and gets of the modules return data
+// from a target. All modules are probed, unless some are requested.
+func discoverHandler(w http.ResponseWriter, r *http.Request, logger *slog.Logger, exporterMetrics collector.Metrics) {
+	query := r.URL.Query()
+	target := query.Get("target")
+	if len(query["target"]) != 1 || target == "" {
+		http.Error(w, "'target' parameter must be specified once", http.StatusBadRequest)
+		snmpRequestErrors.Inc()
+		return
+	}
+	p, err := parseProbe(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		snmpRequestErrors.Inc()
+		return
+	}
+	p.Target = target
+
+	format := query.Get("format")
+	if format == "" {
+		format = "json"
+		if strings.Contains(r.Header.Get("Accept"), "text/html") {
+			format = "html"
+		}
+	}
+	if format != "json" && format != "html" {
+		http.Error(w, fmt.Sprintf("unknown format '%s'", format), http.StatusBadRequest)
+		snmpRequestErrors.Inc()
+		return
+	}
+
+	c, p, err := newDiscoverer(r, p, logger, exporterMetrics)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		snmpRequestErrors.Inc()
+		return
+	}
+	logger = logger.With("target", p.Target, "auth", p.Auth)
+	discovered, err := c.Discover()
+	if err != nil {
+		logger.Info("Error discovering target", "err", err)
+		http.Error(w, fmt.Sprintf("error discovering target: %s", err), http.StatusInternalServerError)
+		return
+	}
+	report := discoveryReport{Target: p.Target, Auth: p.Auth, Modules: []string{}, Discovered: discovered}
+	for _, d := range discovered {
+		if d.HasData {
+			report.Modules = append(report.Modules, d.Module)
+		}
+	}
+
+	if format == "html" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := discoveryTemplate.Execute(w, report); err != nil {
+			logger.Error("Error writing discovery report", "err", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logger.Error("Error writing discovery report", "err", err)
+	}
+}
+
+// newDiscoverer returns a collector for the modules of a discovery, all of
+// them sorted by name if the probe has none.
+func newDiscoverer(r *http.Request, p probe, logger *slog.Logger, exporterMetrics collector.Metrics) (*collector.Collector, probe, error) {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	requested := p.Modules
+	p, _ = resolveProbe(sc.C, p)
+	if strings.HasPrefix(p.Target, "file://") && !*fileTargets {
+		return nil, p, fmt.Errorf("file targets are not enabled")
+	}
+	auth, ok := sc.C.Auths[p.Auth]
+	if !ok {
+		return nil, p, fmt.Errorf("Unknown auth '%s'", p.Auth)
+	}
+	if len(requested) == 0 {
+		for name := range sc.modules {
+			requested = append(requested, name)
+		}
+		slices.Sort(requested)
+	}
+	var nmodules []*collector.NamedModule
+	for _, name := range requested {
+		module, ok := sc.modules[name]
+		if !ok {
+			return nil, p, fmt.Errorf("Unknown module '%s'", name)
+		}
+		nmodules = append(nmodules, module)
+	}
+	logger = logger.With("target", p.Target, "auth", p.Auth)
+	c := collector.New(r.Context(), p.Target, p.Auth, p.SNMPContext, p.SNMPEngineID, auth, nmodules, logger, exporterMetrics, 1, *debugSNMP)
+	if chain := sc.authChains[p.Auth]; chain != nil {
+		c.UseAuthChain(chain)
+	}
+	c.UseEngineCache(engines)
+	c.UseSessionPool(sessions)
+	return c, p, nil
+}
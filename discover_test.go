@@ -0,0 +1,91 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/collector"
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+	"github.com/prometheus/snmp_exporter/simulator"
+)
+
+func TestDiscoverHandler(t *testing.T) {
+	pdus, err := scraper.ReadSnmprec(strings.NewReader("1.3.6.1.2.1.1.3.0|67|12345\n1.3.6.1.2.1.2.2.1.2.1|4|lo\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &config.Auth{Community: "public", Version: 2}
+	agent, err := simulator.NewAgent(promslog.NewNopLogger(), pdus, []*config.Auth{auth}, nil, simulator.Faults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go agent.ServePacket(conn)
+	defer conn.Close()
+
+	retries := 0
+	walkParams := config.WalkParams{Retries: &retries, Timeout: 100 * time.Millisecond, MaxRepetitions: 25}
+	conf := &config.Config{
+		Auths: map[string]*config.Auth{"public_v2": auth},
+		Modules: map[string]*config.Module{
+			"if_mib":         {Walk: []string{"1.3.6.1.2.1.2"}, WalkParams: walkParams},
+			"host_resources": {Walk: []string{"1.3.6.1.2.1.25"}, WalkParams: walkParams},
+		},
+	}
+	sc = &SafeConfig{C: conf, modules: namedModules(conf)}
+	target := conn.LocalAddr().String()
+
+	req := httptest.NewRequest(http.MethodGet, discoverPath+"?target="+target, http.NoBody)
+	resp := httptest.NewRecorder()
+	discoverHandler(resp, req, nopLogger, collector.Metrics{})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, resp.Code, resp.Body)
+	}
+	var report discoveryReport
+	if err := json.Unmarshal(resp.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Modules, []string{"if_mib"}) || len(report.Discovered) != 2 || report.Auth != "public_v2" {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, discoverPath+"?target="+target+"&module=if_mib", http.NoBody)
+	req.Header.Set("Accept", "text/html")
+	resp = httptest.NewRecorder()
+	discoverHandler(resp, req, nopLogger, collector.Metrics{})
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "<code>module=if_mib</code>") {
+		t.Errorf("unexpected response %d: %s", resp.Code, resp.Body)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, discoverPath+"?target="+target+"&module=nope", http.NoBody)
+	resp = httptest.NewRecorder()
+	discoverHandler(resp, req, nopLogger, collector.Metrics{})
+	if resp.Code != http.StatusBadRequest || !strings.Contains(resp.Body.String(), "Unknown module 'nope'") {
+		t.Errorf("unexpected response %d: %s", resp.Code, resp.Body)
+	}
+}
@@ -60,6 +60,7 @@ type ModuleConfig struct {
 	WalkParams config.WalkParams          `yaml:",inline"`
 	Overrides  map[string]MetricOverrides `yaml:"overrides"`
 	Filters    config.Filters             `yaml:"filters,omitempty"`
+	Required   bool                       `yaml:"required,omitempty"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
@@ -70,6 +70,7 @@ func generateConfig(nodes *Node, nameToNode map[string]*Node, logger *slog.Logge
 		}
 		outputConfig.Modules[name] = out
 		outputConfig.Modules[name].WalkParams = m.WalkParams
+		outputConfig.Modules[name].Required = m.Required
 		logger.Info("Generated metrics", "module", name, "metrics", len(outputConfig.Modules[name].Metrics))
 	}
 
@@ -14,6 +14,8 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -21,9 +23,11 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/prometheus/client_golang/prometheus"
@@ -39,6 +43,8 @@ import (
 
 	"github.com/prometheus/snmp_exporter/collector"
 	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+	"github.com/prometheus/snmp_exporter/trap"
 )
 
 const (
@@ -46,11 +52,18 @@ const (
 )
 
 var (
+	serveCommand  = kingpin.Command("serve", "Run the exporter. This is the default command.").Default()
 	configFile    = kingpin.Flag("config.file", "Path to configuration file.").Default("snmp.yml").Strings()
 	dryRun        = kingpin.Flag("dry-run", "Only verify configuration is valid and exit.").Default("false").Bool()
 	concurrency   = kingpin.Flag("snmp.module-concurrency", "The number of modules to fetch concurrently per scrape").Default("1").Int()
 	debugSNMP     = kingpin.Flag("snmp.debug-packets", "Include a full debug trace of SNMP packet traffics.").Default("false").Bool()
 	expandEnvVars = kingpin.Flag("config.expand-environment-variables", "Expand environment variables to source secrets").Default("false").Bool()
+	timeoutOffset = kingpin.Flag("snmp.timeout-offset", "Offset to subtract from the Prometheus scrape timeout, leaving time to return the results.").Default("0.5s").Duration()
+	trapAddrs     = kingpin.Flag("trap.listen-address", "Address to receive traps and informs on, such as udp://:162 or tcp://:162. Repeatable, traps are not received if unset.").Strings()
+	trapEngineID  = kingpin.Flag("trap.engine-id", "Engine ID in hex of the trap receiver for v3 informs, random if unset.").String()
+	engineTTL     = kingpin.Flag("snmp.engine-cache-ttl", "How long the SNMPv3 engines of targets and the keys localized to them are kept between scrapes, 0 to discover them on every scrape.").Default("1h").Duration()
+	poolSize      = kingpin.Flag("snmp.session-pool-size", "How many idle sessions to TCP and connected UDP targets are kept between scrapes, 0 to open a session on every scrape.").Default("0").Int()
+	poolIdle      = kingpin.Flag("snmp.session-pool-idle-timeout", "How long idle sessions are kept in the session pool.").Default("1m").Duration()
 	metricsPath   = kingpin.Flag(
 		"web.telemetry-path",
 		"Path under which to expose metrics.",
@@ -77,17 +90,24 @@ var (
 		C: &config.Config{},
 	}
 	reloadCh chan chan error
+	// Shared by all scrapes, nil if disabled.
+	engines  *collector.EngineCache
+	sessions *collector.SessionPool
 )
 
 const (
 	proberPath = "/snmp"
 	configPath = "/config"
+
+	// Used when neither the request nor the target inventory say otherwise.
+	defaultAuth   = "public_v2"
+	defaultModule = "if_mib"
 )
 
 func parseModules(query url.Values) ([]string, error) {
 	queryModule := query["module"]
 	if len(queryModule) == 0 {
-		queryModule = append(queryModule, "if_mib")
+		return nil, nil
 	}
 	uniqueM := make(map[string]bool)
 	var modules []string
@@ -108,6 +128,218 @@ func parseModules(query url.Values) ([]string, error) {
 	return modules, nil
 }
 
+// probe describes a single target to scrape and how to scrape it.
+type probe struct {
+	Target       string   `json:"target"`
+	Auth         string   `json:"auth,omitempty"`
+	Modules      []string `json:"module,omitempty"`
+	SNMPContext  string   `json:"snmp_context,omitempty"`
+	SNMPEngineID string   `json:"snmp_engineid,omitempty"`
+}
+
+// parseProbe extracts everything but the target from the query parameters.
+func parseProbe(query url.Values) (probe, error) {
+	var p probe
+	p.Auth = query.Get("auth")
+	if len(query["auth"]) > 1 {
+		return p, fmt.Errorf("'auth' parameter must only be specified once")
+	}
+
+	p.SNMPContext = query.Get("snmp_context")
+	if len(query["snmp_context"]) > 1 {
+		return p, fmt.Errorf("'snmp_context' parameter must only be specified once")
+	}
+
+	p.SNMPEngineID = query.Get("snmp_engineid")
+	if len(query["snmp_engineid"]) > 1 {
+		return p, fmt.Errorf("'snmp_engineid' parameter must only be specified once")
+	}
+
+	modules, err := parseModules(query)
+	if err != nil {
+		return p, err
+	}
+	p.Modules = modules
+	return p, nil
+}
+
+// resolveProbe fills in what the request left unspecified from the target
+// inventory, and then from the defaults. It returns the resolved probe along
+// with the extra labels of the inventory target, if any.
+func resolveProbe(conf *config.Config, p probe) (probe, map[string]string) {
+	var labels map[string]string
+	if t, ok := conf.Targets[p.Target]; ok {
+		if t.Address != "" {
+			p.Target = t.Address
+		}
+		if p.Auth == "" {
+			p.Auth = t.Auth
+		}
+		if len(p.Modules) == 0 {
+			p.Modules = t.Modules
+		}
+		if p.SNMPContext == "" {
+			p.SNMPContext = t.SNMPContext
+		}
+		if p.SNMPEngineID == "" {
+			p.SNMPEngineID = t.SNMPEngineID
+		}
+		labels = t.Labels
+	}
+	if p.Auth == "" {
+		p.Auth = defaultAuth
+	}
+	// Without modules, they are picked by the module selection rules.
+	if len(p.Modules) == 0 && conf.ModuleSelection == nil {
+		p.Modules = []string{defaultModule}
+	}
+	return p, labels
+}
+
+// newCollector resolves the auth and modules of a probe against the current
+// configuration. The returned labels must be added to all of its series. If
+// a recorder is given, the PDUs of the scrape are recorded to it.
+func newCollector(ctx context.Context, p probe, logger *slog.Logger, exporterMetrics collector.Metrics, debug bool, rec *scraper.Recorder) (prometheus.Collector, prometheus.Labels, error) {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	logger = logger.With("target", p.Target)
+	p, labels := resolveProbe(sc.C, p)
+	if strings.HasPrefix(p.Target, "file://") && !*fileTargets {
+		return nil, nil, fmt.Errorf("file targets are not enabled")
+	}
+	auth, authOk := sc.C.Auths[p.Auth]
+	if !authOk {
+		return nil, nil, fmt.Errorf("Unknown auth '%s'", p.Auth)
+	}
+	var nmodules []*collector.NamedModule
+	for _, m := range p.Modules {
+		module, moduleOk := sc.modules[m]
+		if !moduleOk {
+			return nil, nil, fmt.Errorf("Unknown module '%s'", m)
+		}
+		nmodules = append(nmodules, module)
+	}
+	logger = logger.With("auth", p.Auth)
+
+	// Serve what the poller has cached, unless a packet trace or a
+	// recording was asked for.
+	var cached prometheus.Collector
+	if sc.poller != nil && !debug && rec == nil {
+		key := collector.PollKey{Target: p.Target, AuthName: p.Auth, SNMPContext: p.SNMPContext, SNMPEngineID: p.SNMPEngineID}
+		cached, nmodules = sc.poller.Collector(key, nmodules)
+	}
+	if cached != nil && len(nmodules) == 0 {
+		return cached, labels, nil
+	}
+	live := collector.New(ctx, p.Target, p.Auth, p.SNMPContext, p.SNMPEngineID, auth, nmodules, logger, exporterMetrics, *concurrency, debug)
+	if len(p.Modules) == 0 {
+		live.SelectModules(sc.selector)
+	}
+	if chain := sc.authChains[p.Auth]; chain != nil {
+		live.UseAuthChain(chain)
+	}
+	live.UseEngineCache(engines)
+	live.UseSessionPool(sessions)
+	if rec != nil {
+		live.RecordTo(rec)
+	}
+	if cached == nil {
+		return live, labels, nil
+	}
+	return collectors{cached, live}, labels, nil
+}
+
+// collectors combines several collectors into one.
+type collectors []prometheus.Collector
+
+// Describe implements Prometheus.Collector.
+func (cs collectors) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range cs {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements Prometheus.Collector.
+func (cs collectors) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range cs {
+		c.Collect(ch)
+	}
+}
+
+// namedModules prepares the modules of a configuration for scraping.
+func namedModules(conf *config.Config) map[string]*collector.NamedModule {
+	modules := make(map[string]*collector.NamedModule, len(conf.Modules))
+	for name, m := range conf.Modules {
+		modules[name] = collector.NewNamedModule(name, m)
+	}
+	return modules
+}
+
+// authChains prepares the auths of a configuration that have chains.
+func authChains(conf *config.Config) map[string]*collector.AuthChain {
+	chains := map[string]*collector.AuthChain{}
+	for name, a := range conf.Auths {
+		if chain := collector.NewAuthChain(a, conf.Auths); chain != nil {
+			chains[name] = chain
+		}
+	}
+	return chains
+}
+
+// pollTargets returns the inventory targets that are scraped in the background.
+func pollTargets(conf *config.Config, modules map[string]*collector.NamedModule, chains map[string]*collector.AuthChain) []collector.PollTarget {
+	var targets []collector.PollTarget
+	for name, t := range conf.Targets {
+		if t.PollInterval <= 0 {
+			continue
+		}
+		p, _ := resolveProbe(conf, probe{Target: name})
+		auth, ok := conf.Auths[p.Auth]
+		if !ok {
+			continue
+		}
+		// Module selection only applies to scrapes.
+		if len(p.Modules) == 0 {
+			p.Modules = []string{defaultModule}
+		}
+		pt := collector.PollTarget{
+			Key:       collector.PollKey{Target: p.Target, AuthName: p.Auth, SNMPContext: p.SNMPContext, SNMPEngineID: p.SNMPEngineID},
+			Auth:      auth,
+			AuthChain: chains[p.Auth],
+			Interval:  t.PollInterval,
+		}
+		for _, m := range p.Modules {
+			if module, ok := modules[m]; ok {
+				pt.Modules = append(pt.Modules, module)
+			}
+		}
+		targets = append(targets, pt)
+	}
+	return targets
+}
+
+// scrapeContext derives the context of a scrape from the request. When
+// Prometheus sends its scrape timeout, the scrape is given a deadline that
+// ends the offset before it.
+func scrapeContext(r *http.Request, offset time.Duration) (context.Context, context.CancelFunc, error) {
+	v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if v == "" {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil || seconds <= 0 {
+		return nil, nil, fmt.Errorf("invalid X-Prometheus-Scrape-Timeout-Seconds header '%s'", v)
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	// Don't let a large offset leave no time at all.
+	if timeout > offset {
+		timeout -= offset
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, nil
+}
+
 func handler(w http.ResponseWriter, r *http.Request, logger *slog.Logger, exporterMetrics collector.Metrics) {
 	query := r.URL.Query()
 
@@ -119,70 +351,69 @@ func handler(w http.ResponseWriter, r *http.Request, logger *slog.Logger, export
 		logger.Debug("Debug query param enabled")
 	}
 
-	target := query.Get("target")
-	if len(query["target"]) != 1 || target == "" {
-		http.Error(w, "'target' parameter must be specified once", http.StatusBadRequest)
+	record := query.Get("snmp_record") == "true"
+	if record && *recordDir == "" {
+		http.Error(w, "recording is not enabled, see --snmp.record-dir", http.StatusBadRequest)
 		snmpRequestErrors.Inc()
 		return
 	}
 
-	authName := query.Get("auth")
-	if len(query["auth"]) > 1 {
-		http.Error(w, "'auth' parameter must only be specified once", http.StatusBadRequest)
+	ctx, cancel, err := scrapeContext(r, *timeoutOffset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		snmpRequestErrors.Inc()
 		return
 	}
-	if authName == "" {
-		authName = "public_v2"
-	}
+	defer cancel()
+	r = r.WithContext(ctx)
 
-	snmpContext := query.Get("snmp_context")
-	if len(query["snmp_context"]) > 1 {
-		http.Error(w, "'snmp_context' parameter must only be specified once", http.StatusBadRequest)
-		snmpRequestErrors.Inc()
+	if r.Method == http.MethodPost || len(query["target"]) > 1 {
+		if record {
+			http.Error(w, "batch requests can't be recorded", http.StatusBadRequest)
+			snmpRequestErrors.Inc()
+			return
+		}
+		batchHandler(w, r, logger, exporterMetrics, debug)
 		return
 	}
 
-	snmpEngineID := query.Get("snmp_engineid")
-	if len(query["snmp_engineid"]) > 1 {
-		http.Error(w, "'snmp_engineid' parameter must only be specified once", http.StatusBadRequest)
+	target := query.Get("target")
+	if len(query["target"]) != 1 || target == "" {
+		http.Error(w, "'target' parameter must be specified once", http.StatusBadRequest)
 		snmpRequestErrors.Inc()
 		return
 	}
 
-	modules, err := parseModules(query)
+	p, err := parseProbe(query)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		snmpRequestErrors.Inc()
 		return
 	}
-	sc.mu.RLock()
-	auth, authOk := sc.C.Auths[authName]
-	if !authOk {
-		sc.mu.RUnlock()
-		http.Error(w, fmt.Sprintf("Unknown auth '%s'", authName), http.StatusBadRequest)
+	p.Target = target
+	var rec *scraper.Recorder
+	if record {
+		rec = scraper.NewRecorder()
+	}
+	c, labels, err := newCollector(r.Context(), p, logger, exporterMetrics, debug, rec)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		snmpRequestErrors.Inc()
 		return
 	}
-	var nmodules []*collector.NamedModule
-	for _, m := range modules {
-		module, moduleOk := sc.C.Modules[m]
-		if !moduleOk {
-			sc.mu.RUnlock()
-			http.Error(w, fmt.Sprintf("Unknown module '%s'", m), http.StatusBadRequest)
-			snmpRequestErrors.Inc()
-			return
-		}
-		nmodules = append(nmodules, collector.NewNamedModule(m, module))
-	}
-	sc.mu.RUnlock()
-	logger = logger.With("auth", authName, "target", target)
 	registry := prometheus.NewRegistry()
-	c := collector.New(r.Context(), target, authName, snmpContext, snmpEngineID, auth, nmodules, logger, exporterMetrics, *concurrency, debug)
-	registry.MustRegister(c)
+	prometheus.WrapRegistererWith(labels, registry).MustRegister(c)
 	// Delegate http serving to Prometheus client library, which will call collector.Collect.
 	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
 	h.ServeHTTP(w, r)
+	if rec != nil {
+		path, err := saveRecording(*recordDir, target, time.Now(), rec)
+		if err != nil {
+			logger.Error("Error saving recording", "target", target, "err", err)
+			return
+		}
+		logger.Info("Saved recording of scrape", "target", target, "file", path)
+	}
 }
 
 func updateConfiguration(w http.ResponseWriter, r *http.Request) {
@@ -201,6 +432,19 @@ func updateConfiguration(w http.ResponseWriter, r *http.Request) {
 type SafeConfig struct {
 	mu sync.RWMutex
 	C  *config.Config
+	// The modules of C, prepared for scraping.
+	modules map[string]*collector.NamedModule
+	// Only set when background polling is enabled.
+	poller *collector.Poller
+	// Only set when traps are received.
+	receiver *trap.Receiver
+	// Picks the modules of targets scraped without any, if configured.
+	selector *collector.ModuleSelector
+	// The auths with chains, by name.
+	authChains map[string]*collector.AuthChain
+	// Serializes the updates of the poller and receiver, which are applied
+	// without holding mu as they can take a while.
+	updateMu sync.Mutex
 }
 
 func (sc *SafeConfig) ReloadConfig(logger *slog.Logger, configFile []string, expandEnvVars bool) (err error) {
@@ -208,13 +452,40 @@ func (sc *SafeConfig) ReloadConfig(logger *slog.Logger, configFile []string, exp
 	if err != nil {
 		return err
 	}
+	modules := namedModules(conf)
+	chains := authChains(conf)
+	sc.updateMu.Lock()
+	defer sc.updateMu.Unlock()
 	sc.mu.Lock()
 	sc.C = conf
+	sc.modules = modules
+	// Keep the auths targets accepted, for the chains that didn't change.
+	for name, chain := range chains {
+		chain.Update(sc.authChains[name])
+	}
+	sc.authChains = chains
+	// Keep the modules already picked for targets, unless selection was
+	// turned on or off.
+	if sc.selector != nil && conf.ModuleSelection != nil {
+		sc.selector.Update(conf.ModuleSelection, modules)
+	} else {
+		sc.selector = collector.NewModuleSelector(conf.ModuleSelection, modules)
+	}
 	// Initialize metrics.
 	for module := range sc.C.Modules {
 		snmpCollectionDuration.WithLabelValues(module)
 	}
+	poller := sc.poller
+	receiver := sc.receiver
 	sc.mu.Unlock()
+	if poller != nil {
+		poller.Update(pollTargets(conf, modules, chains))
+	}
+	// Secrets of the trap auths are fetched here, where slow secret
+	// providers don't hold up scrapes.
+	if receiver != nil {
+		receiver.Update(conf, modules)
+	}
 	return nil
 }
 
@@ -223,8 +494,18 @@ func main() {
 	flag.AddFlags(kingpin.CommandLine, promslogConfig)
 	kingpin.Version(version.Print("snmp_exporter"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
 	logger := promslog.New(promslogConfig)
+	switch command {
+	case simulateCommand.FullCommand():
+		if err := simulate(logger); err != nil {
+			logger.Error("Error simulating agent", "err", err)
+			os.Exit(1)
+		}
+		return
+	case scrapeCommand.FullCommand():
+		os.Exit(scrape(logger, os.Stdout))
+	}
 	if *concurrency < 1 {
 		*concurrency = 1
 	}
@@ -233,6 +514,12 @@ func main() {
 	logger.Info("operational information", "build_context", version.BuildContext())
 
 	prometheus.MustRegister(versioncollector.NewCollector("snmp_exporter"))
+	if engines = collector.NewEngineCache(*engineTTL); engines != nil {
+		prometheus.MustRegister(engines)
+	}
+	if sessions = collector.NewSessionPool(*poolSize, *poolIdle); sessions != nil {
+		prometheus.MustRegister(sessions)
+	}
 
 	// Bail early if the config is bad.
 	err := sc.ReloadConfig(logger, *configFile, *expandEnvVars)
@@ -262,9 +549,29 @@ func main() {
 	hup := make(chan os.Signal, 1)
 	reloadCh = make(chan chan error)
 	signal.Notify(hup, syscall.SIGHUP)
+	var secretsCheck <-chan time.Time
+	if *secretFilesCheckInterval > 0 {
+		secretsCheck = time.NewTicker(*secretFilesCheckInterval).C
+	}
 	go func() {
+		sc.mu.RLock()
+		secrets := &secretFiles{}
+		secrets.changed(sc.C.SecretFiles())
+		sc.mu.RUnlock()
 		for {
 			select {
+			case <-secretsCheck:
+				sc.mu.RLock()
+				files := sc.C.SecretFiles()
+				sc.mu.RUnlock()
+				if !secrets.changed(files) {
+					continue
+				}
+				if err := sc.ReloadConfig(logger, *configFile, *expandEnvVars); err != nil {
+					logger.Error("Error reloading config after a secret file changed", "err", err)
+				} else {
+					logger.Info("Loaded config file after a secret file changed")
+				}
 			case <-hup:
 				if err := sc.ReloadConfig(logger, *configFile, *expandEnvVars); err != nil {
 					logger.Error("Error reloading config", "err", err)
@@ -322,6 +629,75 @@ func main() {
 				Help:      "Current number of SNMP scrapes being requested.",
 			},
 		),
+		SNMPReports: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "usm_reports_total",
+				Help:      "USM reports received from SNMPv3 targets, by report.",
+			},
+			[]string{"report"},
+		),
+	}
+
+	// Start polling the inventory targets that have a poll interval.
+	sc.updateMu.Lock()
+	sc.mu.Lock()
+	sc.poller = collector.NewPoller(logger, exporterMetrics, *concurrency)
+	sc.poller.UseEngineCache(engines)
+	sc.poller.UseSessionPool(sessions)
+	targets := pollTargets(sc.C, sc.modules, sc.authChains)
+	sc.mu.Unlock()
+	sc.poller.Update(targets)
+	sc.updateMu.Unlock()
+
+	if len(*trapAddrs) > 0 {
+		engineID, err := hex.DecodeString(*trapEngineID)
+		if err != nil {
+			logger.Error("Invalid trap engine ID", "err", err)
+			os.Exit(1)
+		}
+		receiver := trap.NewReceiver(logger, engineID, trap.Metrics{
+			Received: promauto.NewCounterVec(
+				prometheus.CounterOpts{
+					Namespace: namespace,
+					Name:      "traps_received_total",
+					Help:      "Traps and informs received, by source and trap OID.",
+				},
+				[]string{"source", "trap_oid", "trap_name"},
+			),
+			Dropped: promauto.NewCounterVec(
+				prometheus.CounterOpts{
+					Namespace: namespace,
+					Name:      "traps_dropped_total",
+					Help:      "Traps and informs dropped, by reason.",
+				},
+				[]string{"reason"},
+			),
+			AlertFailures: promauto.NewCounter(
+				prometheus.CounterOpts{
+					Namespace: namespace,
+					Name:      "traps_alert_delivery_failures_total",
+					Help:      "Deliveries of alerts for traps to Alertmanager that failed after all retries.",
+				},
+			),
+		}, exporterMetrics)
+		sc.updateMu.Lock()
+		sc.mu.Lock()
+		sc.receiver = receiver
+		conf, modules := sc.C, sc.modules
+		sc.mu.Unlock()
+		receiver.Update(conf, modules)
+		sc.updateMu.Unlock()
+		go receiver.Run(context.Background())
+		for _, addr := range *trapAddrs {
+			logger.Info("Receiving traps", "address", addr)
+			go func() {
+				if err := receiver.ListenAndServe(addr); err != nil {
+					logger.Error("Error receiving traps", "address", addr, "err", err)
+					os.Exit(1)
+				}
+			}()
+		}
 	}
 
 	http.Handle(*metricsPath, promhttp.Handler()) // Normal metrics endpoint for SNMP exporter itself.
@@ -329,6 +705,14 @@ func main() {
 	http.HandleFunc(proberPath, func(w http.ResponseWriter, r *http.Request) {
 		handler(w, r, logger, exporterMetrics)
 	})
+	// Endpoint to find the modules that return data from a target.
+	http.HandleFunc(discoverPath, func(w http.ResponseWriter, r *http.Request) {
+		discoverHandler(w, r, logger, exporterMetrics)
+	})
+	// Endpoint for Prometheus HTTP service discovery of the target inventory.
+	http.HandleFunc(sdPath, func(w http.ResponseWriter, r *http.Request) {
+		sdHandler(w, r, logger)
+	})
 	http.HandleFunc("/-/reload", updateConfiguration) // Endpoint to reload configuration.
 	// Endpoint to respond to health checks
 	http.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
@@ -372,6 +756,10 @@ func main() {
 					Address: configPath,
 					Text:    "Config",
 				},
+				{
+					Address: sdPath,
+					Text:    "Service Discovery",
+				},
 				{
 					Address: *metricsPath,
 					Text:    "Metrics",
@@ -0,0 +1,49 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+var (
+	recordDir   = kingpin.Flag("snmp.record-dir", "Directory to save the recordings of scrapes requested with snmp_record=true to. Recording is disabled if unset.").String()
+	fileTargets = kingpin.Flag("snmp.file-targets", "Allow file:///path targets, which replay a recording from the exporter's file system.").Default("false").Bool()
+
+	unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+)
+
+// saveRecording writes a recording to a file in the directory, named after
+// the target and the time of the scrape.
+func saveRecording(dir, target string, t time.Time, rec *scraper.Recorder) (string, error) {
+	name := fmt.Sprintf("%s-%s.snmprec", unsafeFileChars.ReplaceAllString(target, "_"), t.UTC().Format("20060102T150405.000Z"))
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	if err := rec.Write(f); err != nil {
+		f.Close()
+		return "", err
+	}
+	return path, f.Close()
+}
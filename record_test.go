@@ -0,0 +1,84 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/collector"
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+func TestRecordAndReplayTarget(t *testing.T) {
+	dir := t.TempDir()
+	recording := filepath.Join(dir, "device.snmprec")
+	if err := os.WriteFile(recording, []byte("1.3.6.1.2.1.1.3.0|67|12345\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	conf := &config.Config{
+		Auths: map[string]*config.Auth{"public_v2": {Community: "public", Version: 2}},
+		Modules: map[string]*config.Module{
+			"system": {
+				Get:        []string{"1.3.6.1.2.1.1.3.0"},
+				Metrics:    []*config.Metric{{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge"}},
+				WalkParams: config.DefaultWalkParams,
+			},
+		},
+	}
+	sc = &SafeConfig{C: conf, modules: namedModules(conf)}
+	metrics := collector.Metrics{
+		SNMPCollectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "duration"}, []string{"module"}),
+		SNMPInflight:           prometheus.NewGauge(prometheus.GaugeOpts{Name: "inflight"}),
+	}
+	scrape := func(query string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		handler(resp, httptest.NewRequest(http.MethodGet, "/snmp?module=system&target=file://"+recording+query, nil), nopLogger, metrics)
+		return resp
+	}
+
+	if resp := scrape(""); resp.Code != http.StatusBadRequest {
+		t.Fatalf("expected file targets to be rejected, got status %d", resp.Code)
+	}
+	*fileTargets = true
+	defer func() { *fileTargets = false }()
+	resp := scrape("")
+	if !strings.Contains(resp.Body.String(), "sysUpTime 12345\n") {
+		t.Fatalf("expected replayed sample, got:\n%s", resp.Body.String())
+	}
+
+	if resp := scrape("&snmp_record=true"); resp.Code != http.StatusBadRequest {
+		t.Fatalf("expected recording to be rejected, got status %d", resp.Code)
+	}
+	*recordDir = t.TempDir()
+	defer func() { *recordDir = "" }()
+	scrape("&snmp_record=true")
+	files, err := filepath.Glob(filepath.Join(*recordDir, "*.snmprec"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one recording, got %v: %v", files, err)
+	}
+	b, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "1.3.6.1.2.1.1.3.0|67|12345\n" {
+		t.Errorf("unexpected recording %q", b)
+	}
+}
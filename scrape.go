@@ -0,0 +1,191 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/url"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/prometheus/snmp_exporter/collector"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// Exit codes of the scrape command.
+const (
+	exitScrapeFailed  = 1
+	exitConnectFailed = 2
+	exitAuthFailed    = 3
+	exitPartialScrape = 4
+)
+
+var (
+	scrapeCommand     = kingpin.Command("scrape", "Scrape a target once and print the results, for troubleshooting.")
+	scrapeTarget      = scrapeCommand.Flag("target", "Target to scrape, as in the target parameter of /snmp.").Required().String()
+	scrapeAuth        = scrapeCommand.Flag("auth", "Auth to scrape with, public_v2 unless set by the target inventory.").String()
+	scrapeModules     = scrapeCommand.Flag("module", "Module to scrape, if_mib unless set by the target inventory. Repeatable or comma separated.").Strings()
+	scrapeSNMPContext = scrapeCommand.Flag("snmp-context", "SNMP context to scrape.").String()
+	scrapeEngineID    = scrapeCommand.Flag("snmp-engineid", "SNMP engine ID of the target, in hex.").String()
+	scrapeFormat      = scrapeCommand.Flag("format", "Output format: text for the exposition, or json for the PDUs with the metric each one matched or why it was skipped.").Default("text").Enum("text", "json")
+)
+
+// scrape runs the scrape command, and returns its exit code: 0 if the scrape
+// succeeded, exitConnectFailed or exitAuthFailed if a module couldn't reach or
+// authenticate to the target, exitScrapeFailed if it failed otherwise, and
+// exitPartialScrape if some walks or gets failed.
+func scrape(logger *slog.Logger, out io.Writer) int {
+	if err := sc.ReloadConfig(logger, *configFile, *expandEnvVars); err != nil {
+		logger.Error("Error parsing config file", "err", err)
+		return exitScrapeFailed
+	}
+
+	query := url.Values{"module": *scrapeModules}
+	for name, value := range map[string]string{"auth": *scrapeAuth, "snmp_context": *scrapeSNMPContext, "snmp_engineid": *scrapeEngineID} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	p, err := parseProbe(query)
+	if err != nil {
+		logger.Error("Invalid scrape", "err", err)
+		return exitScrapeFailed
+	}
+	p.Target = *scrapeTarget
+
+	metrics := collector.Metrics{
+		SNMPCollectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "snmp_collection_duration_seconds"}, []string{"module"}),
+		SNMPUnexpectedPduType:  prometheus.NewCounter(prometheus.CounterOpts{Name: "snmp_unexpected_pdu_type_total"}),
+		SNMPDuration:           prometheus.NewHistogram(prometheus.HistogramOpts{Name: "snmp_packet_duration_seconds"}),
+		SNMPPackets:            prometheus.NewCounter(prometheus.CounterOpts{Name: "snmp_packets_total"}),
+		SNMPRetries:            prometheus.NewCounter(prometheus.CounterOpts{Name: "snmp_packet_retries_total"}),
+		SNMPInflight:           prometheus.NewGauge(prometheus.GaugeOpts{Name: "snmp_request_in_flight"}),
+		SNMPReports:            prometheus.NewCounterVec(prometheus.CounterOpts{Name: "snmp_usm_reports_total"}, []string{"report"}),
+	}
+	var rec *scraper.Recorder
+	if *scrapeFormat == "json" {
+		rec = scraper.NewRecorder()
+	}
+	c, labels, err := newCollector(context.Background(), p, logger, metrics, *debugSNMP, rec)
+	if err != nil {
+		logger.Error("Invalid scrape", "err", err)
+		return exitScrapeFailed
+	}
+	registry := prometheus.NewRegistry()
+	prometheus.WrapRegistererWith(labels, registry).MustRegister(c)
+	mfs, gatherErr := registry.Gather()
+	if gatherErr != nil {
+		logger.Error("Error gathering samples", "err", gatherErr)
+	}
+
+	if rec != nil {
+		sc.mu.RLock()
+		p, _ = resolveProbe(sc.C, p)
+		var nmodules []*collector.NamedModule
+		for _, name := range p.Modules {
+			nmodules = append(nmodules, sc.modules[name])
+		}
+		if len(p.Modules) == 0 && sc.selector != nil {
+			nmodules, _ = sc.selector.Selected(p.Target, p.Auth, p.SNMPContext)
+		}
+		sc.mu.RUnlock()
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(collector.ExplainPDUs(rec.PDUs(), nmodules, logger, metrics)); err != nil {
+			logger.Error("Error writing PDUs", "err", err)
+			return exitScrapeFailed
+		}
+	} else {
+		enc := expfmt.NewEncoder(out, expfmt.NewFormat(expfmt.TypeTextPlain))
+		for _, mf := range mfs {
+			if err := enc.Encode(mf); err != nil {
+				logger.Error("Error writing samples", "err", err)
+				return exitScrapeFailed
+			}
+		}
+	}
+
+	if gatherErr != nil {
+		return exitScrapeFailed
+	}
+	return scrapeExitCode(mfs)
+}
+
+// scrapeExitCode returns the exit code for the outcome of a scrape, going by
+// the metrics the collector reports about the modules.
+func scrapeExitCode(mfs []*dto.MetricFamily) int {
+	truncated, returned := map[string]bool{}, map[string]bool{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			switch mf.GetName() {
+			case "snmp_scrape_truncated":
+				if m.GetGauge().GetValue() == 1 {
+					truncated[labelValue(m, "module")] = true
+				}
+			case "snmp_scrape_pdus_returned":
+				if m.GetGauge().GetValue() > 0 {
+					returned[labelValue(m, "module")] = true
+				}
+			}
+		}
+	}
+
+	code := 0
+	fail := func(c int) {
+		// Failures of whole modules take precedence over partial ones.
+		if code == 0 || code == exitPartialScrape {
+			code = c
+		}
+	}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			switch mf.GetName() {
+			case "snmp_scrape_error_info", "snmp_scrape_subtree_errors":
+			default:
+				continue
+			}
+			// A module that ran out of time, or that had walks or gets fail
+			// but still returned PDUs, is partially scraped.
+			module := labelValue(m, "module")
+			if truncated[module] || mf.GetName() == "snmp_scrape_subtree_errors" && returned[module] {
+				fail(exitPartialScrape)
+				continue
+			}
+			switch labelValue(m, "reason") {
+			case "timeout", "connection_refused":
+				fail(exitConnectFailed)
+			case "auth":
+				fail(exitAuthFailed)
+			default:
+				fail(exitScrapeFailed)
+			}
+		}
+	}
+	return code
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
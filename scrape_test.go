@@ -0,0 +1,143 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/collector"
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+	"github.com/prometheus/snmp_exporter/simulator"
+)
+
+const scrapeTestConfig = `
+auths:
+  public_v2:
+    community: public
+    version: 2
+  private_v2:
+    community: private
+    version: 2
+  admin_v3:
+    username: admin
+    security_level: authNoPriv
+    password: maplesyrup
+    auth_protocol: SHA
+    version: 3
+  wrong_v3:
+    username: admin
+    security_level: authNoPriv
+    password: pancakes
+    auth_protocol: SHA
+    version: 3
+modules:
+  system:
+    get: [1.3.6.1.2.1.1.3.0]
+    walk: [1.3.6.1.2.1.2.2.1.2]
+    retries: 0
+    timeout: 100ms
+    max_repetitions: 2
+    metrics:
+      - name: sysUpTime
+        oid: 1.3.6.1.2.1.1.3
+        type: gauge
+`
+
+func TestScrapeCommand(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "snmp.yml")
+	if err := os.WriteFile(configPath, []byte(scrapeTestConfig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old []string) { *configFile = old }(*configFile)
+	*configFile = []string{configPath}
+	sc = &SafeConfig{}
+
+	pdus, err := scraper.ReadSnmprec(strings.NewReader("1.3.6.1.2.1.1.3.0|67|12345\n1.3.6.1.2.1.2.2.1.2.1|4|lo\n1.3.6.1.2.1.2.2.1.2.2|4|eth0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auths := []*config.Auth{
+		{Community: "public", Version: 2},
+		{Username: "admin", SecurityLevel: "authNoPriv", Password: "maplesyrup", AuthProtocol: "SHA", Version: 3},
+	}
+	serve := func(faults simulator.Faults) string {
+		agent, err := simulator.NewAgent(promslog.NewNopLogger(), pdus, auths, nil, faults)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go agent.ServePacket(conn)
+		t.Cleanup(func() { conn.Close() })
+		return conn.LocalAddr().String()
+	}
+	agent := serve(simulator.Faults{})
+
+	cases := []struct {
+		name     string
+		target   string
+		auth     string
+		format   string
+		wantCode int
+		wantOut  string
+	}{
+		{name: "success", target: agent, auth: "admin_v3", wantOut: "sysUpTime 12345\n"},
+		{name: "wrong community", target: agent, auth: "private_v2", wantCode: exitConnectFailed},
+		{name: "wrong password", target: agent, auth: "wrong_v3", wantCode: exitAuthFailed},
+		{name: "partial", target: serve(simulator.Faults{NonIncreasingOIDs: true}), wantCode: exitPartialScrape, wantOut: "sysUpTime 12345\n"},
+		{name: "unknown auth", target: agent, auth: "nope", wantCode: exitScrapeFailed},
+		{name: "json", target: agent, format: "json", wantOut: `"metric": "sysUpTime"`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			*scrapeTarget, *scrapeAuth, *scrapeModules = tc.target, tc.auth, []string{"system"}
+			*scrapeFormat = "text"
+			if tc.format != "" {
+				*scrapeFormat = tc.format
+			}
+			var out bytes.Buffer
+			if code := scrape(promslog.NewNopLogger(), &out); code != tc.wantCode {
+				t.Errorf("expected exit code %d, got %d", tc.wantCode, code)
+			}
+			if !strings.Contains(out.String(), tc.wantOut) {
+				t.Errorf("expected output to contain %q, got:\n%s", tc.wantOut, out.String())
+			}
+			if tc.format != "json" {
+				return
+			}
+			var explained []collector.ExplainedPDU
+			if err := json.Unmarshal(out.Bytes(), &explained); err != nil {
+				t.Fatal(err)
+			}
+			if len(explained) != 3 {
+				t.Fatalf("expected 3 PDUs, got %+v", explained)
+			}
+			if m := explained[1].Modules; len(m) != 1 || m[0].Skipped != "no metric for the OID" {
+				t.Errorf("expected ifDescr to be skipped, got %+v", m)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scraper
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// FileScraper replays a recording in the snmprec format, as if it was the
+// device it was recorded from.
+type FileScraper struct {
+	// Sorted by OID.
+	pdus []gosnmp.SnmpPDU
+}
+
+func NewFileScraper(path string) (*FileScraper, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	pdus, err := ReadSnmprec(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading recording %s: %w", path, err)
+	}
+	slices.SortStableFunc(pdus, func(a, b gosnmp.SnmpPDU) int { return CompareOIDs(a.Name, b.Name) })
+	return &FileScraper{pdus: pdus}, nil
+}
+
+// find returns the position of the first PDU not before an OID.
+func (f *FileScraper) find(oid string) (int, bool) {
+	return slices.BinarySearchFunc(f.pdus, oid, func(pdu gosnmp.SnmpPDU, oid string) int { return CompareOIDs(pdu.Name, oid) })
+}
+
+func (f *FileScraper) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	pdus := make([]gosnmp.SnmpPDU, 0, len(oids))
+	for _, oid := range oids {
+		if i, ok := f.find(oid); ok {
+			pdus = append(pdus, f.pdus[i])
+		} else {
+			pdus = append(pdus, gosnmp.SnmpPDU{Name: "." + strings.TrimPrefix(oid, "."), Type: gosnmp.NoSuchInstance})
+		}
+	}
+	return &gosnmp.SnmpPacket{Variables: pdus, Error: gosnmp.NoError}, nil
+}
+
+func (f *FileScraper) WalkAll(oid string) ([]gosnmp.SnmpPDU, error) {
+	var results []gosnmp.SnmpPDU
+	err := f.Walk(oid, func(pdu gosnmp.SnmpPDU) error {
+		results = append(results, pdu)
+		return nil
+	})
+	return results, err
+}
+
+func (f *FileScraper) Walk(oid string, fn func(gosnmp.SnmpPDU) error) error {
+	prefix := strings.TrimPrefix(oid, ".") + "."
+	i, exact := f.find(oid)
+	if exact {
+		i++
+	}
+	found := false
+	for _, pdu := range f.pdus[i:] {
+		if !strings.HasPrefix(strings.TrimPrefix(pdu.Name, "."), prefix) {
+			break
+		}
+		if !hasValue(pdu) {
+			continue
+		}
+		found = true
+		if err := fn(pdu); err != nil {
+			return err
+		}
+	}
+	// Like gosnmp, return the OID itself when it has no subtree.
+	if !found && exact && hasValue(f.pdus[i-1]) {
+		return fn(f.pdus[i-1])
+	}
+	return nil
+}
+
+// hasValue reports whether a PDU holds a value, rather than the answer of a
+// get for a missing OID.
+func hasValue(pdu gosnmp.SnmpPDU) bool {
+	switch pdu.Type {
+	case gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView:
+		return false
+	}
+	return true
+}
+
+func (f *FileScraper) Connect() error {
+	return nil
+}
+
+func (f *FileScraper) Close() error {
+	return nil
+}
+
+func (f *FileScraper) SetOptions(...func(*gosnmp.GoSNMP)) {
+}
@@ -75,8 +75,12 @@ func (g *GoSNMPWrapper) Connect() error {
 	err := g.c.Connect()
 	if err != nil {
 		if errors.Is(err, context.Canceled) {
-			return fmt.Errorf("scrape cancelled after %s (possible timeout) connecting to target %s",
-				time.Since(st), g.c.Target)
+			return fmt.Errorf("scrape cancelled after %s (possible timeout) connecting to target %s: %w",
+				time.Since(st), g.c.Target, err)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("scrape deadline exceeded after %s connecting to target %s: %w",
+				time.Since(st), g.c.Target, err)
 		}
 		return fmt.Errorf("error connecting to target %s: %w", g.c.Target, err)
 	}
@@ -92,10 +96,14 @@ func (g *GoSNMPWrapper) Get(oids []string) (*gosnmp.SnmpPacket, error) {
 	st := time.Now()
 	results, err := g.c.Get(oids)
 	if err != nil {
-		if errors.Is(err, context.Canceled) {
-			err = fmt.Errorf("scrape cancelled after %s (possible timeout) getting target %s",
-				time.Since(st), g.c.Target)
-		} else {
+		switch {
+		case errors.Is(err, context.Canceled):
+			err = fmt.Errorf("scrape cancelled after %s (possible timeout) getting target %s: %w",
+				time.Since(st), g.c.Target, err)
+		case errors.Is(err, context.DeadlineExceeded):
+			err = fmt.Errorf("scrape deadline exceeded after %s getting target %s: %w",
+				time.Since(st), g.c.Target, err)
+		default:
 			err = fmt.Errorf("error getting target %s: %w", g.c.Target, err)
 		}
 		return results, err
@@ -106,23 +114,35 @@ func (g *GoSNMPWrapper) Get(oids []string) (*gosnmp.SnmpPacket, error) {
 
 func (g *GoSNMPWrapper) WalkAll(oid string) ([]gosnmp.SnmpPDU, error) {
 	var results []gosnmp.SnmpPDU
+	err := g.Walk(oid, func(pdu gosnmp.SnmpPDU) error {
+		results = append(results, pdu)
+		return nil
+	})
+	return results, err
+}
+
+func (g *GoSNMPWrapper) Walk(oid string, fn func(gosnmp.SnmpPDU) error) error {
 	var err error
 	g.logger.Debug("Walking subtree", "oid", oid)
 	st := time.Now()
 	if g.c.Version == gosnmp.Version1 {
-		results, err = g.c.WalkAll(oid)
+		err = g.c.Walk(oid, fn)
 	} else {
-		results, err = g.c.BulkWalkAll(oid)
+		err = g.c.BulkWalk(oid, fn)
 	}
 	if err != nil {
-		if errors.Is(err, context.Canceled) {
-			err = fmt.Errorf("scrape canceled after %s (possible timeout) walking target %s",
-				time.Since(st), g.c.Target)
-		} else {
+		switch {
+		case errors.Is(err, context.Canceled):
+			err = fmt.Errorf("scrape canceled after %s (possible timeout) walking target %s: %w",
+				time.Since(st), g.c.Target, err)
+		case errors.Is(err, context.DeadlineExceeded):
+			err = fmt.Errorf("scrape deadline exceeded after %s walking target %s: %w",
+				time.Since(st), g.c.Target, err)
+		default:
 			err = fmt.Errorf("error walking target %s: %w", g.c.Target, err)
 		}
-		return results, err
+		return err
 	}
 	g.logger.Debug("Walk of subtree completed", "oid", oid, "duration_seconds", time.Since(st))
-	return results, err
+	return nil
 }
@@ -29,6 +29,8 @@ func NewMockSNMPScraper(get map[string]gosnmp.SnmpPDU, walk map[string][]gosnmp.
 type mockSNMPScraper struct {
 	GetResponses  map[string]gosnmp.SnmpPDU
 	WalkResponses map[string][]gosnmp.SnmpPDU
+	GetErrors     map[string]error
+	WalkErrors    map[string]error
 	ConnectError  error
 	CloseError    error
 
@@ -45,6 +47,12 @@ func (m *mockSNMPScraper) CallWalk() []string {
 }
 
 func (m *mockSNMPScraper) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	for _, oid := range oids {
+		if err, exists := m.GetErrors[oid]; exists {
+			m.callGet = append(m.callGet, oids...)
+			return nil, err
+		}
+	}
 	pdus := make([]gosnmp.SnmpPDU, 0, len(oids))
 	for _, oid := range oids {
 		if response, exists := m.GetResponses[oid]; exists {
@@ -67,9 +75,19 @@ func (m *mockSNMPScraper) Get(oids []string) (*gosnmp.SnmpPacket, error) {
 func (m *mockSNMPScraper) WalkAll(baseOID string) ([]gosnmp.SnmpPDU, error) {
 	m.callWalk = append(m.callWalk, baseOID)
 	if pdus, exists := m.WalkResponses[baseOID]; exists {
-		return pdus, nil
+		return pdus, m.WalkErrors[baseOID]
+	}
+	return nil, m.WalkErrors[baseOID]
+}
+
+func (m *mockSNMPScraper) Walk(baseOID string, fn func(gosnmp.SnmpPDU) error) error {
+	pdus, err := m.WalkAll(baseOID)
+	for _, pdu := range pdus {
+		if err := fn(pdu); err != nil {
+			return err
+		}
 	}
-	return nil, nil
+	return err
 }
 
 func (m *mockSNMPScraper) Connect() error {
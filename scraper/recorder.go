@@ -0,0 +1,96 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scraper
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// Recorder records the PDUs returned to scrapers, so that they can be
+// replayed with a FileScraper.
+type Recorder struct {
+	mu   sync.Mutex
+	pdus map[string]gosnmp.SnmpPDU
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{pdus: map[string]gosnmp.SnmpPDU{}}
+}
+
+// Wrap returns a scraper that records the PDUs returned by s.
+func (r *Recorder) Wrap(s SNMPScraper) SNMPScraper {
+	return &recordingScraper{SNMPScraper: s, recorder: r}
+}
+
+func (r *Recorder) record(pdus ...gosnmp.SnmpPDU) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, pdu := range pdus {
+		name := "." + strings.TrimPrefix(pdu.Name, ".")
+		if old, ok := r.pdus[name]; ok && !hasValue(pdu) && hasValue(old) {
+			// Keep the value a walk found.
+			continue
+		}
+		pdu.Name = name
+		r.pdus[name] = pdu
+	}
+}
+
+// PDUs returns the recorded PDUs, sorted by OID.
+func (r *Recorder) PDUs() []gosnmp.SnmpPDU {
+	r.mu.Lock()
+	pdus := make([]gosnmp.SnmpPDU, 0, len(r.pdus))
+	for _, pdu := range r.pdus {
+		pdus = append(pdus, pdu)
+	}
+	r.mu.Unlock()
+	slices.SortFunc(pdus, func(a, b gosnmp.SnmpPDU) int { return CompareOIDs(a.Name, b.Name) })
+	return pdus
+}
+
+// Write writes the recorded PDUs in the snmprec format.
+func (r *Recorder) Write(w io.Writer) error {
+	return WriteSnmprec(w, r.PDUs())
+}
+
+type recordingScraper struct {
+	SNMPScraper
+	recorder *Recorder
+}
+
+func (s *recordingScraper) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	packet, err := s.SNMPScraper.Get(oids)
+	if packet != nil && packet.Error == gosnmp.NoError {
+		s.recorder.record(packet.Variables...)
+	}
+	return packet, err
+}
+
+func (s *recordingScraper) WalkAll(oid string) ([]gosnmp.SnmpPDU, error) {
+	pdus, err := s.SNMPScraper.WalkAll(oid)
+	s.recorder.record(pdus...)
+	return pdus, err
+}
+
+func (s *recordingScraper) Walk(oid string, fn func(gosnmp.SnmpPDU) error) error {
+	return s.SNMPScraper.Walk(oid, func(pdu gosnmp.SnmpPDU) error {
+		s.recorder.record(pdu)
+		return fn(pdu)
+	})
+}
@@ -20,6 +20,8 @@ import (
 type SNMPScraper interface {
 	Get([]string) (*gosnmp.SnmpPacket, error)
 	WalkAll(string) ([]gosnmp.SnmpPDU, error)
+	// Walk calls the function for each PDU of the subtree as it arrives.
+	Walk(string, func(gosnmp.SnmpPDU) error) error
 	Connect() error
 	Close() error
 	SetOptions(...func(*gosnmp.GoSNMP))
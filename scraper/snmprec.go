@@ -0,0 +1,178 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scraper
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// The snmprec format has a line for each OID, made of the OID, its ASN.1
+// type and its value, separated by pipes. Values of types marked with an x
+// after the type are hex encoded.
+
+// WriteSnmprec writes PDUs in the snmprec format, sorted by OID.
+func WriteSnmprec(w io.Writer, pdus []gosnmp.SnmpPDU) error {
+	pdus = slices.Clone(pdus)
+	slices.SortFunc(pdus, func(a, b gosnmp.SnmpPDU) int { return CompareOIDs(a.Name, b.Name) })
+	bw := bufio.NewWriter(w)
+	for _, pdu := range pdus {
+		tag := strconv.Itoa(int(pdu.Type))
+		var value string
+		switch v := pdu.Value.(type) {
+		case nil:
+		case int:
+			value = strconv.Itoa(v)
+		case uint:
+			value = strconv.FormatUint(uint64(v), 10)
+		case uint32:
+			value = strconv.FormatUint(uint64(v), 10)
+		case uint64:
+			value = strconv.FormatUint(v, 10)
+		case float32:
+			value = strconv.FormatFloat(float64(v), 'g', -1, 32)
+		case float64:
+			value = strconv.FormatFloat(v, 'g', -1, 64)
+		case string:
+			value = strings.TrimPrefix(v, ".")
+		case []byte:
+			if printable(v) {
+				value = string(v)
+			} else {
+				tag += "x"
+				value = hex.EncodeToString(v)
+			}
+		default:
+			return fmt.Errorf("unsupported value %v of type %T for oid %s", v, v, pdu.Name)
+		}
+		if _, err := fmt.Fprintf(bw, "%s|%s|%s\n", strings.TrimPrefix(pdu.Name, "."), tag, value); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func printable(b []byte) bool {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadSnmprec reads PDUs in the snmprec format. Empty lines and lines starting
+// with # are skipped.
+func ReadSnmprec(r io.Reader) ([]gosnmp.SnmpPDU, error) {
+	var pdus []gosnmp.SnmpPDU
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		pdu, err := parseSnmprecLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		pdus = append(pdus, pdu)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return pdus, nil
+}
+
+func parseSnmprecLine(line string) (gosnmp.SnmpPDU, error) {
+	var pdu gosnmp.SnmpPDU
+	parts := strings.SplitN(line, "|", 3)
+	if len(parts) != 3 {
+		return pdu, fmt.Errorf("expected oid|type|value, got %q", line)
+	}
+	pdu.Name = "." + strings.TrimPrefix(parts[0], ".")
+	tag, isHex := strings.CutSuffix(parts[1], "x")
+	t, err := strconv.ParseUint(tag, 10, 8)
+	if err != nil {
+		return pdu, fmt.Errorf("invalid type %q for oid %s", parts[1], parts[0])
+	}
+	pdu.Type = gosnmp.Asn1BER(t)
+	value := parts[2]
+	if isHex {
+		b, err := hex.DecodeString(value)
+		if err != nil {
+			return pdu, fmt.Errorf("invalid hex value for oid %s: %w", parts[0], err)
+		}
+		value = string(b)
+	}
+
+	switch pdu.Type {
+	case gosnmp.Null, gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView:
+	case gosnmp.Integer:
+		pdu.Value, err = strconv.Atoi(value)
+	case gosnmp.Counter32, gosnmp.Gauge32:
+		var v uint64
+		v, err = strconv.ParseUint(value, 10, 32)
+		pdu.Value = uint(v)
+	case gosnmp.TimeTicks, gosnmp.Uinteger32:
+		var v uint64
+		v, err = strconv.ParseUint(value, 10, 32)
+		pdu.Value = uint32(v)
+	case gosnmp.Counter64:
+		pdu.Value, err = strconv.ParseUint(value, 10, 64)
+	case gosnmp.OpaqueFloat:
+		var v float64
+		v, err = strconv.ParseFloat(value, 32)
+		pdu.Value = float32(v)
+	case gosnmp.OpaqueDouble:
+		pdu.Value, err = strconv.ParseFloat(value, 64)
+	case gosnmp.ObjectIdentifier:
+		pdu.Value = "." + value
+	case gosnmp.IPAddress:
+		pdu.Value = value
+	default:
+		pdu.Value = []byte(value)
+	}
+	if err != nil {
+		return pdu, fmt.Errorf("invalid value for oid %s: %w", parts[0], err)
+	}
+	return pdu, nil
+}
+
+// CompareOIDs compares two OIDs numerically, as an agent orders them.
+func CompareOIDs(a, b string) int {
+	a, b = strings.TrimPrefix(a, "."), strings.TrimPrefix(b, ".")
+	for a != "" && b != "" {
+		var x, y string
+		x, a, _ = strings.Cut(a, ".")
+		y, b, _ = strings.Cut(b, ".")
+		if len(x) != len(y) {
+			// Without leading zeros, the shorter number is smaller.
+			return len(x) - len(y)
+		}
+		if c := strings.Compare(x, y); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
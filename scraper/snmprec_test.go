@@ -0,0 +1,141 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scraper
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+func TestSnmprecRoundTrip(t *testing.T) {
+	pdus := []gosnmp.SnmpPDU{
+		{Name: ".1.3.6.1.2.1.2.2.1.10.10", Type: gosnmp.Counter32, Value: uint(4294967295)},
+		{Name: ".1.3.6.1.2.1.1.1.0", Type: gosnmp.OctetString, Value: []byte("Linux | router")},
+		{Name: ".1.3.6.1.2.1.1.2.0", Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.4.1.8072.3.2.10"},
+		{Name: ".1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: uint32(12345)},
+		{Name: ".1.3.6.1.2.1.2.2.1.6.2", Type: gosnmp.OctetString, Value: []byte{0x00, 0x1b, 0x21, 0x0a, 0xff, 0x7c}},
+		{Name: ".1.3.6.1.2.1.2.2.1.8.2", Type: gosnmp.Integer, Value: -1},
+		{Name: ".1.3.6.1.2.1.4.20.1.1.10.0.0.1", Type: gosnmp.IPAddress, Value: "10.0.0.1"},
+		{Name: ".1.3.6.1.2.1.31.1.1.1.6.2", Type: gosnmp.Counter64, Value: uint64(18446744073709551615)},
+		{Name: ".1.3.6.1.4.1.2021.10.1.6.1", Type: gosnmp.OpaqueFloat, Value: float32(0.25)},
+		{Name: ".1.3.6.1.2.1.1.9.0", Type: gosnmp.NoSuchInstance},
+	}
+	var b strings.Builder
+	if err := WriteSnmprec(&b, pdus); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "1.3.6.1.2.1.2.2.1.6.2|4x|001b210aff7c\n") {
+		t.Errorf("expected binary string to be hex encoded, got:\n%s", b.String())
+	}
+	got, err := ReadSnmprec(strings.NewReader("# Recorded for a test.\n\n" + b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []gosnmp.SnmpPDU{pdus[1], pdus[2], pdus[3], pdus[9], pdus[4], pdus[5], pdus[0], pdus[6], pdus[7], pdus[8]}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected PDUs sorted by OID\n%v\ngot\n%v", want, got)
+	}
+}
+
+func TestReadSnmprecErrors(t *testing.T) {
+	for _, line := range []string{
+		"1.3.6.1.2.1.1.3.0|67",
+		"1.3.6.1.2.1.1.3.0|timeticks|1",
+		"1.3.6.1.2.1.1.3.0|67|-1",
+		"1.3.6.1.2.1.1.1.0|4x|zz",
+	} {
+		if _, err := ReadSnmprec(strings.NewReader(line)); err == nil {
+			t.Errorf("expected error for %q", line)
+		}
+	}
+}
+
+func TestCompareOIDs(t *testing.T) {
+	oids := []string{"1.3.6.1.2.1.2", "1.3.6.1.2.1.10", "1.3.6.1.2.1.10.1", ".1.3.6.1.2.1.11"}
+	for i := range oids {
+		for j := range oids {
+			got := CompareOIDs(oids[i], oids[j])
+			if (got < 0) != (i < j) || (got == 0) != (i == j) {
+				t.Errorf("CompareOIDs(%q, %q) = %d", oids[i], oids[j], got)
+			}
+		}
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	ifDescr := []gosnmp.SnmpPDU{
+		{Name: ".1.3.6.1.2.1.2.2.1.2.1", Type: gosnmp.OctetString, Value: []byte("lo")},
+		{Name: ".1.3.6.1.2.1.2.2.1.2.2", Type: gosnmp.OctetString, Value: []byte("eth0")},
+	}
+	sysUpTime := gosnmp.SnmpPDU{Name: ".1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: uint32(100)}
+	mock := NewMockSNMPScraper(
+		map[string]gosnmp.SnmpPDU{"1.3.6.1.2.1.1.3.0": sysUpTime},
+		map[string][]gosnmp.SnmpPDU{"1.3.6.1.2.1.2.2.1.2": ifDescr},
+	)
+
+	rec := NewRecorder()
+	s := rec.Wrap(mock)
+	if err := s.Walk("1.3.6.1.2.1.2.2.1.2", func(gosnmp.SnmpPDU) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get([]string{"1.3.6.1.2.1.1.3.0", "1.3.6.1.2.1.1.9.0"}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "device.snmprec")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Write(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	replay, err := NewFileScraper(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	walked, err := replay.WalkAll("1.3.6.1.2.1.2.2.1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(walked, ifDescr) {
+		t.Errorf("expected walk %v, got %v", ifDescr, walked)
+	}
+	// Walking a single OID returns it, as a device does.
+	walked, err = replay.WalkAll("1.3.6.1.2.1.1.3.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(walked, []gosnmp.SnmpPDU{sysUpTime}) {
+		t.Errorf("expected walk %v, got %v", sysUpTime, walked)
+	}
+	packet, err := replay.Get([]string{"1.3.6.1.2.1.1.3.0", "1.3.6.1.2.1.1.9.0", "1.3.6.1.2.1.1.5.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []gosnmp.SnmpPDU{
+		sysUpTime,
+		{Name: ".1.3.6.1.2.1.1.9.0", Type: gosnmp.NoSuchObject},
+		{Name: ".1.3.6.1.2.1.1.5.0", Type: gosnmp.NoSuchInstance},
+	}
+	if !reflect.DeepEqual(packet.Variables, want) {
+		t.Errorf("expected get %v, got %v", want, packet.Variables)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+const sdPath = "/sd"
+
+// targetGroup is a target group in the Prometheus HTTP service discovery format.
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// targetGroups builds one target group per inventory target, sorted by name.
+// The labels pass the inventory settings to the prober as URL parameters.
+func targetGroups(conf *config.Config) []targetGroup {
+	names := make([]string, 0, len(conf.Targets))
+	for name := range conf.Targets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	groups := make([]targetGroup, 0, len(names))
+	for _, name := range names {
+		t := conf.Targets[name]
+		labels := map[string]string{}
+		if t.Auth != "" {
+			labels["__param_auth"] = t.Auth
+		}
+		if len(t.Modules) > 0 {
+			labels["__param_module"] = strings.Join(t.Modules, ",")
+		}
+		if t.SNMPContext != "" {
+			labels["__param_snmp_context"] = t.SNMPContext
+		}
+		if t.SNMPEngineID != "" {
+			labels["__param_snmp_engineid"] = t.SNMPEngineID
+		}
+		groups = append(groups, targetGroup{Targets: []string{name}, Labels: labels})
+	}
+	return groups
+}
+
+func sdHandler(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	sc.mu.RLock()
+	groups := targetGroups(sc.C)
+	sc.mu.RUnlock()
+	b, err := json.Marshal(groups)
+	if err != nil {
+		logger.Error("Error marshaling service discovery targets", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
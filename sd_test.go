@@ -0,0 +1,52 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSDHandler(t *testing.T) {
+	sc = &SafeConfig{}
+	if err := sc.ReloadConfig(nopLogger, []string{"testdata/snmp-targets.yml"}, false); err != nil {
+		t.Fatalf("Error loading config %v: %v", "testdata/snmp-targets.yml", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, sdPath, http.NoBody)
+	resp := httptest.NewRecorder()
+	sdHandler(resp, req, nopLogger)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.Code)
+	}
+	if ct := resp.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected JSON content type, got %q", ct)
+	}
+	want := `[{"targets":["core1"],"labels":{"__param_auth":"private_v2","__param_module":"if_mib,system","__param_snmp_context":"vrf-mgmt"}},{"targets":["edge1"]}]`
+	if resp.Body.String() != want {
+		t.Fatalf("unexpected response body:\n%s\nwant:\n%s", resp.Body.String(), want)
+	}
+
+	// A reload without an inventory must be reflected immediately.
+	if err := sc.ReloadConfig(nopLogger, []string{"testdata/snmp-auth.yml"}, false); err != nil {
+		t.Fatalf("Error loading config %v: %v", "testdata/snmp-auth.yml", err)
+	}
+	resp = httptest.NewRecorder()
+	sdHandler(resp, req, nopLogger)
+	if resp.Body.String() != "[]" {
+		t.Fatalf("expected no targets after reload, got %s", resp.Body.String())
+	}
+}
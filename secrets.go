@@ -0,0 +1,49 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+var secretFilesCheckInterval = kingpin.Flag("config.secret-files-check-interval", "How often the files that secrets are read from are checked for changes, reloading the configuration when they do. 0 disables the checks.").Default("1m").Duration()
+
+// secretFiles detects changes to the files that secrets are read from.
+type secretFiles struct {
+	sums map[string][sha256.Size]byte
+}
+
+// changed reports whether any of the files changed since the last call. Files
+// that weren't checked in the last call are only remembered.
+func (s *secretFiles) changed(paths []string) bool {
+	sums := make(map[string][sha256.Size]byte, len(paths))
+	changed := false
+	for _, path := range paths {
+		// A file that can't be read has the zero sum, so that reading it
+		// again counts as a change.
+		var sum [sha256.Size]byte
+		if content, err := os.ReadFile(path); err == nil {
+			sum = sha256.Sum256(content)
+		}
+		if last, ok := s.sums[path]; ok && last != sum {
+			changed = true
+		}
+		sums[path] = sum
+	}
+	s.sums = sums
+	return changed
+}
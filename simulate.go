@@ -0,0 +1,109 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/alecthomas/kingpin/v2"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+	"github.com/prometheus/snmp_exporter/simulator"
+)
+
+var (
+	simulateCommand       = kingpin.Command("simulate", "Run an SNMP agent that answers with the values of a recording.")
+	simulateData          = simulateCommand.Flag("data", "Path to the snmprec file to answer with.").Required().String()
+	simulateListen        = simulateCommand.Flag("listen", "Address to listen on, such as udp://127.0.0.1:1161 or tcp://127.0.0.1:1161. Repeatable.").Default("127.0.0.1:1161").Strings()
+	simulateAuths         = simulateCommand.Flag("auth", "Auth of the configuration file whose community or user is accepted. Repeatable, defaults to all auths.").Strings()
+	simulateEngineID      = simulateCommand.Flag("engine-id", "Engine ID in hex of the agent for v3, random if unset.").String()
+	simulateDropRate      = simulateCommand.Flag("drop-rate", "Fraction of requests that are not answered.").Default("0").Float64()
+	simulateLatency       = simulateCommand.Flag("latency", "Delay before answering each request.").Default("0s").Duration()
+	simulateMaxVariables  = simulateCommand.Flag("too-big", "Answer tooBig to requests whose answer would have more variables than this, 0 for no limit.").Default("0").Int()
+	simulateNonIncreasing = simulateCommand.Flag("non-increasing-oids", "Start the answers to GetNext and GetBulk requests with the requested OID, so that OIDs are not increasing.").Default("false").Bool()
+)
+
+// simulate runs the agent of the simulate command, until it fails.
+func simulate(logger *slog.Logger) error {
+	conf, err := config.LoadFile(logger, *configFile, *expandEnvVars)
+	if err != nil {
+		return fmt.Errorf("error parsing config file: %w", err)
+	}
+	names := *simulateAuths
+	if len(names) == 0 {
+		for name := range conf.Auths {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+	}
+	var auths []*config.Auth
+	for _, name := range names {
+		auth, ok := conf.Auths[name]
+		if !ok {
+			return fmt.Errorf("unknown auth '%s'", name)
+		}
+		// The auths of a chain are served on their own.
+		if len(auth.Chain) > 0 {
+			continue
+		}
+		auth, err := auth.ResolveSecrets(context.Background())
+		if err != nil {
+			return fmt.Errorf("auth '%s': %w", name, err)
+		}
+		auths = append(auths, auth)
+	}
+
+	f, err := os.Open(*simulateData)
+	if err != nil {
+		return err
+	}
+	pdus, err := scraper.ReadSnmprec(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", *simulateData, err)
+	}
+	if *simulateDropRate < 0 || *simulateDropRate > 1 {
+		return fmt.Errorf("drop rate must be between 0 and 1")
+	}
+	engineID, err := hex.DecodeString(*simulateEngineID)
+	if err != nil {
+		return fmt.Errorf("invalid engine ID: %w", err)
+	}
+	agent, err := simulator.NewAgent(logger, pdus, auths, engineID, simulator.Faults{
+		DropRate:          *simulateDropRate,
+		Latency:           *simulateLatency,
+		MaxVariables:      *simulateMaxVariables,
+		NonIncreasingOIDs: *simulateNonIncreasing,
+	})
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, len(*simulateListen))
+	for _, addr := range *simulateListen {
+		logger.Info("Simulating agent", "address", addr, "data", *simulateData, "oids", len(pdus), "auths", names)
+		go func() {
+			if err := agent.ListenAndServe(addr); err != nil {
+				errs <- fmt.Errorf("error listening on %s: %w", addr, err)
+			}
+		}()
+	}
+	return <-errs
+}
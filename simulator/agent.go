@@ -0,0 +1,451 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+const (
+	// Large enough for any request sent over UDP.
+	maxMessageSize = 65535
+	tcpIdleTimeout = 5 * time.Minute
+	// Answers to GetBulk requests are cut short at this many variables, as
+	// agents do to fit them in a message.
+	maxBulkVariables = 500
+)
+
+// Faults are ways for an agent to misbehave, to exercise the error handling
+// of managers.
+type Faults struct {
+	// The fraction of requests that are not answered.
+	DropRate float64
+	// How long to wait before answering a request.
+	Latency time.Duration
+	// Requests whose answer would have more variables than this are answered
+	// with tooBig. 0 for no limit.
+	MaxVariables int
+	// Answers to GetNext and GetBulk requests start with the value of the
+	// requested OID, so that the OIDs returned are not increasing.
+	NonIncreasingOIDs bool
+}
+
+// Agent answers Get, GetNext and GetBulk requests from v1, v2c and v3
+// managers with the values of a recording, using the communities and users
+// of auths.
+type Agent struct {
+	logger *slog.Logger
+	// Sorted by OID, without the PDUs that hold no value.
+	pdus     []gosnmp.SnmpPDU
+	faults   Faults
+	engineID string
+	start    time.Time
+
+	communities map[string]bool
+	users       []*config.Auth
+	// Decodes v3 requests, with the users localized to the engine ID.
+	engine *gosnmp.GoSNMP
+
+	mu sync.Mutex
+	// The counters of the reports sent, by OID.
+	reports map[string]uint32
+}
+
+// NewAgent creates an Agent. The engine ID identifies the agent to v3
+// managers, a random one is used if it is empty.
+func NewAgent(logger *slog.Logger, pdus []gosnmp.SnmpPDU, auths []*config.Auth, engineID []byte, faults Faults) (*Agent, error) {
+	if len(engineID) == 0 {
+		// A local engine ID in the octets format of RFC 3411.
+		engineID = make([]byte, 13)
+		copy(engineID, []byte{0x80, 0x00, 0x00, 0x00, 0x05})
+		rand.Read(engineID[5:])
+	}
+	a := &Agent{
+		logger:      logger,
+		faults:      faults,
+		engineID:    string(engineID),
+		start:       time.Now(),
+		communities: map[string]bool{},
+		reports:     map[string]uint32{},
+	}
+	for _, pdu := range pdus {
+		switch pdu.Type {
+		case gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView:
+			continue
+		}
+		a.pdus = append(a.pdus, pdu)
+	}
+	slices.SortStableFunc(a.pdus, func(x, y gosnmp.SnmpPDU) int { return scraper.CompareOIDs(x.Name, y.Name) })
+	a.pdus = slices.CompactFunc(a.pdus, func(x, y gosnmp.SnmpPDU) bool { return scraper.CompareOIDs(x.Name, y.Name) == 0 })
+
+	table := gosnmp.NewSnmpV3SecurityParametersTable(gosnmp.Logger{})
+	for _, auth := range auths {
+		if auth.Version != 3 {
+			a.communities[string(auth.Community)] = true
+			continue
+		}
+		a.users = append(a.users, auth)
+		g := &gosnmp.GoSNMP{}
+		auth.ConfigureSNMP(g, "")
+		usm := g.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+		if err := auth.LocalizeKeys(usm, a.engineID); err != nil {
+			return nil, fmt.Errorf("error localizing keys of user %q: %w", auth.Username, err)
+		}
+		if err := table.Add(auth.Username, usm); err != nil {
+			return nil, fmt.Errorf("error localizing keys of user %q: %w", auth.Username, err)
+		}
+	}
+	a.engine = &gosnmp.GoSNMP{
+		Version:                     gosnmp.Version3,
+		SecurityModel:               gosnmp.UserSecurityModel,
+		TrapSecurityParametersTable: table,
+	}
+	return a, nil
+}
+
+// ListenAndServe listens on a UDP address, or a TCP address when it is
+// prefixed with tcp://, and answers the requests sent to it.
+func (a *Agent) ListenAndServe(addr string) error {
+	if addr, ok := strings.CutPrefix(addr, "tcp://"); ok {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		return a.ServeStream(l)
+	}
+	conn, err := net.ListenPacket("udp", strings.TrimPrefix(addr, "udp://"))
+	if err != nil {
+		return err
+	}
+	return a.ServePacket(conn)
+}
+
+// ServePacket answers the requests received on a packet connection, until
+// the connection is closed.
+func (a *Agent) ServePacket(conn net.PacketConn) error {
+	defer conn.Close()
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		msg := slices.Clone(buf[:n])
+		// Answer concurrently, so that latency doesn't hold up other requests.
+		go func() {
+			if resp := a.handle(msg, addr); resp != nil {
+				if _, err := conn.WriteTo(resp, addr); err != nil {
+					a.logger.Debug("Error sending response", "source", addr, "err", err)
+				}
+			}
+		}()
+	}
+}
+
+// ServeStream answers the requests sent over the connections of a stream
+// listener, until the listener is closed.
+func (a *Agent) ServeStream(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go a.serveConn(conn)
+	}
+}
+
+func (a *Agent) serveConn(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		msg, err := readMessage(br)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				a.logger.Debug("Error reading request", "source", conn.RemoteAddr(), "err", err)
+			}
+			return
+		}
+		if resp := a.handle(msg, conn.RemoteAddr()); resp != nil {
+			if _, err := conn.Write(resp); err != nil {
+				a.logger.Debug("Error sending response", "source", conn.RemoteAddr(), "err", err)
+				return
+			}
+		}
+	}
+}
+
+// readMessage reads a BER encoded message from a stream.
+func readMessage(br *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 2, 6)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 {
+			return nil, fmt.Errorf("invalid message length")
+		}
+		header = header[:2+n]
+		if _, err := io.ReadFull(br, header[2:]); err != nil {
+			return nil, err
+		}
+		length = 0
+		for _, b := range header[2:] {
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes is too large", length)
+	}
+	msg := make([]byte, len(header)+length)
+	copy(msg, header)
+	if _, err := io.ReadFull(br, msg[len(header):]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// handle processes a request, and returns the response to send back if any.
+func (a *Agent) handle(msg []byte, addr net.Addr) []byte {
+	logger := a.logger.With("source", addr)
+	if a.faults.DropRate > 0 && mathrand.Float64() < a.faults.DropRate {
+		logger.Debug("Dropping request")
+		return nil
+	}
+	if a.faults.Latency > 0 {
+		time.Sleep(a.faults.Latency)
+	}
+
+	var version struct {
+		Version int
+	}
+	if _, err := asn1.Unmarshal(msg, &version); err != nil {
+		logger.Debug("Error decoding request", "err", err)
+		return nil
+	}
+	var (
+		request *gosnmp.SnmpPacket
+		err     error
+	)
+	if gosnmp.SnmpVersion(version.Version) == gosnmp.Version3 {
+		var report []byte
+		request, report, err = a.decodeV3(msg)
+		if report != nil {
+			return report
+		}
+	} else {
+		request, err = a.decodeCommunity(msg)
+	}
+	if err != nil {
+		logger.Debug("Dropping request", "err", err)
+		return nil
+	}
+
+	response, ok := a.answer(request)
+	if !ok {
+		logger.Debug("Dropping unsupported PDU", "type", request.PDUType)
+		return nil
+	}
+	logger.Debug("Answering request", "type", request.PDUType, "variables", len(response.Variables), "error", response.Error)
+	resp, err := response.MarshalMsg()
+	if err != nil {
+		logger.Debug("Error encoding response", "err", err)
+		return nil
+	}
+	return resp
+}
+
+// decodeCommunity decodes a v1 or v2c request, if its community is accepted.
+func (a *Agent) decodeCommunity(msg []byte) (*gosnmp.SnmpPacket, error) {
+	var header struct {
+		Version   int
+		Community []byte
+	}
+	if _, err := asn1.Unmarshal(msg, &header); err != nil {
+		return nil, err
+	}
+	if !a.communities[string(header.Community)] {
+		return nil, fmt.Errorf("unknown community")
+	}
+	g := &gosnmp.GoSNMP{}
+	return g.UnmarshalTrap(msg, false)
+}
+
+// answer builds the response to a request, if it is a Get, GetNext or
+// GetBulk request.
+func (a *Agent) answer(request *gosnmp.SnmpPacket) (*gosnmp.SnmpPacket, bool) {
+	v1 := request.Version == gosnmp.Version1
+	var (
+		vars       []gosnmp.SnmpPDU
+		errStatus  = gosnmp.NoError
+		errorIndex uint8
+	)
+	// missing is the answer for an OID that has no value, or no next OID.
+	missing := func(i int, pdu gosnmp.SnmpPDU) {
+		if v1 {
+			if errStatus == gosnmp.NoError {
+				errStatus, errorIndex = gosnmp.NoSuchName, uint8(i+1)
+			}
+			vars = append(vars, gosnmp.SnmpPDU{Name: pdu.Name, Type: gosnmp.Null})
+		} else {
+			vars = append(vars, pdu)
+		}
+	}
+
+	switch request.PDUType {
+	case gosnmp.GetRequest:
+		for i, v := range request.Variables {
+			if pdu, ok := a.get(v.Name); ok {
+				vars = append(vars, pdu)
+			} else {
+				missing(i, gosnmp.SnmpPDU{Name: v.Name, Type: gosnmp.NoSuchInstance})
+			}
+		}
+	case gosnmp.GetNextRequest:
+		vars = a.repeatRequested(request)
+		for i, v := range request.Variables {
+			if pdu, ok := a.next(v.Name); ok {
+				vars = append(vars, pdu)
+			} else {
+				missing(i, gosnmp.SnmpPDU{Name: v.Name, Type: gosnmp.EndOfMibView})
+			}
+		}
+	case gosnmp.GetBulkRequest:
+		if v1 {
+			return nil, false
+		}
+		vars = a.repeatRequested(request)
+		nonRepeaters := min(int(request.NonRepeaters), len(request.Variables))
+		for _, v := range request.Variables[:nonRepeaters] {
+			vars = append(vars, a.nextOrEnd(v.Name))
+		}
+		last := make([]string, 0, len(request.Variables)-nonRepeaters)
+		for _, v := range request.Variables[nonRepeaters:] {
+			last = append(last, v.Name)
+		}
+		for r := 0; r < int(request.MaxRepetitions) && len(last) > 0 && len(vars)+len(last) <= maxBulkVariables; r++ {
+			ended := true
+			for i, oid := range last {
+				pdu := a.nextOrEnd(oid)
+				if pdu.Type != gosnmp.EndOfMibView {
+					ended = false
+				}
+				vars = append(vars, pdu)
+				last[i] = pdu.Name
+			}
+			if ended {
+				break
+			}
+		}
+	default:
+		return nil, false
+	}
+
+	if a.faults.MaxVariables > 0 && len(vars) > a.faults.MaxVariables {
+		errStatus, errorIndex = gosnmp.TooBig, 0
+		vars = vars[:0]
+		for _, v := range request.Variables {
+			vars = append(vars, gosnmp.SnmpPDU{Name: v.Name, Type: gosnmp.Null})
+		}
+	}
+
+	response := *request
+	response.PDUType = gosnmp.GetResponse
+	response.NonRepeaters = 0
+	response.MaxRepetitions = 0
+	response.Error = errStatus
+	response.ErrorIndex = errorIndex
+	response.Variables = vars
+	if response.Version == gosnmp.Version3 {
+		response.MsgFlags &^= gosnmp.Reportable
+		if usm, ok := response.SecurityParameters.(*gosnmp.UsmSecurityParameters); ok {
+			usm.AuthoritativeEngineBoots = 1
+			usm.AuthoritativeEngineTime = a.engineTime()
+		}
+	}
+	return &response, true
+}
+
+// repeatRequested returns the value of the first OID of a request, if the
+// agent is to return non-increasing OIDs.
+func (a *Agent) repeatRequested(request *gosnmp.SnmpPacket) []gosnmp.SnmpPDU {
+	if !a.faults.NonIncreasingOIDs || len(request.Variables) == 0 {
+		return nil
+	}
+	if pdu, ok := a.get(request.Variables[0].Name); ok {
+		return []gosnmp.SnmpPDU{pdu}
+	}
+	return nil
+}
+
+// find returns the position of the first PDU not before an OID.
+func (a *Agent) find(oid string) (int, bool) {
+	return slices.BinarySearchFunc(a.pdus, oid, func(pdu gosnmp.SnmpPDU, oid string) int { return scraper.CompareOIDs(pdu.Name, oid) })
+}
+
+func (a *Agent) get(oid string) (gosnmp.SnmpPDU, bool) {
+	if i, ok := a.find(oid); ok {
+		return a.pdus[i], true
+	}
+	return gosnmp.SnmpPDU{}, false
+}
+
+// next returns the PDU following an OID.
+func (a *Agent) next(oid string) (gosnmp.SnmpPDU, bool) {
+	i, ok := a.find(oid)
+	if ok {
+		i++
+	}
+	if i == len(a.pdus) {
+		return gosnmp.SnmpPDU{}, false
+	}
+	return a.pdus[i], true
+}
+
+func (a *Agent) nextOrEnd(oid string) gosnmp.SnmpPDU {
+	if pdu, ok := a.next(oid); ok {
+		return pdu
+	}
+	return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.EndOfMibView}
+}
+
+func (a *Agent) engineTime() uint32 {
+	return uint32(time.Since(a.start).Seconds())
+}
@@ -0,0 +1,276 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+const testData = `1.3.6.1.2.1.1.1.0|4|Test device
+1.3.6.1.2.1.1.3.0|67|12345
+1.3.6.1.2.1.2.2.1.2.1|4|eth0
+1.3.6.1.2.1.2.2.1.2.2|4x|657468ff
+1.3.6.1.2.1.2.2.1.10.1|65|100
+1.3.6.1.2.1.2.2.1.10.2|65|200
+`
+
+var testAuths = map[string]*config.Auth{
+	"public_v1": {Community: "public", Version: 1},
+	"public_v2": {Community: "public", Version: 2},
+	"auth_v3": {
+		Username:      "monitor",
+		SecurityLevel: "authNoPriv",
+		Password:      "maplesyrup",
+		AuthProtocol:  "MD5",
+		Version:       3,
+	},
+	"priv_v3": {
+		Username:      "admin",
+		SecurityLevel: "authPriv",
+		Password:      "maplesyrup",
+		AuthProtocol:  "SHA",
+		PrivPassword:  "maplesyrup",
+		PrivProtocol:  "AES",
+		Version:       3,
+	},
+}
+
+func newTestAgent(t *testing.T, faults Faults) *Agent {
+	t.Helper()
+	pdus, err := scraper.ReadSnmprec(strings.NewReader(testData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var auths []*config.Auth
+	for _, auth := range testAuths {
+		auths = append(auths, auth)
+	}
+	a, err := NewAgent(promslog.NewNopLogger(), pdus, auths, nil, faults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func serveUDP(t *testing.T, a *Agent) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.ServePacket(conn)
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String()
+}
+
+func newTestManager(t *testing.T, transport, addr string, auth *config.Auth) *gosnmp.GoSNMP {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &gosnmp.GoSNMP{
+		Transport: transport,
+		Target:    host,
+		Port:      uint16(p),
+		Timeout:   2 * time.Second,
+		MaxOids:   gosnmp.MaxOids,
+	}
+	auth.ConfigureSNMP(g, "")
+	if err := g.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { g.Conn.Close() })
+	return g
+}
+
+func walk(g *gosnmp.GoSNMP, oid string) ([]string, error) {
+	var oids []string
+	fn := func(pdu gosnmp.SnmpPDU) error {
+		oids = append(oids, pdu.Name)
+		return nil
+	}
+	var err error
+	if g.Version == gosnmp.Version1 {
+		err = g.Walk(oid, fn)
+	} else {
+		err = g.BulkWalk(oid, fn)
+	}
+	return oids, err
+}
+
+func TestAgentAuths(t *testing.T) {
+	a := newTestAgent(t, Faults{})
+	udp := serveUDP(t, a)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.ServeStream(l)
+	t.Cleanup(func() { l.Close() })
+
+	for _, transport := range []string{"udp", "tcp"} {
+		addr := udp
+		if transport == "tcp" {
+			addr = l.Addr().String()
+		}
+		for name, auth := range testAuths {
+			t.Run(transport+"/"+name, func(t *testing.T) {
+				g := newTestManager(t, transport, addr, auth)
+				packet, err := g.Get([]string{"1.3.6.1.2.1.1.1.0", "1.3.6.1.2.1.1.2.0"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if auth.Version == 1 {
+					// v1 has no exceptions, a missing OID fails the whole request.
+					if packet.Error != gosnmp.NoSuchName || packet.ErrorIndex != 2 {
+						t.Errorf("expected noSuchName for the second OID, got %v at %d", packet.Error, packet.ErrorIndex)
+					}
+				} else {
+					if packet.Error != gosnmp.NoError || len(packet.Variables) != 2 {
+						t.Fatalf("unexpected response %+v", packet)
+					}
+					if v := packet.Variables[0]; string(v.Value.([]byte)) != "Test device" {
+						t.Errorf("unexpected value %+v", v)
+					}
+					if v := packet.Variables[1]; v.Type != gosnmp.NoSuchInstance {
+						t.Errorf("expected noSuchInstance, got %+v", v)
+					}
+				}
+
+				oids, err := walk(g, "1.3.6.1.2.1.2.2.1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := ".1.3.6.1.2.1.2.2.1.2.1 .1.3.6.1.2.1.2.2.1.2.2 .1.3.6.1.2.1.2.2.1.10.1 .1.3.6.1.2.1.2.2.1.10.2"
+				if got := strings.Join(oids, " "); got != want {
+					t.Errorf("expected walk to return %s, got %s", want, got)
+				}
+			})
+		}
+	}
+}
+
+func TestAgentRejectsAuth(t *testing.T) {
+	addr := serveUDP(t, newTestAgent(t, Faults{}))
+
+	// The reports sent for a wrong password or security level aren't
+	// authenticated, so gosnmp discards them as it does those of other agents.
+	cases := []struct {
+		name string
+		auth *config.Auth
+		err  error
+	}{
+		{
+			name: "unknown community",
+			auth: &config.Auth{Community: "private", Version: 2},
+		},
+		{
+			name: "wrong password",
+			auth: &config.Auth{Username: "monitor", SecurityLevel: "authNoPriv", Password: "pancakes", AuthProtocol: "MD5", Version: 3},
+		},
+		{
+			name: "unknown user",
+			auth: &config.Auth{Username: "guest", SecurityLevel: "noAuthNoPriv", Version: 3},
+			err:  gosnmp.ErrUnknownUsername,
+		},
+		{
+			name: "security level too low",
+			auth: &config.Auth{Username: "admin", SecurityLevel: "authNoPriv", Password: "maplesyrup", AuthProtocol: "SHA", Version: 3},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := newTestManager(t, "udp", addr, tc.auth)
+			g.Timeout = 100 * time.Millisecond
+			g.Retries = 0
+			_, err := g.Get([]string{"1.3.6.1.2.1.1.1.0"})
+			if err == nil {
+				t.Fatal("expected request to fail")
+			}
+			if tc.err != nil && !errors.Is(err, tc.err) {
+				t.Errorf("expected error %v, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestAgentFaults(t *testing.T) {
+	auth := testAuths["public_v2"]
+
+	t.Run("too big", func(t *testing.T) {
+		g := newTestManager(t, "udp", serveUDP(t, newTestAgent(t, Faults{MaxVariables: 2})), auth)
+		packet, err := g.Get([]string{"1.3.6.1.2.1.1.1.0", "1.3.6.1.2.1.1.3.0"})
+		if err != nil || packet.Error != gosnmp.NoError {
+			t.Fatalf("expected get of two OIDs to succeed, got %v, %v", packet, err)
+		}
+		packet, err = g.Get([]string{"1.3.6.1.2.1.1.1.0", "1.3.6.1.2.1.1.3.0", "1.3.6.1.2.1.2.2.1.2.1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.Error != gosnmp.TooBig {
+			t.Errorf("expected tooBig, got %v", packet.Error)
+		}
+	})
+
+	t.Run("non-increasing OIDs", func(t *testing.T) {
+		g := newTestManager(t, "udp", serveUDP(t, newTestAgent(t, Faults{NonIncreasingOIDs: true})), auth)
+		g.MaxRepetitions = 2
+		if _, err := walk(g, "1.3.6.1.2.1.2.2.1"); err == nil || !strings.Contains(err.Error(), "OID not increasing") {
+			t.Fatalf("expected walk to fail with non-increasing OIDs, got %v", err)
+		}
+		g.AppOpts = map[string]any{"c": true}
+		oids, err := walk(g, "1.3.6.1.2.1.2.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Every answer after the first repeats the last OID of the previous one.
+		if len(oids) != 6 || oids[2] != oids[1] || oids[5] != oids[4] {
+			t.Errorf("unexpected walk %v", oids)
+		}
+	})
+
+	t.Run("drop and latency", func(t *testing.T) {
+		g := newTestManager(t, "udp", serveUDP(t, newTestAgent(t, Faults{DropRate: 1})), auth)
+		g.Timeout = 100 * time.Millisecond
+		g.Retries = 1
+		if _, err := g.Get([]string{"1.3.6.1.2.1.1.1.0"}); err == nil {
+			t.Error("expected dropped request to time out")
+		}
+
+		g = newTestManager(t, "udp", serveUDP(t, newTestAgent(t, Faults{Latency: 200 * time.Millisecond})), auth)
+		start := time.Now()
+		if _, err := g.Get([]string{"1.3.6.1.2.1.1.1.0"}); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d < 200*time.Millisecond {
+			t.Errorf("expected answer to be delayed, got it after %s", d)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"encoding/asn1"
+	"fmt"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// The usmStats counters of RFC 3414, sent in reports.
+const (
+	usmStatsUnsupportedSecLevels = ".1.3.6.1.6.3.15.1.1.1.0"
+	usmStatsUnknownUserNames     = ".1.3.6.1.6.3.15.1.1.3.0"
+	usmStatsUnknownEngineIDs     = ".1.3.6.1.6.3.15.1.1.4.0"
+	usmStatsWrongDigests         = ".1.3.6.1.6.3.15.1.1.5.0"
+)
+
+// v3Header is the start of a v3 message, as defined in RFC 3412.
+type v3Header struct {
+	Version    int
+	GlobalData struct {
+		ID            int
+		MaxSize       int
+		Flags         []byte
+		SecurityModel int
+	}
+	SecurityParameters []byte
+}
+
+// usmHeader is the start of the USM security parameters of a v3 message.
+type usmHeader struct {
+	EngineID []byte
+	Boots    int
+	Time     int
+	UserName []byte
+}
+
+// decodeV3 authenticates and decodes a v3 request. If the request can't be
+// processed, a report is returned instead, which tells the manager why.
+func (a *Agent) decodeV3(msg []byte) (*gosnmp.SnmpPacket, []byte, error) {
+	var header v3Header
+	if _, err := asn1.Unmarshal(msg, &header); err != nil {
+		return nil, nil, err
+	}
+	if header.GlobalData.SecurityModel != int(gosnmp.UserSecurityModel) || len(header.GlobalData.Flags) != 1 {
+		return nil, nil, fmt.Errorf("unsupported security model %d", header.GlobalData.SecurityModel)
+	}
+	var usm usmHeader
+	if _, err := asn1.Unmarshal(header.SecurityParameters, &usm); err != nil {
+		return nil, nil, err
+	}
+	msgID := uint32(header.GlobalData.ID)
+
+	if string(usm.EngineID) != a.engineID {
+		// Engine ID discovery, answered with the engine ID of the agent.
+		// The request ID is only known if the request isn't encrypted.
+		var requestID uint32
+		g := &gosnmp.GoSNMP{
+			Version:            gosnmp.Version3,
+			SecurityModel:      gosnmp.UserSecurityModel,
+			SecurityParameters: &gosnmp.UsmSecurityParameters{},
+		}
+		if packet, err := g.UnmarshalTrap(msg, true); err == nil {
+			requestID = packet.RequestID
+		}
+		return nil, a.report(msgID, requestID, usmStatsUnknownEngineIDs), nil
+	}
+
+	required, ok := a.securityLevel(string(usm.UserName))
+	if !ok {
+		return nil, a.report(msgID, 0, usmStatsUnknownUserNames), nil
+	}
+	if gosnmp.SnmpV3MsgFlags(header.GlobalData.Flags[0])&gosnmp.AuthPriv < required {
+		return nil, a.report(msgID, 0, usmStatsUnsupportedSecLevels), nil
+	}
+	packet, err := a.engine.UnmarshalTrap(msg, true)
+	if err != nil {
+		return nil, a.report(msgID, 0, usmStatsWrongDigests), nil
+	}
+	return packet, nil, nil
+}
+
+// securityLevel returns the lowest security level the auths allow for a
+// user.
+func (a *Agent) securityLevel(userName string) (gosnmp.SnmpV3MsgFlags, bool) {
+	level, found := gosnmp.AuthPriv, false
+	for _, auth := range a.users {
+		if auth.Username != userName {
+			continue
+		}
+		found = true
+		g := &gosnmp.GoSNMP{}
+		auth.ConfigureSNMP(g, "")
+		level = min(level, g.MsgFlags)
+	}
+	return level, found
+}
+
+// report builds a report of one of the usmStats counters, with the engine ID,
+// boots and time of the agent, as described in RFC 3414.
+func (a *Agent) report(msgID, requestID uint32, oid string) []byte {
+	a.mu.Lock()
+	a.reports[oid]++
+	count := a.reports[oid]
+	a.mu.Unlock()
+
+	packet := &gosnmp.SnmpPacket{
+		Version:       gosnmp.Version3,
+		MsgID:         msgID,
+		MsgFlags:      gosnmp.NoAuthNoPriv,
+		SecurityModel: gosnmp.UserSecurityModel,
+		SecurityParameters: &gosnmp.UsmSecurityParameters{
+			AuthoritativeEngineID:    a.engineID,
+			AuthoritativeEngineBoots: 1,
+			AuthoritativeEngineTime:  a.engineTime(),
+		},
+		ContextEngineID: a.engineID,
+		PDUType:         gosnmp.Report,
+		RequestID:       requestID,
+		Variables: []gosnmp.SnmpPDU{
+			{Name: oid, Type: gosnmp.Counter32, Value: uint(count)},
+		},
+	}
+	resp, err := packet.MarshalMsg()
+	if err != nil {
+		a.logger.Debug("Error encoding report", "err", err)
+		return nil
+	}
+	return resp
+}
@@ -0,0 +1,333 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+const (
+	alertsPath = "/api/v2/alerts"
+	// Firing alerts are sent again this often, so that Alertmanager does
+	// not resolve them.
+	resendInterval = time.Minute
+	// Deliveries waiting beyond this are dropped.
+	maxQueuedDeliveries = 100
+)
+
+// The wait before the first retry of a delivery, doubled for each retry.
+var retryBackoff = time.Second
+
+// alertRule is a TrapAlert with its templates parsed.
+type alertRule struct {
+	*config.TrapAlert
+	labels      map[string]*template.Template
+	annotations map[string]*template.Template
+}
+
+func newAlertRule(a *config.TrapAlert) (*alertRule, error) {
+	r := &alertRule{
+		TrapAlert:   a,
+		labels:      map[string]*template.Template{},
+		annotations: map[string]*template.Template{},
+	}
+	for name, text := range a.Labels {
+		tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		r.labels[name] = tmpl
+	}
+	for name, text := range a.Annotations {
+		tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		r.annotations[name] = tmpl
+	}
+	return r, nil
+}
+
+// render executes templates with a trap.
+func render(templates map[string]*template.Template, t Trap, result map[string]string) error {
+	for name, tmpl := range templates {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, t); err != nil {
+			return err
+		}
+		result[name] = b.String()
+	}
+	return nil
+}
+
+// alertLabels returns the labels of the alert a trap raises or clears.
+func (r *alertRule) alertLabels(t Trap) (map[string]string, error) {
+	labels := map[string]string{"alertname": r.Alert, "source": t.Source}
+	if err := render(r.labels, t, labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// alert is an alert in the format of the Alertmanager v2 API.
+type alert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+	// When the alert resolves by itself, zero if only a clearing trap
+	// resolves it.
+	expires time.Time
+}
+
+// fingerprint identifies an alert by its labels.
+func fingerprint(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte(0xff)
+		b.WriteString(labels[name])
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+// alerter raises and resolves alerts for received traps, and delivers them
+// to Alertmanager.
+type alerter struct {
+	logger   *slog.Logger
+	failures prometheus.Counter
+	client   *http.Client
+	queue    chan []alert
+
+	mu     sync.Mutex
+	am     *config.Alertmanager
+	rules  map[string][]*alertRule
+	clears map[string][]*alertRule
+	active map[string]*alert
+}
+
+func newAlerter(logger *slog.Logger, failures prometheus.Counter) *alerter {
+	return &alerter{
+		logger:   logger,
+		failures: failures,
+		client:   &http.Client{},
+		queue:    make(chan []alert, maxQueuedDeliveries),
+		rules:    map[string][]*alertRule{},
+		clears:   map[string][]*alertRule{},
+		active:   map[string]*alert{},
+	}
+}
+
+// update applies the alerts of a configuration. Alerts that are firing keep
+// firing until they are cleared or expire.
+func (a *alerter) update(traps config.Traps) {
+	rules := map[string][]*alertRule{}
+	clears := map[string][]*alertRule{}
+	for _, ta := range traps.Alerts {
+		r, err := newAlertRule(ta)
+		if err != nil {
+			// Already checked when loading the configuration.
+			a.logger.Error("Error parsing trap alert", "alert", ta.Alert, "err", err)
+			continue
+		}
+		rules[ta.TrapOID] = append(rules[ta.TrapOID], r)
+		if ta.ClearOID != "" {
+			clears[ta.ClearOID] = append(clears[ta.ClearOID], r)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.am = traps.Alertmanager
+	a.rules = rules
+	a.clears = clears
+	if a.am == nil {
+		a.active = map[string]*alert{}
+	}
+}
+
+// handle raises the alerts for a trap, and resolves the alerts it clears.
+func (a *alerter) handle(t Trap, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var send []alert
+	for _, r := range a.rules[t.OID] {
+		labels, err := r.alertLabels(t)
+		if err != nil {
+			a.logger.Debug("Error rendering alert labels", "alert", r.Alert, "err", err)
+			continue
+		}
+		annotations := map[string]string{}
+		if err := render(r.annotations, t, annotations); err != nil {
+			a.logger.Debug("Error rendering alert annotations", "alert", r.Alert, "err", err)
+			continue
+		}
+		key := fingerprint(labels)
+		al, ok := a.active[key]
+		if !ok {
+			al = &alert{Labels: labels, StartsAt: now}
+			a.active[key] = al
+		}
+		al.Annotations = annotations
+		al.expires = time.Time{}
+		if r.TTL > 0 {
+			al.expires = now.Add(r.TTL)
+		}
+		al.EndsAt = endsAt(al, now)
+		send = append(send, *al)
+	}
+	for _, r := range a.clears[t.OID] {
+		labels, err := r.alertLabels(t)
+		if err != nil {
+			a.logger.Debug("Error rendering alert labels", "alert", r.Alert, "err", err)
+			continue
+		}
+		key := fingerprint(labels)
+		if al, ok := a.active[key]; ok {
+			delete(a.active, key)
+			al.EndsAt = now
+			send = append(send, *al)
+		}
+	}
+	a.enqueue(send)
+}
+
+// endsAt returns when a firing alert ends, unless it is sent again.
+func endsAt(al *alert, now time.Time) time.Time {
+	end := now.Add(4 * resendInterval)
+	if !al.expires.IsZero() && al.expires.Before(end) {
+		return al.expires
+	}
+	return end
+}
+
+// resend sends the firing alerts again, and the alerts that expired as
+// resolved.
+func (a *alerter) resend(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var send []alert
+	for key, al := range a.active {
+		if !al.expires.IsZero() && !al.expires.After(now) {
+			delete(a.active, key)
+			al.EndsAt = al.expires
+		} else {
+			al.EndsAt = endsAt(al, now)
+		}
+		send = append(send, *al)
+	}
+	a.enqueue(send)
+}
+
+// enqueue queues alerts for delivery, without blocking the receipt of traps.
+func (a *alerter) enqueue(alerts []alert) {
+	if len(alerts) == 0 || a.am == nil {
+		return
+	}
+	select {
+	case a.queue <- alerts:
+	default:
+		a.logger.Error("Dropping alerts, too many deliveries queued", "alerts", len(alerts))
+		a.failures.Inc()
+	}
+}
+
+// run delivers the queued alerts and resends firing alerts, until the
+// context is done.
+func (a *alerter) run(ctx context.Context) {
+	ticker := time.NewTicker(resendInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			a.resend(now)
+		case alerts := <-a.queue:
+			a.mu.Lock()
+			am := a.am
+			a.mu.Unlock()
+			if am == nil {
+				continue
+			}
+			if err := a.deliver(ctx, am, alerts); err != nil {
+				a.logger.Error("Error sending alerts to Alertmanager", "url", am.URL, "alerts", len(alerts), "err", err)
+				a.failures.Inc()
+			}
+		}
+	}
+}
+
+// deliver posts alerts to Alertmanager, retrying with a backoff.
+func (a *alerter) deliver(ctx context.Context, am *config.Alertmanager, alerts []alert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		err = a.post(ctx, am, body)
+		if err == nil || attempt >= am.Retries {
+			return err
+		}
+		a.logger.Debug("Retrying alert delivery", "url", am.URL, "err", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (a *alerter) post(ctx context.Context, am *config.Alertmanager, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, am.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(am.URL, "/")+alertsPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
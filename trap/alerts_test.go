@@ -0,0 +1,165 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trap
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+// newTestAlerter returns an alerter delivering to a test Alertmanager, which
+// answers with the given status codes in turn and then with 200.
+func newTestAlerter(t *testing.T, statuses ...int) (*alerter, <-chan []alert) {
+	t.Helper()
+	received := make(chan []alert, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != alertsPath {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		if len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+			return
+		}
+		var alerts []alert
+		if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+			t.Errorf("error decoding alerts: %v", err)
+		}
+		received <- alerts
+	}))
+	t.Cleanup(srv.Close)
+
+	a := newAlerter(promslog.NewNopLogger(), prometheus.NewCounter(prometheus.CounterOpts{Name: "failures"}))
+	a.update(config.Traps{
+		Alertmanager: &config.Alertmanager{URL: srv.URL, Retries: 2, Timeout: time.Second},
+		Alerts: []*config.TrapAlert{
+			{
+				Alert:       "LinkDown",
+				TrapOID:     "1.3.6.1.6.3.1.1.5.3",
+				ClearOID:    "1.3.6.1.6.3.1.1.5.4",
+				Labels:      map[string]string{"interface": "{{ .Labels.ifDescr }}"},
+				Annotations: map[string]string{"summary": "{{ .Name }} on {{ .Labels.ifDescr }}"},
+			},
+			{
+				Alert:   "PowerSupplyChange",
+				TrapOID: "1.3.6.1.4.1.9.9.117.2.0.2",
+				TTL:     time.Hour,
+			},
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go a.run(ctx)
+	return a, received
+}
+
+func receiveAlerts(t *testing.T, ch <-chan []alert) []alert {
+	t.Helper()
+	select {
+	case alerts := <-ch:
+		return alerts
+	case <-time.After(5 * time.Second):
+		t.Fatal("no alerts delivered")
+		return nil
+	}
+}
+
+func TestAlerterClearingTrap(t *testing.T) {
+	a, received := newTestAlerter(t)
+	now := time.Now().Truncate(time.Second).UTC()
+	down := Trap{Source: "192.0.2.1", OID: "1.3.6.1.6.3.1.1.5.3", Name: "linkDown", Labels: map[string]string{"ifDescr": "eth0"}}
+
+	a.handle(down, now)
+	alerts := receiveAlerts(t, received)
+	wantLabels := map[string]string{"alertname": "LinkDown", "source": "192.0.2.1", "interface": "eth0"}
+	if len(alerts) != 1 || !reflect.DeepEqual(alerts[0].Labels, wantLabels) {
+		t.Fatalf("expected alert with labels %v, got %+v", wantLabels, alerts)
+	}
+	if alerts[0].Annotations["summary"] != "linkDown on eth0" {
+		t.Errorf("unexpected annotations %v", alerts[0].Annotations)
+	}
+	if !alerts[0].EndsAt.After(now) {
+		t.Errorf("expected firing alert, ends at %v", alerts[0].EndsAt)
+	}
+
+	// A linkUp of another interface clears nothing.
+	a.handle(Trap{Source: "192.0.2.1", OID: "1.3.6.1.6.3.1.1.5.4", Labels: map[string]string{"ifDescr": "eth1"}}, now)
+	a.handle(Trap{Source: "192.0.2.1", OID: "1.3.6.1.6.3.1.1.5.4", Labels: map[string]string{"ifDescr": "eth0"}}, now.Add(time.Minute))
+	alerts = receiveAlerts(t, received)
+	if len(alerts) != 1 || !reflect.DeepEqual(alerts[0].Labels, wantLabels) {
+		t.Fatalf("expected alert with labels %v, got %+v", wantLabels, alerts)
+	}
+	if !alerts[0].StartsAt.Equal(now) || !alerts[0].EndsAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected alert resolved at %v, got %+v", now.Add(time.Minute), alerts[0])
+	}
+	if len(a.active) != 0 {
+		t.Errorf("expected no active alerts, got %d", len(a.active))
+	}
+}
+
+func TestAlerterTTL(t *testing.T) {
+	a, received := newTestAlerter(t)
+	now := time.Now().Truncate(time.Second).UTC()
+	a.handle(Trap{Source: "192.0.2.1", OID: "1.3.6.1.4.1.9.9.117.2.0.2"}, now)
+	if alerts := receiveAlerts(t, received); len(alerts) != 1 {
+		t.Fatalf("expected 1 alert, got %+v", alerts)
+	}
+
+	a.resend(now.Add(30 * time.Minute))
+	alerts := receiveAlerts(t, received)
+	if len(alerts) != 1 || !alerts[0].EndsAt.After(now.Add(30*time.Minute)) {
+		t.Fatalf("expected firing alert, got %+v", alerts)
+	}
+
+	a.resend(now.Add(2 * time.Hour))
+	alerts = receiveAlerts(t, received)
+	if len(alerts) != 1 || !alerts[0].EndsAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("expected alert resolved at %v, got %+v", now.Add(time.Hour), alerts)
+	}
+	if len(a.active) != 0 {
+		t.Errorf("expected no active alerts, got %d", len(a.active))
+	}
+}
+
+func TestAlerterRetries(t *testing.T) {
+	retryBackoff = time.Millisecond
+	defer func() { retryBackoff = time.Second }()
+
+	a, received := newTestAlerter(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	a.handle(Trap{Source: "192.0.2.1", OID: "1.3.6.1.4.1.9.9.117.2.0.2"}, time.Now())
+	receiveAlerts(t, received)
+	if v := metricValue(a.failures); v != 0 {
+		t.Errorf("expected no failures, got %v", v)
+	}
+
+	a, _ = newTestAlerter(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	a.handle(Trap{Source: "192.0.2.1", OID: "1.3.6.1.4.1.9.9.117.2.0.2"}, time.Now())
+	deadline := time.Now().Add(5 * time.Second)
+	for metricValue(a.failures) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a delivery failure")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
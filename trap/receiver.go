@@ -0,0 +1,534 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trap
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/collector"
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+const (
+	snmpTrapOID = "1.3.6.1.6.3.1.1.4.1.0"
+	snmpTraps   = "1.3.6.1.6.3.1.1.5"
+
+	// Reasons for dropping a trap.
+	reasonCommunity = "community"
+	reasonAuth      = "auth"
+	reasonDecode    = "decode"
+
+	// Large enough for any trap sent over UDP.
+	maxMessageSize = 65535
+	tcpIdleTimeout = 5 * time.Minute
+)
+
+// Secrets of secret providers are fetched again at most this often, even
+// when the providers don't cache them.
+var minSecretRefresh = 10 * time.Second
+
+// The traps defined by SNMPv2-MIB, which are known without any configuration.
+var standardTraps = map[string]string{
+	snmpTraps + ".1": "coldStart",
+	snmpTraps + ".2": "warmStart",
+	snmpTraps + ".3": "linkDown",
+	snmpTraps + ".4": "linkUp",
+	snmpTraps + ".5": "authenticationFailure",
+	snmpTraps + ".6": "egpNeighborLoss",
+}
+
+// Metrics are the metrics about received traps.
+type Metrics struct {
+	// Labelled by source, trap_oid and trap_name.
+	Received *prometheus.CounterVec
+	// Labelled by reason.
+	Dropped *prometheus.CounterVec
+	// Alerts that could not be delivered to Alertmanager.
+	AlertFailures prometheus.Counter
+}
+
+// Trap is a received trap or inform.
+type Trap struct {
+	Source string
+	OID    string
+	// Empty if the trap OID is unknown.
+	Name string
+	// The variables of the trap, decoded by the metrics of the configured
+	// modules.
+	Labels map[string]string
+}
+
+// Receiver handles traps and informs sent by v1, v2c and v3 agents, using
+// the communities and users of the configured auths.
+type Receiver struct {
+	logger           *slog.Logger
+	metrics          Metrics
+	collectorMetrics collector.Metrics
+	engineID         string
+	start            time.Time
+	alerts           *alerter
+	// Signalled when an update changes how often secrets are refreshed.
+	updated chan struct{}
+
+	mu sync.RWMutex
+	// The auths traps are accepted for, with the secrets they reference
+	// resolved from their secret providers on every refresh.
+	auths       map[string]*config.Auth
+	resolved    map[string]*config.Auth
+	refresh     time.Duration
+	generation  uint64
+	communities map[string]bool
+	users       map[string]*config.Auth
+	modules     []*collector.NamedModule
+	names       map[string]string
+	// Users are localized to the engine ID of the sender of a v3 trap, and
+	// to the engine ID of the receiver for informs.
+	engines          map[string]*gosnmp.GoSNMP
+	unknownEngineIDs uint32
+}
+
+// NewReceiver creates a Receiver. The engine ID identifies the receiver to
+// the senders of v3 informs, a random one is used if it is empty.
+func NewReceiver(logger *slog.Logger, engineID []byte, metrics Metrics, collectorMetrics collector.Metrics) *Receiver {
+	if len(engineID) == 0 {
+		// A local engine ID in the octets format of RFC 3411.
+		engineID = make([]byte, 13)
+		copy(engineID, []byte{0x80, 0x00, 0x00, 0x00, 0x05})
+		rand.Read(engineID[5:])
+	}
+	return &Receiver{
+		logger:           logger,
+		metrics:          metrics,
+		collectorMetrics: collectorMetrics,
+		engineID:         string(engineID),
+		start:            time.Now(),
+		alerts:           newAlerter(logger, metrics.AlertFailures),
+		updated:          make(chan struct{}, 1),
+		engines:          map[string]*gosnmp.GoSNMP{},
+	}
+}
+
+// Run delivers the alerts raised for traps, and fetches the secrets of the
+// auths again when their secret providers expire them, until the context is
+// done.
+func (r *Receiver) Run(ctx context.Context) {
+	go r.alerts.run(ctx)
+	timer := time.NewTimer(0)
+	timer.Stop()
+	for {
+		r.mu.RLock()
+		refresh := r.refresh
+		r.mu.RUnlock()
+		var expired <-chan time.Time
+		if refresh > 0 {
+			timer.Reset(refresh)
+			expired = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-r.updated:
+		case <-expired:
+			r.refreshSecrets(ctx)
+		}
+		timer.Stop()
+	}
+}
+
+// Update applies the trap settings of a configuration.
+func (r *Receiver) Update(conf *config.Config, modules map[string]*collector.NamedModule) {
+	auths := conf.Traps.Auths
+	if len(auths) == 0 {
+		for name := range conf.Auths {
+			auths = append(auths, name)
+		}
+	}
+	accepted := map[string]*config.Auth{}
+	var refresh time.Duration
+	for _, name := range auths {
+		auth := conf.Auths[name]
+		// The auths of a chain are accepted on their own.
+		if len(auth.Chain) > 0 {
+			continue
+		}
+		accepted[name] = auth
+		if ttl, ok := auth.SecretTTL(); ok {
+			ttl = max(ttl, minSecretRefresh)
+			if refresh == 0 || ttl < refresh {
+				refresh = ttl
+			}
+		}
+	}
+	resolved := r.resolveAuths(context.Background(), accepted, nil)
+
+	moduleNames := conf.Traps.Modules
+	if len(moduleNames) == 0 {
+		for name := range modules {
+			moduleNames = append(moduleNames, name)
+		}
+		// Have the same module decode a variable on every update.
+		slices.Sort(moduleNames)
+	}
+	var nmodules []*collector.NamedModule
+	for _, name := range moduleNames {
+		nmodules = append(nmodules, modules[name])
+	}
+
+	names := make(map[string]string, len(standardTraps)+len(conf.Traps.Names))
+	for oid, name := range standardTraps {
+		names[oid] = name
+	}
+	for oid, name := range conf.Traps.Names {
+		names[oid] = name
+	}
+
+	r.alerts.update(conf.Traps)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.auths = accepted
+	r.refresh = refresh
+	r.generation++
+	r.setAuths(resolved)
+	r.modules = nmodules
+	r.names = names
+	select {
+	case r.updated <- struct{}{}:
+	default:
+	}
+}
+
+// resolveAuths fetches the secrets the auths reference from their secret
+// providers. Auths whose secrets can't be fetched keep their previously
+// resolved secrets, and are dropped if they have none.
+func (r *Receiver) resolveAuths(ctx context.Context, auths, previous map[string]*config.Auth) map[string]*config.Auth {
+	resolved := make(map[string]*config.Auth, len(auths))
+	for name, auth := range auths {
+		auth, err := auth.ResolveSecrets(ctx)
+		if err == nil {
+			resolved[name] = auth
+			continue
+		}
+		if prev, ok := previous[name]; ok {
+			r.logger.Error("Error fetching secrets, keeping the previous ones for the auth", "auth", name, "err", err)
+			resolved[name] = prev
+			continue
+		}
+		r.logger.Error("Error fetching secrets, not accepting traps for the auth", "auth", name, "err", err)
+	}
+	return resolved
+}
+
+// refreshSecrets fetches the secrets of the auths again, so that traps sent
+// with rotated communities and passwords are accepted.
+func (r *Receiver) refreshSecrets(ctx context.Context) {
+	r.mu.RLock()
+	auths, previous, generation := r.auths, r.resolved, r.generation
+	r.mu.RUnlock()
+	resolved := r.resolveAuths(ctx, auths, previous)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Secrets resolved for the auths of an older configuration are stale.
+	if r.generation != generation || sameSecrets(resolved, previous) {
+		return
+	}
+	r.logger.Debug("Secrets of the trap auths changed")
+	r.setAuths(resolved)
+}
+
+// setAuths accepts traps for resolved auths, dropping the keys localized
+// with the previous passwords. It must be called with the lock held.
+func (r *Receiver) setAuths(resolved map[string]*config.Auth) {
+	communities := map[string]bool{}
+	users := map[string]*config.Auth{}
+	for name, auth := range resolved {
+		if auth.Version == 3 {
+			users[name] = auth
+		} else {
+			communities[string(auth.Community)] = true
+		}
+	}
+	r.resolved = resolved
+	r.communities = communities
+	r.users = users
+	r.engines = map[string]*gosnmp.GoSNMP{}
+}
+
+// sameSecrets reports whether two resolutions of the same auths have the
+// same secrets.
+func sameSecrets(a, b map[string]*config.Auth) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, auth := range a {
+		other, ok := b[name]
+		if !ok || auth.Community != other.Community || auth.Password != other.Password || auth.PrivPassword != other.PrivPassword {
+			return false
+		}
+	}
+	return true
+}
+
+// ListenAndServe listens on a UDP address, or a TCP address when it is
+// prefixed with tcp://, and handles the traps sent to it.
+func (r *Receiver) ListenAndServe(addr string) error {
+	if a, ok := strings.CutPrefix(addr, "tcp://"); ok {
+		l, err := net.Listen("tcp", a)
+		if err != nil {
+			return err
+		}
+		return r.ServeStream(l)
+	}
+	conn, err := net.ListenPacket("udp", strings.TrimPrefix(addr, "udp://"))
+	if err != nil {
+		return err
+	}
+	return r.ServePacket(conn)
+}
+
+// ServePacket handles the traps received on a packet connection, until the
+// connection is closed.
+func (r *Receiver) ServePacket(conn net.PacketConn) error {
+	defer conn.Close()
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if resp := r.handle(buf[:n], addr); resp != nil {
+			if _, err := conn.WriteTo(resp, addr); err != nil {
+				r.logger.Debug("Error sending trap response", "source", addr, "err", err)
+			}
+		}
+	}
+}
+
+// ServeStream handles the traps sent over the connections of a stream
+// listener, until the listener is closed.
+func (r *Receiver) ServeStream(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go r.serveConn(conn)
+	}
+}
+
+func (r *Receiver) serveConn(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		msg, err := readMessage(br)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				r.logger.Debug("Error reading trap", "source", conn.RemoteAddr(), "err", err)
+			}
+			return
+		}
+		if resp := r.handle(msg, conn.RemoteAddr()); resp != nil {
+			if _, err := conn.Write(resp); err != nil {
+				r.logger.Debug("Error sending trap response", "source", conn.RemoteAddr(), "err", err)
+				return
+			}
+		}
+	}
+}
+
+// readMessage reads a BER encoded message from a stream.
+func readMessage(br *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 2, 6)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 {
+			return nil, fmt.Errorf("invalid message length")
+		}
+		header = header[:2+n]
+		if _, err := io.ReadFull(br, header[2:]); err != nil {
+			return nil, err
+		}
+		length = 0
+		for _, b := range header[2:] {
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes is too large", length)
+	}
+	msg := make([]byte, len(header)+length)
+	copy(msg, header)
+	if _, err := io.ReadFull(br, msg[len(header):]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// handle processes a message, and returns the response to send back if any.
+func (r *Receiver) handle(msg []byte, addr net.Addr) []byte {
+	source := addr.String()
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		source = host
+	}
+	logger := r.logger.With("source", source)
+
+	var version struct {
+		Version int
+	}
+	if _, err := asn1.Unmarshal(msg, &version); err != nil {
+		logger.Debug("Error decoding trap", "err", err)
+		r.metrics.Dropped.WithLabelValues(reasonDecode).Inc()
+		return nil
+	}
+
+	var (
+		packet *gosnmp.SnmpPacket
+		reason string
+		err    error
+	)
+	if gosnmp.SnmpVersion(version.Version) == gosnmp.Version3 {
+		packet, reason, err = r.decodeV3(msg)
+	} else {
+		packet, reason, err = r.decodeCommunity(msg)
+	}
+	if err != nil {
+		logger.Debug("Dropping trap", "reason", reason, "err", err)
+		r.metrics.Dropped.WithLabelValues(reason).Inc()
+		return nil
+	}
+	switch packet.PDUType {
+	case gosnmp.Trap, gosnmp.SNMPv2Trap, gosnmp.InformRequest:
+	case gosnmp.GetRequest:
+		if packet.Version == gosnmp.Version3 {
+			// Engine ID discovery ahead of a v3 inform.
+			return r.report(packet, logger)
+		}
+		fallthrough
+	default:
+		logger.Debug("Dropping unexpected PDU", "type", packet.PDUType)
+		r.metrics.Dropped.WithLabelValues(reasonDecode).Inc()
+		return nil
+	}
+
+	t := r.trap(packet, source)
+	if t.OID == "" {
+		logger.Debug("Dropping trap without trap OID")
+		r.metrics.Dropped.WithLabelValues(reasonDecode).Inc()
+		return nil
+	}
+	logger.Debug("Received trap", "trap_oid", t.OID, "trap_name", t.Name, "labels", t.Labels, "inform", packet.PDUType == gosnmp.InformRequest)
+	r.metrics.Received.WithLabelValues(t.Source, t.OID, t.Name).Inc()
+	r.alerts.handle(t, time.Now())
+
+	if packet.PDUType != gosnmp.InformRequest {
+		return nil
+	}
+	// Acknowledge the inform with the same variables.
+	packet.PDUType = gosnmp.GetResponse
+	packet.Error = gosnmp.NoError
+	packet.ErrorIndex = 0
+	packet.MsgFlags &^= gosnmp.Reportable
+	resp, err := packet.MarshalMsg()
+	if err != nil {
+		logger.Debug("Error encoding inform response", "err", err)
+		return nil
+	}
+	return resp
+}
+
+// decodeCommunity decodes a v1 or v2c trap, if its community is accepted.
+func (r *Receiver) decodeCommunity(msg []byte) (*gosnmp.SnmpPacket, string, error) {
+	var header struct {
+		Version   int
+		Community []byte
+	}
+	if _, err := asn1.Unmarshal(msg, &header); err != nil {
+		return nil, reasonDecode, err
+	}
+	r.mu.RLock()
+	ok := r.communities[string(header.Community)]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, reasonCommunity, fmt.Errorf("unknown community")
+	}
+	g := &gosnmp.GoSNMP{}
+	packet, err := g.UnmarshalTrap(msg, false)
+	if err != nil {
+		return nil, reasonDecode, err
+	}
+	return packet, "", nil
+}
+
+// trap builds the Trap of a decoded packet.
+func (r *Receiver) trap(packet *gosnmp.SnmpPacket, source string) Trap {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	oid := trapOID(packet)
+	return Trap{
+		Source: source,
+		OID:    oid,
+		Name:   r.names[oid],
+		Labels: collector.DecodeVarbinds(packet.Variables, r.modules, r.collectorMetrics),
+	}
+}
+
+// trapOID returns the OID identifying a trap, translating v1 traps as
+// described in RFC 3584.
+func trapOID(packet *gosnmp.SnmpPacket) string {
+	if packet.PDUType == gosnmp.Trap {
+		if packet.GenericTrap == 6 {
+			// enterpriseSpecific.
+			return fmt.Sprintf("%s.0.%d", strings.TrimPrefix(packet.Enterprise, "."), packet.SpecificTrap)
+		}
+		return fmt.Sprintf("%s.%d", snmpTraps, packet.GenericTrap+1)
+	}
+	for _, v := range packet.Variables {
+		if strings.TrimPrefix(v.Name, ".") != snmpTrapOID {
+			continue
+		}
+		if oid, ok := v.Value.(string); ok {
+			return strings.TrimPrefix(oid, ".")
+		}
+	}
+	return ""
+}
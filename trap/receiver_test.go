@@ -0,0 +1,342 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/collector"
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+func newTestReceiver(t *testing.T) (*Receiver, string) {
+	t.Helper()
+	conf := &config.Config{
+		Auths: map[string]*config.Auth{
+			"public_v2": {Community: "public", Version: 2},
+			"v3": {
+				Username:      "admin",
+				SecurityLevel: "authPriv",
+				Password:      "maplesyrup",
+				AuthProtocol:  "SHA",
+				PrivPassword:  "maplesyrup",
+				PrivProtocol:  "AES",
+				Version:       3,
+			},
+		},
+		Modules: map[string]*config.Module{},
+		Traps: config.Traps{
+			Names: map[string]string{"1.3.6.1.4.1.9.9.117.2.0.2": "cefcPowerStatusChange"},
+		},
+	}
+	return serveTestReceiver(t, conf)
+}
+
+// serveTestReceiver serves a receiver updated with a configuration on a UDP
+// address.
+func serveTestReceiver(t *testing.T, conf *config.Config) (*Receiver, string) {
+	t.Helper()
+	metrics := Metrics{
+		Received: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "snmp_traps_received_total"}, []string{"source", "trap_oid", "trap_name"}),
+		Dropped:  prometheus.NewCounterVec(prometheus.CounterOpts{Name: "snmp_traps_dropped_total"}, []string{"reason"}),
+		// Alerts are tested separately.
+		AlertFailures: prometheus.NewCounter(prometheus.CounterOpts{Name: "snmp_traps_alert_delivery_failures_total"}),
+	}
+	r := NewReceiver(promslog.NewNopLogger(), nil, metrics, collector.Metrics{})
+	r.Update(conf, map[string]*collector.NamedModule{})
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.ServePacket(conn)
+	t.Cleanup(func() { conn.Close() })
+	return r, conn.LocalAddr().String()
+}
+
+func newTestSender(t *testing.T, addr string, configure func(*gosnmp.GoSNMP)) *gosnmp.GoSNMP {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &gosnmp.GoSNMP{
+		Target:    host,
+		Timeout:   time.Second,
+		Community: "public",
+		Version:   gosnmp.Version2c,
+		MaxOids:   gosnmp.MaxOids,
+		Port:      uint16(p),
+	}
+	if configure != nil {
+		configure(g)
+	}
+	if err := g.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { g.Conn.Close() })
+	return g
+}
+
+// waitFor waits until a counter reaches the expected value.
+func waitFor(t *testing.T, c prometheus.Collector, want float64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for metricValue(c) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v, got %v", want, metricValue(c))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func linkDown(inform bool) gosnmp.SnmpTrap {
+	return gosnmp.SnmpTrap{
+		Variables: []gosnmp.SnmpPDU{
+			{Name: ".1.3.6.1.6.3.1.1.4.1.0", Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.6.3.1.1.5.3"},
+			{Name: ".1.3.6.1.2.1.2.2.1.1.2", Type: gosnmp.Integer, Value: 2},
+		},
+		IsInform: inform,
+	}
+}
+
+func TestReceiverCommunity(t *testing.T) {
+	r, addr := newTestReceiver(t)
+	received := r.metrics.Received.WithLabelValues("127.0.0.1", "1.3.6.1.6.3.1.1.5.3", "linkDown")
+
+	g := newTestSender(t, addr, nil)
+	if _, err := g.SendTrap(linkDown(false)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, received, 1)
+
+	// Informs are acknowledged.
+	if _, err := g.SendTrap(linkDown(true)); err != nil {
+		t.Fatalf("inform was not acknowledged: %v", err)
+	}
+	waitFor(t, received, 2)
+
+	// v1 traps are translated to the OIDs of their v2 equivalents.
+	v1 := newTestSender(t, addr, func(g *gosnmp.GoSNMP) { g.Version = gosnmp.Version1 })
+	_, err := v1.SendTrap(gosnmp.SnmpTrap{
+		Enterprise:   ".1.3.6.1.4.1.9.9.117.2",
+		AgentAddress: "127.0.0.1",
+		GenericTrap:  6,
+		SpecificTrap: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, r.metrics.Received.WithLabelValues("127.0.0.1", "1.3.6.1.4.1.9.9.117.2.0.2", "cefcPowerStatusChange"), 1)
+
+	wrong := newTestSender(t, addr, func(g *gosnmp.GoSNMP) { g.Community = "private" })
+	if _, err := wrong.SendTrap(linkDown(false)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, r.metrics.Dropped.WithLabelValues(reasonCommunity), 1)
+}
+
+func TestReceiverV3(t *testing.T) {
+	r, addr := newTestReceiver(t)
+	received := r.metrics.Received.WithLabelValues("127.0.0.1", "1.3.6.1.6.3.1.1.5.3", "linkDown")
+	usm := func(engineID, password string) func(*gosnmp.GoSNMP) {
+		return func(g *gosnmp.GoSNMP) {
+			g.Version = gosnmp.Version3
+			g.SecurityModel = gosnmp.UserSecurityModel
+			g.MsgFlags = gosnmp.AuthPriv
+			g.SecurityParameters = &gosnmp.UsmSecurityParameters{
+				UserName:                 "admin",
+				AuthenticationProtocol:   gosnmp.SHA,
+				AuthenticationPassphrase: password,
+				PrivacyProtocol:          gosnmp.AES,
+				PrivacyPassphrase:        password,
+				AuthoritativeEngineID:    engineID,
+				AuthoritativeEngineBoots: 1,
+				AuthoritativeEngineTime:  1,
+			}
+		}
+	}
+
+	// Traps are authenticated with keys localized to the engine ID of
+	// the sender.
+	g := newTestSender(t, addr, usm("\x80\x00\x00\x00\x05sender", "maplesyrup"))
+	if _, err := g.SendTrap(linkDown(false)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, received, 1)
+
+	// Informs discover the engine ID of the receiver first.
+	g = newTestSender(t, addr, usm("", "maplesyrup"))
+	if _, err := g.SendTrap(linkDown(true)); err != nil {
+		t.Fatalf("inform was not acknowledged: %v", err)
+	}
+	waitFor(t, received, 2)
+
+	g = newTestSender(t, addr, usm("\x80\x00\x00\x00\x05sender", "wrongpassword"))
+	if _, err := g.SendTrap(linkDown(false)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, r.metrics.Dropped.WithLabelValues(reasonAuth), 1)
+
+	// gosnmp pads small message IDs.
+	discovery := &gosnmp.SnmpPacket{
+		Version:            gosnmp.Version3,
+		MsgFlags:           gosnmp.Reportable,
+		SecurityModel:      gosnmp.UserSecurityModel,
+		SecurityParameters: &gosnmp.UsmSecurityParameters{},
+		MsgID:              1,
+		PDUType:            gosnmp.GetRequest,
+	}
+	msg, err := discovery.MarshalMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, maxMessageSize)); err != nil {
+		t.Fatalf("engine discovery was not answered: %v", err)
+	}
+}
+
+func TestReceiverStream(t *testing.T) {
+	r, _ := newTestReceiver(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.ServeStream(l)
+	t.Cleanup(func() { l.Close() })
+
+	g := newTestSender(t, l.Addr().String(), func(g *gosnmp.GoSNMP) { g.Transport = "tcp" })
+	// Several messages can be sent over one connection.
+	for range 2 {
+		if _, err := g.SendTrap(linkDown(true)); err != nil {
+			t.Fatalf("inform was not acknowledged: %v", err)
+		}
+	}
+	waitFor(t, r.metrics.Received.WithLabelValues("127.0.0.1", "1.3.6.1.6.3.1.1.5.3", "linkDown"), 2)
+}
+
+func TestReceiverSecretRotation(t *testing.T) {
+	minSecretRefresh = 50 * time.Millisecond
+	defer func() { minSecretRefresh = 10 * time.Second }()
+
+	var community atomic.Value
+	community.Store("public")
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, community.Load())
+	}))
+	defer server.Close()
+	configPath := filepath.Join(t.TempDir(), "snmp.yml")
+	content := `
+secret_providers:
+  broker:
+    http:
+      url: ` + server.URL + `
+    ttl: 0s
+auths:
+  public_v2:
+    community: {provider: broker, key: community}
+    version: 2
+`
+	if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := config.LoadFile(promslog.NewNopLogger(), []string{configPath}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, addr := serveTestReceiver(t, conf)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	received := r.metrics.Received.WithLabelValues("127.0.0.1", "1.3.6.1.6.3.1.1.5.3", "linkDown")
+	g := newTestSender(t, addr, nil)
+	if _, err := g.SendTrap(linkDown(true)); err != nil {
+		t.Fatalf("inform was not acknowledged: %v", err)
+	}
+	waitFor(t, received, 1)
+
+	// The rotated community is accepted once the secret is fetched again.
+	community.Store("rotated")
+	rotated := newTestSender(t, addr, func(g *gosnmp.GoSNMP) {
+		g.Community = "rotated"
+		g.Timeout = 100 * time.Millisecond
+	})
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := rotated.SendTrap(linkDown(true)); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("rotated community was not accepted")
+		}
+	}
+	waitFor(t, received, 2)
+
+	// The fetched community is kept while the provider fails.
+	failing.Store(true)
+	time.Sleep(200 * time.Millisecond)
+	if _, err := rotated.SendTrap(linkDown(true)); err != nil {
+		t.Fatalf("inform was not acknowledged: %v", err)
+	}
+	waitFor(t, received, 3)
+}
+
+// metricValue returns the value of a collector holding a single counter or
+// gauge.
+func metricValue(c prometheus.Collector) float64 {
+	ch := make(chan prometheus.Metric, 1)
+	c.Collect(ch)
+	var pb io_prometheus_client.Metric
+	if err := (<-ch).Write(&pb); err != nil {
+		panic(err)
+	}
+	if pb.Counter != nil {
+		return pb.Counter.GetValue()
+	}
+	return pb.Gauge.GetValue()
+}
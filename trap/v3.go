@@ -0,0 +1,180 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trap
+
+import (
+	"encoding/asn1"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// Engines localized for more senders than this are forgotten, so that
+// made up engine IDs can't use up memory.
+const maxEngines = 1024
+
+// v3Header is the start of a v3 message, as defined in RFC 3412. Senders,
+// gosnmp among them, don't always encode the message ID and size minimally,
+// which encoding/asn1 rejects for integers.
+type v3Header struct {
+	Version    int
+	GlobalData struct {
+		ID            asn1.RawValue
+		MaxSize       asn1.RawValue
+		Flags         []byte
+		SecurityModel int
+	}
+	SecurityParameters []byte
+}
+
+// usmHeader is the start of the USM security parameters of a v3 message.
+type usmHeader struct {
+	EngineID []byte
+	Boots    int
+	Time     int
+	UserName []byte
+}
+
+// decodeV3 authenticates and decodes a v3 trap or inform.
+func (r *Receiver) decodeV3(msg []byte) (*gosnmp.SnmpPacket, string, error) {
+	var header v3Header
+	if _, err := asn1.Unmarshal(msg, &header); err != nil {
+		return nil, reasonDecode, err
+	}
+	if header.GlobalData.SecurityModel != int(gosnmp.UserSecurityModel) || len(header.GlobalData.Flags) != 1 {
+		return nil, reasonDecode, fmt.Errorf("unsupported security model %d", header.GlobalData.SecurityModel)
+	}
+	var usm usmHeader
+	if _, err := asn1.Unmarshal(header.SecurityParameters, &usm); err != nil {
+		return nil, reasonDecode, err
+	}
+
+	if len(usm.EngineID) == 0 {
+		// A discovery request, which is answered with the engine ID of
+		// the receiver.
+		g := &gosnmp.GoSNMP{
+			Version:            gosnmp.Version3,
+			SecurityModel:      gosnmp.UserSecurityModel,
+			SecurityParameters: &gosnmp.UsmSecurityParameters{},
+		}
+		packet, err := g.UnmarshalTrap(msg, true)
+		if err != nil {
+			return nil, reasonDecode, err
+		}
+		return packet, "", nil
+	}
+
+	r.mu.Lock()
+	required, ok := r.securityLevel(string(usm.UserName))
+	if !ok {
+		r.mu.Unlock()
+		return nil, reasonAuth, fmt.Errorf("unknown user %q", usm.UserName)
+	}
+	g, err := r.engine(string(usm.EngineID))
+	r.mu.Unlock()
+	if err != nil {
+		return nil, reasonAuth, err
+	}
+	if gosnmp.SnmpV3MsgFlags(header.GlobalData.Flags[0])&gosnmp.AuthPriv < required {
+		return nil, reasonAuth, fmt.Errorf("security level of user %q too low", usm.UserName)
+	}
+	packet, err := g.UnmarshalTrap(msg, true)
+	if err != nil {
+		return nil, reasonAuth, err
+	}
+	return packet, "", nil
+}
+
+// securityLevel returns the lowest security level the auths allow for a
+// user. It must be called with the lock held.
+func (r *Receiver) securityLevel(userName string) (gosnmp.SnmpV3MsgFlags, bool) {
+	level, found := gosnmp.AuthPriv, false
+	for _, auth := range r.users {
+		if auth.Username != userName {
+			continue
+		}
+		found = true
+		g := &gosnmp.GoSNMP{}
+		auth.ConfigureSNMP(g, "")
+		level = min(level, g.MsgFlags)
+	}
+	return level, found
+}
+
+// engine returns a decoder with the users localized to an engine ID. It
+// must be called with the lock held.
+func (r *Receiver) engine(engineID string) (*gosnmp.GoSNMP, error) {
+	if g, ok := r.engines[engineID]; ok {
+		return g, nil
+	}
+	table := gosnmp.NewSnmpV3SecurityParametersTable(gosnmp.Logger{})
+	for _, auth := range r.users {
+		g := &gosnmp.GoSNMP{}
+		auth.ConfigureSNMP(g, "")
+		usm := g.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+		// Users with keys only localized to other engines can't send
+		// traps from this one.
+		if err := auth.LocalizeKeys(usm, engineID); err != nil {
+			continue
+		}
+		if err := table.Add(auth.Username, usm); err != nil {
+			return nil, fmt.Errorf("error localizing keys of user %q: %w", auth.Username, err)
+		}
+	}
+	if len(r.engines) >= maxEngines {
+		r.engines = map[string]*gosnmp.GoSNMP{}
+	}
+	g := &gosnmp.GoSNMP{
+		Version:                     gosnmp.Version3,
+		SecurityModel:               gosnmp.UserSecurityModel,
+		TrapSecurityParametersTable: table,
+	}
+	r.engines[engineID] = g
+	return g, nil
+}
+
+// report answers a discovery request with the engine ID, boots and time of
+// the receiver, as described in RFC 3414.
+func (r *Receiver) report(request *gosnmp.SnmpPacket, logger *slog.Logger) []byte {
+	r.mu.Lock()
+	r.unknownEngineIDs++
+	count := r.unknownEngineIDs
+	r.mu.Unlock()
+
+	packet := &gosnmp.SnmpPacket{
+		Version:       gosnmp.Version3,
+		MsgID:         request.MsgID,
+		MsgFlags:      gosnmp.NoAuthNoPriv,
+		SecurityModel: gosnmp.UserSecurityModel,
+		SecurityParameters: &gosnmp.UsmSecurityParameters{
+			AuthoritativeEngineID:    r.engineID,
+			AuthoritativeEngineBoots: 1,
+			AuthoritativeEngineTime:  uint32(time.Since(r.start).Seconds()),
+		},
+		ContextEngineID: r.engineID,
+		PDUType:         gosnmp.Report,
+		RequestID:       request.RequestID,
+		Variables: []gosnmp.SnmpPDU{
+			{Name: ".1.3.6.1.6.3.15.1.1.4.0", Type: gosnmp.Counter32, Value: uint(count)},
+		},
+	}
+	resp, err := packet.MarshalMsg()
+	if err != nil {
+		logger.Debug("Error encoding report", "err", err)
+		return nil
+	}
+	return resp
+}